@@ -0,0 +1,311 @@
+// Package main is a command to inspect and repair Append Only Files, the equivalent of redis-check-aof.
+//
+// It does not start a Server: the AOF is parsed frame by frame, reporting what's inside and where the first
+// invalid command is found. The AOF can be a single file, or a directory with a manifest (see aof.Files), in which
+// case all the files are checked in order.
+//
+// Encrypted files are decrypted with --key-file (aof-encryption-key-file). Their offsets are relative to the
+// decrypted content, and only an incomplete chunk at the end can be fixed.
+//
+//	Usage: aof-check [--transcript] [--fix] [--filename appendonly.aof] [--key-file path] <appendonlydir | file.aof>
+package main
+
+import (
+	"bufio"
+	"ddia/src/server"
+	"ddia/src/storage/aof"
+	"ddia/src/storage/rdb"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	os.Exit(run(os.Args[0], os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command with args, and returns its exit status: 0 if the AOF is valid (or has been fixed), 1 if
+// it's not, and 2 if the arguments are not valid
+func run(name string, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	transcript := flags.Bool("transcript", false, "print every command found in the AOF")
+	fix := flags.Bool("fix", false, "truncate the AOF at the first invalid command")
+	filename := flags.String("filename", aof.DefaultFilename, "prefix of the files of the AOF (appendfilename)")
+	keyFile := flags.String("key-file", "", "key to decrypt the AOF (aof-encryption-key-file)")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [--transcript] [--fix] [--filename appendonly.aof] "+
+			"[--key-file path] <appendonlydir | file.aof>\n", name)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		var err error
+		if key, err = aof.ReadKeyFile(*keyFile); err != nil {
+			fmt.Fprintf(stderr, "%v\n", err)
+			return 2
+		}
+	}
+
+	if err := checkAll(stdout, flags.Arg(0), *filename, key, *transcript, *fix); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// report contains the result of analysing an AOF
+type report struct {
+	size     int64
+	validTo  int64
+	commands int
+	// keys is the number of keys found on the snapshot at the beginning of the AOF (see aof-use-rdb-preamble)
+	keys int
+	// perDB counts the commands for each database, by kind (string, list, generic, ...)
+	perDB map[int]map[string]int
+	err   error
+}
+
+// checkAll checks all the files of the AOF. Only the last file can be fixed: it's the only one that is written
+// when the server crashes, the others are not expected to be truncated.
+func checkAll(w io.Writer, path, filename string, key []byte, transcript, fix bool) error {
+	files, err := aof.Files(path, filename)
+	if err != nil {
+		return err
+	}
+
+	for i, file := range files {
+		last := i == len(files)-1
+		if len(files) > 1 {
+			fmt.Fprintf(w, "Checking %s\n", file)
+		}
+
+		if err := check(w, file, key, transcript, fix && last); err != nil {
+			if fix && !last {
+				return fmt.Errorf("%w. Only the last file of the AOF can be fixed", err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func check(w io.Writer, path string, key []byte, transcript, fix bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	fr, err := aof.NewFileReader(f, key)
+	if err != nil {
+		return err
+	}
+
+	r := analyse(w, fr, transcript)
+	r.size = stat.Size()
+
+	// The offsets of an encrypted file are relative to its decrypted content: only incomplete chunks can be fixed
+	fixable := true
+	if fr.Encrypted() && r.err != nil {
+		fixable = false
+	} else if fr.Encrypted() {
+		// The content is valid up to the last complete chunk
+		r.validTo = r.size
+		if offset, truncated := fr.Truncated(); truncated {
+			r.validTo = offset
+			r.err = fmt.Errorf("%w: incomplete encrypted chunk, last complete chunk ends at offset %d",
+				aof.ErrTruncated, offset)
+		}
+	}
+
+	printReport(w, r)
+
+	if r.err == nil {
+		return nil
+	}
+
+	if !fix {
+		return fmt.Errorf("AOF is not valid. Use the --fix option to try fixing it")
+	}
+
+	if !fixable {
+		return fmt.Errorf("AOF is not valid. Only an incomplete chunk at the end of an encrypted AOF can be fixed")
+	}
+
+	if err := os.Truncate(path, r.validTo); err != nil {
+		return fmt.Errorf("unable to truncate the AOF: %w", err)
+	}
+
+	fmt.Fprintf(w, "Successfully truncated AOF %s to %d bytes (%d bytes discarded)\n", path, r.validTo, r.size-r.validTo)
+
+	return nil
+}
+
+func analyse(w io.Writer, r io.Reader, transcript bool) report {
+	rep := report{perDB: make(map[int]map[string]int)}
+
+	br := bufio.NewReader(r)
+	preambleSize, err := analysePreamble(w, br, &rep, transcript)
+	if err != nil {
+		rep.validTo, rep.err = 0, err
+		return rep
+	}
+
+	db := 0
+	timestamp := int64(0)
+
+	s := aof.NewScanner(br)
+	for s.Scan() {
+		cmd := s.Command()
+		name := strings.ToUpper(cmd[0])
+
+		if transcript && s.Timestamp() != timestamp {
+			timestamp = s.Timestamp()
+			fmt.Fprintf(w, "%10s %s\n", "#", time.Unix(timestamp, 0).UTC().Format(time.RFC3339))
+		}
+
+		if transcript {
+			fmt.Fprintf(w, "%10d [db %d] %s\n", preambleSize+s.Start(), db, formatCommand(cmd))
+		}
+
+		if name == server.Select && len(cmd) == 2 {
+			if idx, err := strconv.Atoi(cmd[1]); err == nil {
+				db = idx
+			}
+			continue // SELECT is how the AOF tracks the database, it's not counted as a command
+		}
+
+		if rep.perDB[db] == nil {
+			rep.perDB[db] = make(map[string]int)
+		}
+		rep.perDB[db][kind(name)]++
+		rep.commands++
+	}
+
+	rep.validTo, rep.err = preambleSize+s.Offset(), s.Err()
+
+	return rep
+}
+
+// analysePreamble counts the keys of the snapshot found at the beginning of the AOF, if any, and returns its size.
+// A corrupted snapshot cannot be fixed: nothing before its end can be trusted.
+func analysePreamble(w io.Writer, r *bufio.Reader, rep *report, transcript bool) (int64, error) {
+	magic, err := r.Peek(len(rdb.Magic))
+	if err != nil || string(magic) != rdb.Magic {
+		return 0, nil
+	}
+
+	reader, err := rdb.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid preamble: %v", aof.ErrCorrupted, err)
+	}
+
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("%w: invalid preamble: %v", aof.ErrCorrupted, err)
+		}
+
+		if transcript {
+			fmt.Fprintf(w, "%10s [db %d] %s %s\n", "preamble", record.DB, record.Type, strconv.Quote(record.Key))
+		}
+
+		if rep.perDB[record.DB] == nil {
+			rep.perDB[record.DB] = make(map[string]int)
+		}
+		rep.perDB[record.DB][record.Type.String()]++
+		rep.keys++
+	}
+
+	return reader.Offset(), nil
+}
+
+func printReport(w io.Writer, r report) {
+	fmt.Fprintf(w, "AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n", r.size, r.validTo, r.size-r.validTo)
+	if r.keys > 0 {
+		fmt.Fprintf(w, "Preamble: %d keys\n", r.keys)
+	}
+	fmt.Fprintf(w, "Commands: %d\n", r.commands)
+
+	dbs := make([]int, 0, len(r.perDB))
+	for db := range r.perDB {
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+
+	for _, db := range dbs {
+		kinds := make([]string, 0, len(r.perDB[db]))
+		total := 0
+		for k, count := range r.perDB[db] {
+			kinds = append(kinds, fmt.Sprintf("%s=%d", k, count))
+			total += count
+		}
+		sort.Strings(kinds)
+
+		fmt.Fprintf(w, "  db %d: %d commands (%s)\n", db, total, strings.Join(kinds, ", "))
+	}
+
+	switch {
+	case r.err == nil:
+		fmt.Fprintf(w, "AOF is valid\n")
+	case errors.Is(r.err, aof.ErrTruncated):
+		fmt.Fprintf(w, "AOF is truncated: %v\n", r.err)
+	default:
+		fmt.Fprintf(w, "AOF is corrupted: %v\n", r.err)
+	}
+}
+
+// kind returns the kind of command (string, list, generic, ...) as defined on server.Commands
+func kind(name string) string {
+	for _, c := range server.Commands {
+		if strings.ToUpper(c.Name) == name {
+			return c.Kind
+		}
+	}
+	return "unknown"
+}
+
+// formatCommand returns a human-readable representation of the command, quoting the arguments when needed
+func formatCommand(cmd []string) string {
+	parts := make([]string, 0, len(cmd))
+	for i, arg := range cmd {
+		if i == 0 {
+			parts = append(parts, strings.ToUpper(arg))
+			continue
+		}
+
+		quoted := strconv.Quote(arg)
+		if quoted[1:len(quoted)-1] == arg && !strings.ContainsAny(arg, " ") && arg != "" {
+			parts = append(parts, arg)
+		} else {
+			parts = append(parts, quoted)
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
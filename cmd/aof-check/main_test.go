@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const (
+	selectCmd = "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n"
+	setCmd    = "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"
+	// badCmd has a bulk string with an invalid length
+	badCmd = "*3\r\n$3\r\nSET\r\n$x\r\nkey\r\n$5\r\nvalue\r\n"
+)
+
+// frame wraps payload into a frame, as written with aof-framing
+func frame(seq int, payload string) string {
+	checksum := crc32.Checksum([]byte(payload), crc32.MakeTable(crc32.Castagnoli))
+	return fmt.Sprintf("@%d %d %08x\r\n%s", seq, len(payload), checksum, payload)
+}
+
+func TestRun(t *testing.T) {
+	frame1, frame2 := frame(1, selectCmd+setCmd), frame(2, selectCmd+setCmd)
+	corruptedFrame2 := strings.Replace(frame2, "value", "vAlue", 1)
+
+	tests := []struct {
+		name    string
+		content string
+		// validTo is the offset reported as valid, and the size of the file after --fix
+		validTo int
+		status  string
+	}{
+		{name: "plain valid", content: selectCmd + setCmd, validTo: len(selectCmd + setCmd), status: "valid"},
+		{name: "plain truncated", content: selectCmd + setCmd[:10], validTo: len(selectCmd), status: "truncated"},
+		{name: "plain corrupted", content: selectCmd + badCmd + setCmd, validTo: len(selectCmd), status: "corrupted"},
+		{name: "framed valid", content: frame1 + frame2, validTo: len(frame1 + frame2), status: "valid"},
+		{name: "framed truncated", content: frame1 + frame2[:len(frame2)-5], validTo: len(frame1), status: "truncated"},
+		{name: "framed corrupted", content: frame1 + corruptedFrame2, validTo: len(frame1), status: "corrupted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), "test.aof")
+			if err := os.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("expecting no error: %v", err)
+			}
+
+			check := func(args ...string) (int, string) {
+				stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+				code := run("aof-check", append(args, file), stdout, stderr)
+				return code, stdout.String()
+			}
+
+			wantCode := 1
+			if tt.status == "valid" {
+				wantCode = 0
+			}
+
+			code, out := check()
+			if code != wantCode {
+				t.Fatalf("unexpected exit status: %d, want %d\n%s", code, wantCode, out)
+			}
+
+			report := fmt.Sprintf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n", len(tt.content), tt.validTo,
+				len(tt.content)-tt.validTo)
+			if !strings.Contains(out, report) || !strings.Contains(out, "AOF is "+tt.status) {
+				t.Fatalf("unexpected report:\n%s\nwant %q and the AOF %s", out, report, tt.status)
+			}
+
+			// The file is only modified with --fix
+			if stat, err := os.Stat(file); err != nil || stat.Size() != int64(len(tt.content)) {
+				t.Fatalf("the file has been modified without --fix: %v, %v", stat.Size(), err)
+			}
+
+			if code, out := check("--fix"); code != 0 {
+				t.Fatalf("unexpected exit status with --fix: %d, want 0\n%s", code, out)
+			}
+
+			content, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("expecting no error: %v", err)
+			}
+
+			if want := tt.content[:tt.validTo]; string(content) != want {
+				t.Fatalf("unexpected content after --fix: %q, want %q", content, want)
+			}
+
+			// Once fixed, the AOF is valid
+			if code, out := check(); code != 0 {
+				t.Fatalf("unexpected exit status after --fix: %d, want 0\n%s", code, out)
+			}
+		})
+	}
+}
+
+func TestRun_InvalidArguments(t *testing.T) {
+	for _, args := range [][]string{{}, {"--unknown", "test.aof"}, {"a.aof", "b.aof"}} {
+		if code := run("aof-check", args, &bytes.Buffer{}, &bytes.Buffer{}); code != 2 {
+			t.Fatalf("unexpected exit status with %q: %d, want 2", args, code)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Package main is a command to restore an Append Only File to a previous point: a point in time, a byte offset,
+// or the state it would have without specific commands (eg: a FLUSHDB run by mistake).
+//
+// The AOF is not modified: the commands selected are copied into a new single-file AOF, that can be loaded by
+// the server by pointing appenddirname to it. Points in time require an AOF written with aof-timestamp-enabled.
+// Offsets are the ones reported by aof-check --transcript, prefixed by the name of the file when the AOF has
+// multiple files.
+//
+// If the AOF is encrypted, --key-file must be set (aof-encryption-key-file): the AOF created is encrypted too.
+//
+//	Usage: aof-restore [--filename appendonly.aof] [--key-file path] [--until <RFC3339 | unix>]
+//	                   [--until-offset [file:]offset] [--skip [file:]offset]... <appendonlydir | file.aof> <output.aof>
+package main
+
+import (
+	"context"
+	"ddia/src/storage/aof"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// positions collects the values of a repeated flag
+type positions []string
+
+func (p *positions) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *positions) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
+
+func main() {
+	os.Exit(run(os.Args[0], os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command with args, and returns its exit status: 0 if the AOF has been restored, 1 if it cannot be
+// restored, and 2 if the arguments are not valid
+func run(name string, args []string, stdout, stderr io.Writer) int {
+	var skip positions
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	filename := flags.String("filename", aof.DefaultFilename, "prefix of the files of the AOF (appendfilename)")
+	until := flags.String("until", "", "keep the commands executed up to this time (RFC3339 or unix timestamp)")
+	untilOffset := flags.String("until-offset", "", "keep the commands that start before this [file:]offset")
+	flags.Var(&skip, "skip", "leave out the command that starts at this [file:]offset. Can be repeated.")
+	keyFile := flags.String("key-file", "", "key to decrypt the AOF, and encrypt the AOF created "+
+		"(aof-encryption-key-file)")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s [--filename appendonly.aof] [--key-file path] "+
+			"[--until <RFC3339 | unix>] [--until-offset [file:]offset] [--skip [file:]offset]... "+
+			"<appendonlydir | file.aof> <output.aof>\n", name)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	opts, err := restoreOptions(flags.Arg(0), *filename, *until, *untilOffset, skip)
+	if err == nil && *keyFile != "" {
+		var key []byte
+		key, err = aof.ReadKeyFile(*keyFile)
+		opts = append(opts, aof.RestoreWithKey(key))
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 2
+	}
+
+	if err := restore(stdout, flags.Arg(0), *filename, flags.Arg(1), opts); err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func restoreOptions(path, filename, until, untilOffset string, skip []string) ([]aof.RestoreOption, error) {
+	var opts []aof.RestoreOption
+
+	if until != "" {
+		t, err := parseTime(until)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, aof.RestoreUntil(t))
+	}
+
+	files, err := aof.Files(path, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if untilOffset != "" {
+		p, err := parsePosition(untilOffset, files)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, aof.RestoreUntilOffset(p))
+	}
+
+	for _, s := range skip {
+		p, err := parsePosition(s, files)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, aof.RestoreSkip(p))
+	}
+
+	return opts, nil
+}
+
+// restore writes the AOF restored into a new file at output. The file is removed if the restore fails.
+func restore(w io.Writer, path, filename, output string, opts []aof.RestoreOption) error {
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	stats, err := aof.Restore(context.Background(), f, path, filename, opts...)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(output)
+		return err
+	}
+
+	fmt.Fprintf(w, "AOF restored into %s: keys=%d, commands=%d, skipped=%d\n",
+		output, stats.Keys, stats.Commands, stats.Skipped)
+	if stats.Timestamp != 0 {
+		fmt.Fprintf(w, "Last command executed at %s\n", time.Unix(stats.Timestamp, 0).UTC().Format(time.RFC3339))
+	}
+	if stats.Truncated {
+		fmt.Fprintf(w, "The AOF is truncated: the incomplete command at the end has been discarded\n")
+	}
+
+	return nil
+}
+
+// parseTime parses an RFC3339 time or a unix timestamp
+func parseTime(v string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expecting RFC3339 or a unix timestamp", v)
+	}
+
+	return t, nil
+}
+
+// parsePosition parses "[file:]offset". The file can be omitted if the AOF has a single file.
+func parsePosition(v string, files []string) (aof.Position, error) {
+	file, offset := "", v
+	if i := strings.LastIndex(v, ":"); i != -1 {
+		file, offset = v[:i], v[i+1:]
+	}
+
+	n, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil || n < 0 {
+		return aof.Position{}, fmt.Errorf("invalid offset %q", v)
+	}
+
+	if file == "" {
+		if len(files) != 1 {
+			return aof.Position{}, fmt.Errorf("the AOF has %d files, the offset %q must be prefixed by the name of "+
+				"the file", len(files), v)
+		}
+		file = files[0]
+	}
+
+	return aof.Position{File: filepath.Base(file), Offset: n}, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"ddia/src/storage/aof"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	selectCmd = "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n"
+	setCmd    = "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"
+	incrCmd   = "*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n"
+	flushCmd  = "*1\r\n$7\r\nFLUSHDB\r\n"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	input := path.Join(dir, "test.aof")
+	content := "#TS:1760870400\r\n" + selectCmd + setCmd +
+		"#TS:1760870460\r\n" + selectCmd + incrCmd +
+		"#TS:1760870520\r\n" + selectCmd + flushCmd +
+		"#TS:1760870580\r\n" + selectCmd + incrCmd
+	if err := os.WriteFile(input, []byte(content), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	flushAt := strconv.Itoa(strings.Index(content, flushCmd))
+
+	set, incr := []string{"SET", "key", "value"}, []string{"INCR", "counter"}
+	tests := []struct {
+		name string
+		args []string
+		want [][]string
+	}{
+		{
+			name: "until a cutoff before the FLUSHDB",
+			args: []string{"--until", "2025-10-19T10:41:30Z"},
+			want: [][]string{{"SELECT", "0"}, set, incr},
+		},
+		{
+			name: "until a unix timestamp",
+			args: []string{"--until", "1760870459"},
+			want: [][]string{{"SELECT", "0"}, set},
+		},
+		{
+			name: "until a cutoff after the last write",
+			args: []string{"--until", "1760870580"},
+			want: [][]string{{"SELECT", "0"}, set, incr, {"FLUSHDB"}, incr},
+		},
+		{
+			name: "skipping the FLUSHDB",
+			args: []string{"--skip", flushAt},
+			want: [][]string{{"SELECT", "0"}, set, incr, incr},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := path.Join(dir, strconv.Itoa(i)+".aof")
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			if code := run("aof-restore", append(tt.args, input, output), stdout, stderr); code != 0 {
+				t.Fatalf("unexpected exit status: %d, want 0\n%s", code, stderr)
+			}
+
+			f, err := os.Open(output)
+			if err != nil {
+				t.Fatalf("expecting no error: %v", err)
+			}
+			defer func() { _ = f.Close() }()
+
+			s := aof.NewScanner(f)
+			var commands [][]string
+			for s.Scan() {
+				commands = append(commands, s.Command())
+			}
+
+			if err := s.Err(); err != nil {
+				t.Fatalf("expecting no error: %v", err)
+			}
+
+			if !reflect.DeepEqual(commands, tt.want) {
+				t.Fatalf("unexpected commands: %v, want %v", commands, tt.want)
+			}
+
+			// The output is never overwritten
+			if code := run("aof-restore", append(tt.args, input, output), stdout, stderr); code != 1 {
+				t.Fatalf("unexpected exit status: %d, want 1", code)
+			}
+		})
+	}
+
+	t.Run("a cutoff before the first write", func(t *testing.T) {
+		output := path.Join(dir, "empty.aof")
+		if code := run("aof-restore", []string{"--until", "1760870399", input, output}, &bytes.Buffer{},
+			&bytes.Buffer{}); code != 0 {
+			t.Fatalf("unexpected exit status: %d, want 0", code)
+		}
+
+		if data, err := os.ReadFile(output); err != nil || len(data) != 0 {
+			t.Fatalf("unexpected content: %q, %v, want nothing restored", data, err)
+		}
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		for _, args := range [][]string{{input}, {"--until", "yesterday", input, "x.aof"}} {
+			if code := run("aof-restore", args, &bytes.Buffer{}, &bytes.Buffer{}); code != 2 {
+				t.Fatalf("unexpected exit status with %q: %d, want 2", args, code)
+			}
+		}
+	})
+}
@@ -86,16 +86,20 @@ func getAOF(ctx context.Context, cfg config.Config) (aof io.WriteCloser, err err
 		return nil, fmt.Errorf("appendfsync %q not supported", v)
 	}
 
-	f, err := os.OpenFile(
-		cfg.GetD("appenddirname", "./redis.aof"),
-		os.O_CREATE|os.O_APPEND|os.O_WRONLY,
-		0600,
-	)
-	if err != nil {
-		return nil, err
+	framing := aof2.WithFraming(cfg.GetD("aof-framing", "no") == "yes")
+	timestamps := aof2.WithTimestamps(cfg.GetD("aof-timestamp-enabled", "no") == "yes")
+	filename := aof2.WithFilename(cfg.GetD("appendfilename", aof2.DefaultFilename))
+	opts := []aof2.Option{framing, timestamps, filename}
+
+	if keyFile := cfg.GetD("aof-encryption-key-file", ""); keyFile != "" {
+		key, err := aof2.ReadKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, aof2.WithEncryption(key))
 	}
 
-	return aof2.NewAppendOnlyFile(ctx, f, sync), nil
+	return aof2.Open(ctx, cfg.GetD("appenddirname", aof2.DefaultDir), sync, opts...)
 }
 
 func getLogger(_ config.Config) logger.Logger {
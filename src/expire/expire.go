@@ -4,43 +4,62 @@ package expire
 import (
 	"container/heap"
 	"sync"
-	"time"
 )
 
-// Expire keeps tracks of keys that must be expired
+// Tracker keeps track of keys that must be expired, across all the databases. It's an index of the deadlines
+// ordered by time: the timeout of a key is owned by the database, so a deadline returned by GetExpired must be
+// checked against it before deleting the key (it might have been removed, overwritten or renamed since).
+type Tracker interface {
+	// AddUpdate adds or updates the TTL for a given Key. time is the unix timestamp in milliseconds when it expires.
+	AddUpdate(database int, key string, time int64)
+	// GetExpired returns the element that has expired at time (unix timestamp in milliseconds), if any
+	GetExpired(time int64) (database int, key string, found bool)
+	// Remove stops tracking the TTL of key in database, if any
+	Remove(database int, key string)
+}
+
+// Expire keeps tracks of keys that must be expired, on a min-heap protected by a single lock. Adding, updating and
+// removing a key takes logarithmic time.
 type Expire struct {
 	priorityQueue  *priorityQueue
-	mapKeyPosition map[string]*item
+	mapKeyPosition map[dbKey]*item
 
 	mux sync.Mutex
 }
 
+// dbKey identifies a key in a database: the same key might have a different timeout on each database
+type dbKey struct {
+	database int
+	key      string
+}
+
 // NewExpire returns a Expire
 func NewExpire() *Expire {
 	pq := make(priorityQueue, 0)
 	return &Expire{
 		priorityQueue:  &pq,
-		mapKeyPosition: make(map[string]*item),
+		mapKeyPosition: make(map[dbKey]*item),
 	}
 }
 
-// AddUpdate adds or updates the TTL for a given Key
+// AddUpdate adds or updates the TTL for a given Key. time is the unix timestamp in milliseconds when it expires.
 func (e *Expire) AddUpdate(database int, key string, time int64) {
 	e.mux.Lock()
 	defer e.mux.Unlock()
 
-	if i, ok := e.mapKeyPosition[key]; ok {
+	k := dbKey{database: database, key: key}
+	if i, ok := e.mapKeyPosition[k]; ok {
 		// Key exists, we update it then.
 		e.priorityQueue.update(i, key, database, time)
 	} else {
 		// Key does not exist. Let's create a new one, then.
 		i := &item{database: database, key: key, priority: time}
 		heap.Push(e.priorityQueue, i)
-		e.mapKeyPosition[key] = i
+		e.mapKeyPosition[k] = i
 	}
 }
 
-// GetExpired returns the element that
+// GetExpired returns the element that has expired at time (unix timestamp in milliseconds), if any
 func (e *Expire) GetExpired(time int64) (database int, key string, found bool) {
 	e.mux.Lock()
 	defer e.mux.Unlock()
@@ -61,21 +80,21 @@ func (e *Expire) GetExpired(time int64) (database int, key string, found bool) {
 
 	// Element expired! Time to remove it from the queue and map, and return it
 	heap.Pop(e.priorityQueue)
-	delete(e.mapKeyPosition, i.key)
+	delete(e.mapKeyPosition, dbKey{database: i.database, key: i.key})
 	return i.database, i.key, true
 }
 
-func (e *Expire) TTL(key string) (int, bool) {
+// Remove stops tracking the TTL of key in database, if any
+func (e *Expire) Remove(database int, key string) {
 	e.mux.Lock()
 	defer e.mux.Unlock()
 
-	v, ok := e.mapKeyPosition[key]
+	k := dbKey{database: database, key: key}
+	v, ok := e.mapKeyPosition[k]
 	if !ok {
-		return 0, false
+		return
 	}
 
-	expireAt := time.Unix(v.priority, 0)
-	ttl := int(expireAt.Sub(time.Now()).Seconds())
-
-	return ttl, true
+	heap.Remove(e.priorityQueue, v.index)
+	delete(e.mapKeyPosition, k)
 }
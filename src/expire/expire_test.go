@@ -0,0 +1,205 @@
+package expire
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// trackers returns an instance of each tracker, with its clock (if any) at start
+func trackers(start int64) map[string]Tracker {
+	return map[string]Tracker{
+		"heap":         NewExpire(),
+		"timing-wheel": newTimingWheel(start),
+	}
+}
+
+// drain returns all the keys expired at now, as "database/key"
+func drain(tracker Tracker, now int64) []string {
+	var keys []string
+	for {
+		database, key, found := tracker.GetExpired(now)
+		if !found {
+			sort.Strings(keys)
+			return keys
+		}
+		keys = append(keys, strconv.Itoa(database)+"/"+key)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	const day = 24 * 60 * 60 * 1000
+
+	for name, tracker := range trackers(0) {
+		t.Run(name, func(t *testing.T) {
+			tracker.AddUpdate(0, "a", 10)
+			tracker.AddUpdate(1, "a", 20) // Same key on another database
+			tracker.AddUpdate(0, "b", 300)
+			tracker.AddUpdate(0, "c", 70_000)
+			tracker.AddUpdate(0, "d", 60*day) // Further than the timing wheel reaches
+			tracker.AddUpdate(0, "updated", 10)
+			tracker.AddUpdate(0, "updated", 400)
+			tracker.AddUpdate(0, "removed", 10)
+			tracker.Remove(0, "removed")
+
+			for _, tc := range []struct {
+				now  int64
+				want []string
+			}{
+				{now: 9, want: nil},
+				{now: 15, want: []string{"0/a"}},
+				{now: 299, want: []string{"1/a"}},
+				{now: 400, want: []string{"0/b", "0/updated"}},
+				{now: 69_999, want: nil},
+				{now: 70_000, want: []string{"0/c"}},
+				{now: 60*day - 1, want: nil},
+				{now: 60 * day, want: []string{"0/d"}},
+			} {
+				if got := drain(tracker, tc.now); !equal(got, tc.want) {
+					t.Fatalf("unexpected keys expired at %d: %v, want %v", tc.now, got, tc.want)
+				}
+			}
+
+			// Deadlines in the past are returned right away
+			tracker.AddUpdate(0, "past", 10)
+			if got, want := drain(tracker, 60*day), []string{"0/past"}; !equal(got, want) {
+				t.Fatalf("unexpected keys: %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestTracker_Random compares the keys returned by each tracker with the ones that should expire, on random
+// additions, updates and removals.
+func TestTracker_Random(t *testing.T) {
+	for name, tracker := range trackers(0) {
+		t.Run(name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			deadlines := make(map[string]int64)
+
+			for now := int64(0); now < 2_000_000; now += rnd.Int63n(5_000) {
+				for i := 0; i < 100; i++ {
+					key := strconv.Itoa(rnd.Intn(1_000))
+					if rnd.Intn(10) == 0 {
+						tracker.Remove(0, key)
+						delete(deadlines, key)
+						continue
+					}
+
+					deadline := now + rnd.Int63n(1_000_000)
+					tracker.AddUpdate(0, key, deadline)
+					deadlines[key] = deadline
+				}
+
+				var want []string
+				for key, deadline := range deadlines {
+					if deadline <= now {
+						want = append(want, "0/"+key)
+						delete(deadlines, key)
+					}
+				}
+				sort.Strings(want)
+
+				if got := drain(tracker, now); !equal(got, want) {
+					t.Fatalf("unexpected keys expired at %d: %v, want %v", now, got, want)
+				}
+			}
+		})
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The benchmarks simulate short-lived session keys: each one expires within the next 30 minutes
+
+func sessions(n int) (keys []string, deadlines []int64) {
+	rnd := rand.New(rand.NewSource(1))
+	keys, deadlines = make([]string, n), make([]int64, n)
+	for i := range keys {
+		keys[i], deadlines[i] = "session:"+strconv.Itoa(i), rnd.Int63n(30*60*1000)
+	}
+	return keys, deadlines
+}
+
+func BenchmarkTracker_AddUpdate(b *testing.B) {
+	for name, tracker := range trackers(0) {
+		b.Run(name, func(b *testing.B) {
+			keys, deadlines := sessions(b.N)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				tracker.AddUpdate(0, keys[i], deadlines[i])
+			}
+		})
+	}
+}
+
+func BenchmarkTracker_AddUpdateParallel(b *testing.B) {
+	for name, tracker := range trackers(0) {
+		b.Run(name, func(b *testing.B) {
+			keys, deadlines := sessions(b.N)
+			b.ResetTimer()
+
+			var n atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := n.Add(1) - 1
+					tracker.AddUpdate(0, keys[i], deadlines[i])
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkTracker_GetExpired(b *testing.B) {
+	for name, tracker := range trackers(0) {
+		b.Run(name, func(b *testing.B) {
+			keys, deadlines := sessions(b.N)
+			for i := 0; i < b.N; i++ {
+				tracker.AddUpdate(0, keys[i], deadlines[i])
+			}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, _, found := tracker.GetExpired(30 * 60 * 1000); !found {
+					b.Fatalf("expecting a key to expire")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTracker_Mixed adds keys from many goroutines while they are being expired, like the active expire cycle
+// of the server does. The clock advances a millisecond on each operation.
+func BenchmarkTracker_Mixed(b *testing.B) {
+	for name, tracker := range trackers(0) {
+		b.Run(name, func(b *testing.B) {
+			keys, deadlines := sessions(b.N)
+			b.ResetTimer()
+
+			var clock atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := clock.Add(1)
+					if i%10 == 0 {
+						tracker.GetExpired(i)
+						continue
+					}
+					tracker.AddUpdate(0, keys[i-1], i+deadlines[i-1])
+				}
+			})
+		})
+	}
+}
@@ -6,7 +6,7 @@ type item struct {
 	key      string // Redis  "key"
 	database int    // Redis database the Key resides in
 
-	priority int64 // Unit timestamp
+	priority int64 // Unix timestamp in milliseconds
 	// The index is needed by update and is maintained by the heap.Interface methods.
 	index int // The index of the item in the heap.
 }
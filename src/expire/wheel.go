@@ -0,0 +1,351 @@
+package expire
+
+import (
+	"hash/maphash"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The timing wheel has the layout of the timers of the Linux kernel: the first level has a slot per millisecond
+// for the next 256 milliseconds, and each of the next levels has 64 slots, each one as long as the whole previous
+// level. The fifth level covers ~50 days: later deadlines are kept on its last slot until they get closer.
+const (
+	wheelRootBits  = 8
+	wheelLevelBits = 6
+	wheelLevels    = 4 // Besides the root level
+
+	wheelRootSize  = 1 << wheelRootBits
+	wheelLevelSize = 1 << wheelLevelBits
+	wheelRootMask  = wheelRootSize - 1
+	wheelLevelMask = wheelLevelSize - 1
+
+	// wheelMaxDistance is the furthest deadline that fits in the wheel, in milliseconds from now
+	wheelMaxDistance = 1<<(wheelRootBits+wheelLevels*wheelLevelBits) - 1
+
+	// wheelShards is the number of parts of the index of the keys, each one with its own lock
+	wheelShards = 64
+)
+
+// TimingWheel keeps track of keys that must be expired, like Expire, using a hierarchical timing wheel: adding,
+// updating and removing a key takes constant time, and only locks the slot of its deadline and a shard of the
+// index of the keys. The clock of the wheel advances when GetExpired is called, which must be called with the
+// current time.
+//
+// Many clients can add keys at once: they only share the read lock of the clock. Advancing the clock takes the
+// write lock, for as long as it takes to move the keys of the slots that have expired.
+type TimingWheel struct {
+	// clockMux protects current: slots are chosen relative to it
+	clockMux sync.RWMutex
+	// current is the next millisecond to be processed by advance
+	current int64
+	root    [wheelRootSize]wheelSlot
+	levels  [wheelLevels][wheelLevelSize]wheelSlot
+	// tracked is the number of entries on the slots of each level, the root first, to skip advancing slot by slot
+	// through the empty ones
+	tracked [wheelLevels + 1]atomic.Int64
+
+	seed   maphash.Seed
+	shards [wheelShards]wheelShard
+
+	// expired are the entries that have been taken out of their slots by advance, to be returned by GetExpired
+	expired    []*wheelEntry
+	expiredMux sync.Mutex
+}
+
+type wheelEntry struct {
+	database  int
+	key       string
+	expiresAt int64
+	// slot is where the entry is, or nil once it's been moved to the expired entries, and level is the level of the
+	// slot. They are modified with the lock of the clock held, and read with at least its read lock held.
+	slot  *wheelSlot
+	level int
+	// prev and next link the entries of the same slot
+	prev, next *wheelEntry
+}
+
+// wheelSlot is a doubly linked list of entries, so they are added and removed without allocating
+type wheelSlot struct {
+	mux  sync.Mutex
+	head *wheelEntry
+	len  int
+}
+
+// wheelShard is a part of the index of the keys being tracked
+type wheelShard struct {
+	mux     sync.Mutex
+	entries map[dbKey]*wheelEntry
+}
+
+// NewTimingWheel returns a TimingWheel whose clock starts now
+func NewTimingWheel() *TimingWheel {
+	return newTimingWheel(time.Now().UnixMilli())
+}
+
+func newTimingWheel(now int64) *TimingWheel {
+	w := &TimingWheel{current: now, seed: maphash.MakeSeed()}
+	for i := range w.shards {
+		w.shards[i].entries = make(map[dbKey]*wheelEntry)
+	}
+	return w
+}
+
+// AddUpdate adds or updates the TTL for a given Key. time is the unix timestamp in milliseconds when it expires.
+func (w *TimingWheel) AddUpdate(database int, key string, time int64) {
+	w.clockMux.RLock()
+	defer w.clockMux.RUnlock()
+
+	k := dbKey{database: database, key: key}
+	shard := w.shard(k)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	if old, ok := shard.entries[k]; ok {
+		w.unlink(old)
+	}
+
+	e := &wheelEntry{database: database, key: key, expiresAt: time}
+	shard.entries[k] = e
+	w.link(e)
+}
+
+// GetExpired returns the element that has expired at time (unix timestamp in milliseconds), if any
+func (w *TimingWheel) GetExpired(time int64) (database int, key string, found bool) {
+	for {
+		e, ok := w.popExpired()
+		if !ok {
+			if !w.advance(time) {
+				return 0, "", false
+			}
+			continue
+		}
+
+		// The key might have been removed or updated after its entry was taken out of its slot
+		k := dbKey{database: e.database, key: e.key}
+		shard := w.shard(k)
+		shard.mux.Lock()
+		current := shard.entries[k] == e
+		if current {
+			delete(shard.entries, k)
+		}
+		shard.mux.Unlock()
+
+		if current {
+			return e.database, e.key, true
+		}
+	}
+}
+
+// Remove stops tracking the TTL of key in database, if any
+func (w *TimingWheel) Remove(database int, key string) {
+	w.clockMux.RLock()
+	defer w.clockMux.RUnlock()
+
+	k := dbKey{database: database, key: key}
+	shard := w.shard(k)
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+
+	if e, ok := shard.entries[k]; ok {
+		w.unlink(e)
+		delete(shard.entries, k)
+	}
+}
+
+// advance moves the clock up to now, taking the entries of the slots that have expired. Returns true if any entry
+// has been taken.
+func (w *TimingWheel) advance(now int64) bool {
+	w.clockMux.Lock()
+	defer w.clockMux.Unlock()
+
+	var expired []*wheelEntry
+	for w.current <= now && len(expired) == 0 {
+		idx := w.current & wheelRootMask
+		if idx == 0 {
+			w.cascade()
+		}
+
+		if next := w.nextCascade(); next > w.current+1 {
+			// The slots up to the next cascade are empty
+			if next > now+1 {
+				next = now + 1
+			}
+			w.current = next
+			continue
+		}
+
+		expired = w.root[idx].take()
+		w.tracked[0].Add(-int64(len(expired)))
+		w.current++
+	}
+
+	if len(expired) == 0 {
+		return false
+	}
+
+	for _, e := range expired {
+		e.slot = nil
+	}
+
+	w.expiredMux.Lock()
+	w.expired = append(w.expired, expired...)
+	w.expiredMux.Unlock()
+
+	return true
+}
+
+// cascade moves the entries of the slots of the upper levels that start at the current millisecond to the levels
+// below. The caller must hold the write lock of the clock.
+func (w *TimingWheel) cascade() {
+	for level := 0; level < wheelLevels; level++ {
+		shift := wheelRootBits + level*wheelLevelBits
+		idx := (w.current >> shift) & wheelLevelMask
+
+		entries := w.levels[level][idx].take()
+		w.tracked[level+1].Add(-int64(len(entries)))
+		for _, e := range entries {
+			w.link(e)
+		}
+
+		if idx != 0 {
+			return // The upper levels have not completed a turn
+		}
+	}
+}
+
+// nextCascade returns the next millisecond at which entries might be moved to the root level. If the root level is
+// not empty, it's the current one. Otherwise, it's the next cascade of the first level that is not empty, or
+// math.MaxInt64 if the wheel is empty. The caller must hold the write lock of the clock.
+func (w *TimingWheel) nextCascade() int64 {
+	if w.tracked[0].Load() != 0 {
+		return w.current
+	}
+
+	for level := 0; level < wheelLevels; level++ {
+		if w.tracked[level+1].Load() != 0 {
+			mask := int64(1)<<(wheelRootBits+level*wheelLevelBits) - 1
+			return (w.current | mask) + 1
+		}
+	}
+
+	return math.MaxInt64
+}
+
+// link adds e to the slot of its deadline. The caller must hold the write lock of the clock, or its read lock and
+// the lock of the shard of e.
+func (w *TimingWheel) link(e *wheelEntry) {
+	distance := e.expiresAt - w.current
+
+	if distance < 0 {
+		// The slot of its deadline has already been processed: it's returned by the next call to GetExpired
+		e.slot = nil
+		w.expiredMux.Lock()
+		w.expired = append(w.expired, e)
+		w.expiredMux.Unlock()
+		return
+	}
+
+	var slot *wheelSlot
+	level := -1 // The root level
+	switch {
+	case distance < wheelRootSize:
+		slot = &w.root[e.expiresAt&wheelRootMask]
+	default:
+		expiresAt := e.expiresAt
+		if distance > wheelMaxDistance {
+			expiresAt = w.current + wheelMaxDistance // It's moved to the right slot when it gets closer
+			distance = wheelMaxDistance
+		}
+
+		level = 0
+		for distance >= 1<<(wheelRootBits+(level+1)*wheelLevelBits) {
+			level++
+		}
+		shift := wheelRootBits + level*wheelLevelBits
+		slot = &w.levels[level][(expiresAt>>shift)&wheelLevelMask]
+	}
+
+	slot.add(e)
+	e.slot, e.level = slot, level+1
+	w.tracked[e.level].Add(1)
+}
+
+// unlink removes e from its slot, if it's still on it. The caller must hold the lock of the clock, and of the
+// shard of e.
+func (w *TimingWheel) unlink(e *wheelEntry) {
+	if e.slot == nil {
+		return // It's on the expired entries, GetExpired skips it
+	}
+
+	e.slot.remove(e)
+	e.slot = nil
+	w.tracked[e.level].Add(-1)
+}
+
+func (w *TimingWheel) popExpired() (*wheelEntry, bool) {
+	w.expiredMux.Lock()
+	defer w.expiredMux.Unlock()
+
+	if len(w.expired) == 0 {
+		return nil, false
+	}
+
+	e := w.expired[len(w.expired)-1]
+	w.expired[len(w.expired)-1] = nil
+	w.expired = w.expired[:len(w.expired)-1]
+	return e, true
+}
+
+func (w *TimingWheel) shard(k dbKey) *wheelShard {
+	return &w.shards[maphash.String(w.seed, k.key)%wheelShards]
+}
+
+func (s *wheelSlot) add(e *wheelEntry) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	e.prev, e.next = nil, s.head
+	if s.head != nil {
+		s.head.prev = e
+	}
+	s.head = e
+	s.len++
+}
+
+func (s *wheelSlot) remove(e *wheelEntry) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		s.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	e.prev, e.next = nil, nil
+	s.len--
+}
+
+// take empties the slot, returning its entries
+func (s *wheelSlot) take() []*wheelEntry {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.len == 0 {
+		return nil
+	}
+
+	entries := make([]*wheelEntry, 0, s.len)
+	for e := s.head; e != nil; {
+		next := e.next
+		e.prev, e.next = nil, nil
+		entries = append(entries, e)
+		e = next
+	}
+	s.head, s.len = nil, 0
+	return entries
+}
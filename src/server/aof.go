@@ -1,32 +1,380 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"ddia/src/resp"
 	"ddia/src/storage/aof"
+	"ddia/src/storage/rdb"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"time"
 )
 
-// restoreAOF reads the AOF file and restores it into the server to keep the old state
+// rewriteItemsPerCommand is the maximum number of elements of a list written on a single RPUSH when rewriting
+// the AOF. It prevents huge commands for huge lists.
+const rewriteItemsPerCommand = 64
+
+// rewriter is implemented by the AOFs that can be compacted (see aof.AppendOnlyFile)
+type rewriter interface {
+	StartRewrite() (*aof.Rewrite, error)
+	NeedsRewrite(percentage int, minSize int64) bool
+}
+
+// restoreAOF reads the files of the AOF in order, and restores them into the server to keep the old state
 func (s *Server) restoreAOF(ctx context.Context) error {
-	aofPath := s.config.GetD("appenddirname", "./redis.aof")
+	dir := s.config.GetD("appenddirname", aof.DefaultDir)
+	filename := s.config.GetD("appendfilename", aof.DefaultFilename)
+	loadTruncated := s.config.GetD("aof-load-truncated", "yes") == "yes"
 
-	importAOF, err := aof.NewImportAppendOnlyFile(ctx, aofPath)
+	key, err := s.aofKey()
+	if err != nil {
+		return err
+	}
+
+	files, err := aof.Files(dir, filename)
 	if errors.Is(err, os.ErrNotExist) {
 		return nil // AOF does not exist. Nothing to import.
 	} else if err != nil {
 		return err
 	}
 
-	oldAOF := s.handlers.aof
-	defer func() {
-		s.handlers.aof = oldAOF // Resume the AOF configuration to the initial state after restoration
-	}()
-	s.handlers.aof = io.Discard // We don't want to record new records on the AOF when restoring the AOF!
+	var total int64
+	for _, path := range files {
+		if stat, err := os.Stat(path); err == nil {
+			total += stat.Size()
+		}
+	}
+
+	s.handlers.loading.start(total)
+
+	for i, path := range files {
+		// Only the last file can be truncated by a crash: the others are not written anymore
+		last := i == len(files)-1
+		if err := s.importAOF(ctx, path, key, loadTruncated && last); err != nil {
+			if errors.Is(err, aof.ErrTruncated) && !last {
+				s.logger.Printf("[ERROR] %v. Only the last file of the AOF can be truncated", err)
+			} else if errors.Is(err, aof.ErrTruncated) {
+				s.logger.Printf("[ERROR] %v. Set aof-load-truncated to yes to load the AOF up to the last valid command", err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// aofKey returns the key the AOF is encrypted with (see aof-encryption-key-file), nil if it's not encrypted
+func (s *Server) aofKey() ([]byte, error) {
+	keyFile := s.config.GetD("aof-encryption-key-file", "")
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	return aof.ReadKeyFile(keyFile)
+}
+
+// importAOF replays the commands stored on the file found at path. If the file is encrypted, it's decrypted with
+// key.
+func (s *Server) importAOF(ctx context.Context, path string, key []byte, loadTruncated bool) error {
+	importAOF, err := aof.NewImportAppendOnlyFile(ctx, path,
+		aof.WithLoadTruncated(loadTruncated), aof.WithPreambleLoader(s.loadRecord), aof.WithDecryption(key),
+		aof.WithProgress(func(n int) { s.handlers.loading.loaded.Add(int64(n)) }))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // The last incremental file is created when the AOF is opened
+	} else if err != nil {
+		return err
+	}
 
 	c := newClient(importAOF, s.options.dbs[0])
 	c.authenticated = true // Pretend that we've successfully authenticated to the server
+	c.replaying = true     // We don't want to record new records on the AOF when restoring the AOF!
+
+	if err := s.handleRequest(ctx, c); err != nil {
+		return err
+	}
+
+	if offset, truncated := importAOF.Truncated(); truncated {
+		s.logger.Printf("[WARNING] AOF %q was truncated: loaded up to offset %d and truncated the file to that "+
+			"size, because aof-load-truncated is enabled", path, offset)
+	}
+
+	return nil
+}
+
+// loadRecord stores a key found on the snapshot at the beginning of the AOF (see aof-use-rdb-preamble)
+func (s *Server) loadRecord(r rdb.Record) error {
+	if r.DB < 0 || r.DB >= len(s.options.dbs) {
+		return fmt.Errorf("%w: %d", ErrDBIndexOutOfRange, r.DB)
+	}
+
+	if r.ExpiresAt != 0 && r.ExpiresAt <= time.Now().UnixMilli() {
+		return nil // The key has expired while the server was down
+	}
+
+	db := s.options.dbs[r.DB]
+	db.Lock()
+	defer db.Unlock()
+
+	if err := restoreKey(db, r); err != nil {
+		return err
+	}
+
+	if r.ExpiresAt != 0 {
+		s.expire.AddUpdate(r.DB, r.Key, r.ExpiresAt)
+	}
+
+	return nil
+}
+
+// rewriteAOFWhenNeeded to be called as goroutine. Every second checks if the AOF has grown enough to be
+// rewritten (see auto-aof-rewrite-percentage and auto-aof-rewrite-min-size), or it has discarded writes while
+// failing (see aof.ErrDiscarded), even if the automatic rewrites are disabled. To stop it, close the context.
+func (s *Server) rewriteAOFWhenNeeded(ctx context.Context) {
+	rw, ok := s.handlers.aof.(rewriter)
+	if !ok {
+		return // Nothing to rewrite
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			if !rw.NeedsRewrite(s.options.autoAOFRewritePercentage, s.options.autoAOFRewriteMinSize) {
+				continue
+			}
+
+			s.logger.Printf("Starting automatic rewriting of AOF")
+			err := s.handlers.rewriteAOF(s.options.dbs, s.locks, s.schedules, s.options.aofUseRDBPreamble)
+			if err != nil && !errors.Is(err, aof.ErrRewriteInProgress) {
+				s.logger.Printf("[ERROR] unable to rewrite AOF: %v", err)
+			}
+		}
+	}
+}
+
+// rewriteAOF compacts the AOF in the background, replacing it with the minimal set of commands that recreate
+// the current dataset. If preamble is true, the dataset is written as a snapshot, which is faster to load.
+//
+// All the databases are locked while the dataset is being copied into memory, and the writes received from then
+// on go to a new incremental file of the AOF. There is no fork(2) in Go, so unlike Redis we cannot rely on
+// copy-on-write: copying the dataset blocks the server, and needs as much memory as the dataset.
+//
+// The pending schedules (see SCHEDULE) are written as commands after the dataset, even with the preamble.
+func (h *Handlers) rewriteAOF(dbs []Storage, locks *dbLocks, sched *scheduler, preamble bool) error {
+	write, err := h.startRewrite(dbs, locks, sched, preamble)
+	if err != nil {
+		return err
+	}
+
+	go func() { _ = write() }()
+
+	return nil
+}
+
+// startRewrite starts a rewrite of the AOF (see rewriteAOF), and copies the dataset. It returns the function
+// that writes the copy into the AOF, and commits the rewrite: it's aborted if the copy cannot be written.
+func (h *Handlers) startRewrite(dbs []Storage, locks *dbLocks, sched *scheduler, preamble bool) (func() error, error) {
+	rw, ok := h.aof.(rewriter)
+	if !ok {
+		return nil, aof.ErrRewriteNotSupported
+	}
+
+	sched.mux.Lock()
+	unlock := locks.lockAll()
+
+	r, err := rw.StartRewrite()
+	var records []rdb.Record
+	var schedules []scheduled
+	if err == nil {
+		records = h.snapshot(dbs)
+		schedules = sched.list()
+	}
+
+	unlock()
+	sched.mux.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		start := time.Now()
+		write := writeRecords
+		if preamble {
+			write = func(_ io.Writer, records []rdb.Record) error { return writePreamble(r.Preamble(), records) }
+		}
+
+		if err := write(r, records); err != nil {
+			_ = r.Abort()
+			h.logger.Printf("[ERROR] background AOF rewrite: %v", err)
+			return err
+		}
+
+		if err := writeSchedules(r, schedules); err != nil {
+			_ = r.Abort()
+			h.logger.Printf("[ERROR] background AOF rewrite: %v", err)
+			return err
+		}
+
+		if err := r.Commit(); err != nil {
+			h.logger.Printf("[ERROR] background AOF rewrite: %v", err)
+			return err
+		}
+
+		h.logger.Printf("Background AOF rewrite finished successfully in %s", time.Since(start))
+		return nil
+	}, nil
+}
+
+// rewriteAOFNow is rewriteAOF, but it returns once the rewrite is committed. It's used when the AOF holds another
+// dataset than the one in memory (eg: it has been replaced by the one of the master): until the rewrite is
+// committed, a restart would restore the old one.
+func (h *Handlers) rewriteAOFNow(dbs []Storage, locks *dbLocks, sched *scheduler, preamble bool) error {
+	write, err := h.startRewrite(dbs, locks, sched, preamble)
+	if err != nil {
+		return err
+	}
+
+	return write()
+}
+
+// snapshot copies the content of all the databases. The caller must hold the locks of all of them. On a replica,
+// the keys whose timeout has passed are copied too: they are deleted once the master sends the DEL.
+func (h *Handlers) snapshot(dbs []Storage) []rdb.Record {
+	h.replication.keepExpired.Add(1)
+	defer h.replication.keepExpired.Add(-1)
+
+	var records []rdb.Record
+	for idx, db := range dbs {
+		for _, key := range db.Keys() {
+			if r, ok := dumpKey(db, idx, key); ok {
+				records = append(records, r)
+			}
+		}
+	}
+
+	return records
+}
+
+// dumpKey copies key, its value and its timeout, from the database idx. Returns false if the key does not exist.
+// The caller must hold the lock of the database.
+func dumpKey(db Storage, idx int, key string) (rdb.Record, bool) {
+	kind, err := db.Type(key)
+	if err != nil {
+		return rdb.Record{}, false
+	}
+
+	r := rdb.Record{DB: idx, Key: key}
+	switch kind {
+	case "string":
+		r.Type = rdb.TypeString
+		r.Value, err = db.Get(key)
+	case "list":
+		r.Type = rdb.TypeList
+		r.List, err = db.LRange(key, 0, -1)
+	default:
+		err = fmt.Errorf("unknown kind %q", kind)
+	}
+	if err != nil {
+		return rdb.Record{}, false
+	}
+
+	if expiresAt, ok := db.ExpiresAt(key); ok {
+		r.ExpiresAt = expiresAt
+	}
+
+	return r, true
+}
+
+// restoreKey stores the key of r, with its value and timeout, into db, whatever the database of r is. The key
+// must not exist. The caller must hold the lock of the database, and add the timeout to the expire tracker.
+func restoreKey(db Storage, r rdb.Record) error {
+	var err error
+	switch r.Type {
+	case rdb.TypeString:
+		err = db.Set(r.Key, r.Value)
+	case rdb.TypeList:
+		_, err = db.RPush(r.Key, r.List)
+	default:
+		err = fmt.Errorf("unknown type %q", r.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.ExpiresAt != 0 {
+		return db.SetExpire(r.Key, r.ExpiresAt)
+	}
+
+	return nil
+}
+
+// writePreamble writes records into w as a snapshot (see aof-use-rdb-preamble)
+func writePreamble(w io.Writer, records []rdb.Record) error {
+	rw, err := rdb.NewWriter(w)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if err := rw.Write(r); err != nil {
+			return err
+		}
+	}
+
+	return rw.Close()
+}
+
+// writeRecords writes the commands needed to recreate records into w, in RESP format. Each call to w.Write
+// contains complete commands.
+func writeRecords(w io.Writer, records []rdb.Record) error {
+	buf := &bytes.Buffer{}
+
+	lastDB := -1
+	write := func(args ...string) {
+		_, _ = resp.NewArray(args).WriteTo(buf) // Writing into a bytes.Buffer never fails
+	}
+
+	for _, r := range records {
+		buf.Reset()
+
+		if r.DB != lastDB {
+			write("SELECT", strconv.Itoa(r.DB))
+			lastDB = r.DB
+		}
+
+		switch r.Type {
+		case rdb.TypeString:
+			write("SET", r.Key, r.Value)
+		case rdb.TypeList:
+			for i := 0; i < len(r.List); i += rewriteItemsPerCommand {
+				end := i + rewriteItemsPerCommand
+				if end > len(r.List) {
+					end = len(r.List)
+				}
+
+				write(append([]string{"RPUSH", r.Key}, r.List[i:end]...)...)
+			}
+		}
+
+		if r.ExpiresAt != 0 {
+			write("PEXPIREAT", r.Key, strconv.FormatInt(r.ExpiresAt, 10))
+		}
+
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
 
-	return s.handleRequest(ctx, c)
+	return nil
 }
@@ -3,7 +3,9 @@ package server
 import (
 	"bytes"
 	"ddia/src/resp"
+	"ddia/src/storage/aof"
 	"fmt"
+	"io"
 	"strconv"
 )
 
@@ -12,30 +14,157 @@ import (
 // If the change has been done correctly in memory, we write the operation on the AOF file
 // with the lock still acquired.
 // Atomic does not support atomic operations between two different databases.
+//
+// With appendfsync always, atomic returns once the operation is on disk. The DB lock is released before
+// waiting, so concurrent writers are synced together (group commit). Meanwhile, other clients might read
+// the new value before it's durable.
+//
+// If the AOF fails, ErrPersistenceFailed is returned. The change has been done in memory, and it will be
+// persisted once the disk recovers.
 func (h *Handlers) atomic(c *client, fnx func() error) error {
+	offset, err := h.atomicLocked(c, fnx)
+	if err != nil {
+		return err
+	}
+
+	if err := h.waitAOF(offset); err != nil {
+		return fmt.Errorf("%w: %v", ErrPersistenceFailed, err)
+	}
+
+	return nil
+}
+
+func (h *Handlers) atomicLocked(c *client, fnx func() error) (uint64, error) {
 	c.db.Lock()
 	defer c.db.Unlock()
 
 	if err := fnx(); err != nil {
-		return err
+		return 0, err
 	}
 
-	if err := h.writeToAOF(c); err != nil {
+	offset, err := h.writeToAOF(c)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrPersistenceFailed, err)
+	}
+
+	return offset, nil
+}
+
+// atomicDBs is atomic for the commands that access several databases (eg: MOVE). The locks of the databases given
+// are held, instead of the one of the database selected by the client. They are acquired in order (see dbLocks).
+func (h *Handlers) atomicDBs(c *client, locks *dbLocks, indexes []int, fnx func() error) error {
+	return h.atomicWith(c, func() func() { return locks.lock(indexes...) }, fnx)
+}
+
+// atomicAllDBs is atomicDBs for the commands that access all the databases (eg: FLUSHALL)
+func (h *Handlers) atomicAllDBs(c *client, locks *dbLocks, fnx func() error) error {
+	return h.atomicWith(c, locks.lockAll, fnx)
+}
+
+// atomicWith is atomic, holding the locks acquired by lock instead of the one of the database selected
+func (h *Handlers) atomicWith(c *client, lock func() (unlock func()), fnx func() error) error {
+	offset, err := func() (uint64, error) {
+		unlock := lock()
+		defer unlock()
+
+		if err := fnx(); err != nil {
+			return 0, err
+		}
+
+		offset, err := h.writeToAOF(c)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrPersistenceFailed, err)
+		}
+
+		return offset, nil
+	}()
+	if err != nil {
 		return err
 	}
 
+	if err := h.waitAOF(offset); err != nil {
+		return fmt.Errorf("%w: %v", ErrPersistenceFailed, err)
+	}
+
+	return nil
+}
+
+// aofStats is implemented by AOFs that report their state (see aof.AppendOnlyFile)
+type aofStats interface {
+	Stats() aof.Stats
+}
+
+// rewritingAOF returns true while the AOF is being rewritten
+func (h *Handlers) rewritingAOF() bool {
+	stats, ok := h.aof.(aofStats)
+	return ok && stats.Stats().RewriteInProgress
+}
+
+// checkPersistence returns ErrPersistenceFailed if c is running a write command while the AOF is failing. As in
+// Redis, the master is not refused: the replica must apply its stream, or it would diverge from it. Its writes are
+// done in memory, and written into the AOF once the disk recovers.
+func (h *Handlers) checkPersistence(c *client) error {
+	cmd, ok := getCommand(c.command())
+	if !ok || cmd.Operation != "write" || c.replaying || c.master {
+		return nil
+	}
+
+	stats, ok := h.aof.(aofStats)
+	if !ok {
+		return nil
+	}
+
+	if err := stats.Stats().Err; err != nil {
+		return fmt.Errorf("%w: %v", ErrPersistenceFailed, err)
+	}
+
 	return nil
 }
 
+// groupCommitter is implemented by AOFs that can write without waiting for the data to be synced to disk, so
+// that the writes of concurrent clients can be synced at once (see aof.AppendOnlyFile)
+type groupCommitter interface {
+	Append(p []byte) (uint64, error)
+	WaitSync(offset uint64) error
+}
+
+// waitAOF blocks until the AOF is synced up to offset, as returned by writeToAOF or propagate
+func (h *Handlers) waitAOF(offset uint64) error {
+	gc, ok := h.aof.(groupCommitter)
+	if !ok || offset == 0 {
+		return nil
+	}
+
+	return gc.WaitSync(offset)
+}
+
+// syncer is implemented by AOFs that can be synced on demand, whatever their sync option (see aof.AppendOnlyFile)
+type syncer interface {
+	SyncUpTo(offset uint64) error
+}
+
+// syncAOF blocks until the AOF is synced up to offset, as returned by writeToAOF or propagate, whatever the
+// appendfsync option. It returns false if the AOF is disabled, or it cannot be synced.
+func (h *Handlers) syncAOF(offset uint64) (bool, error) {
+	s, ok := h.aof.(syncer)
+	if !ok {
+		return false, nil
+	}
+
+	return true, s.SyncUpTo(offset)
+}
+
 // writeToAOF persists the executed command if the AOF storage has been set, and
-// the command being executed is a "write" command. It always pre-appends the
-// SELECT {DB_ID} number before each command, to make sure that operation is
-// going to be re-played in the correct DB. It obvious that we could memorize
+// the command being executed is a "write" command, and sends it to the replicas.
+// It always pre-appends the SELECT {DB_ID} number before each command, to make
+// sure that operation is going to be re-played in the correct DB. It obvious that we could memorize
 // into which DB did we write the last time, and avoid the same SELECT over and
 // over. It's an optimization to be done in the future.
-func (h *Handlers) writeToAOF(c *client) error {
-	if h.aof == nil {
-		return nil
+//
+// It returns the offset to wait for the command to be durable (see waitAOF).
+func (h *Handlers) writeToAOF(c *client) (uint64, error) {
+	if c.replaying {
+		return 0, nil
 	}
 
 	cmd, ok := getCommand(c.command())
@@ -44,22 +173,57 @@ func (h *Handlers) writeToAOF(c *client) error {
 		panic(fmt.Errorf("command %q is not a known command. AOF might be corrupted", c.command()))
 	}
 
-	if cmd.Operation != "write" {
-		return nil
+	if cmd.Operation != "write" || c.argsWriter == nil {
+		return 0, nil
+	}
+
+	offset, err := h.propagate(c.dbIdx, c.argsWriter)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset != 0 {
+		c.aofOffset = offset
+	}
+	if h.replication.streaming.Load() {
+		c.replOffset = h.replication.streamOffset()
+	}
+
+	return offset, nil
+}
+
+// propagate writes cmd into the AOF, preceded by SELECT {dbIdx}, and into the stream sent to the replicas (see
+// replication). It's used to record commands that have not been sent by any client (eg: deleting an expired
+// key). The caller must hold the lock of the database, to make sure that the order of the commands in the AOF
+// is correct.
+//
+// The command might not be on disk yet when propagate returns: use waitAOF with the offset returned.
+func (h *Handlers) propagate(dbIdx int, cmd io.WriterTo) (uint64, error) {
+	if h.aof == nil && !h.replication.streaming.Load() {
+		return 0, nil
 	}
 
 	buf := &bytes.Buffer{}
-	sel := resp.NewArray([]string{"SELECT", strconv.Itoa(c.dbIdx)})
+	sel := resp.NewArray([]string{"SELECT", strconv.Itoa(dbIdx)})
 	if _, err := sel.WriteTo(buf); err != nil {
-		return err
+		return 0, err
 	}
-	if _, err := c.argsWriter.WriteTo(buf); err != nil {
-		return err
+	if _, err := cmd.WriteTo(buf); err != nil {
+		return 0, err
+	}
+
+	h.replication.feed(buf.Bytes())
+	if h.aof == nil {
+		return 0, nil
+	}
+
+	if gc, ok := h.aof.(groupCommitter); ok {
+		return gc.Append(buf.Bytes())
 	}
 
 	if _, err := h.aof.Write(buf.Bytes()); err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return 0, nil
 }
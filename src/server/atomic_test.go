@@ -6,6 +6,8 @@ import (
 	"ddia/src/server"
 	"ddia/src/storage/aof"
 	"ddia/testing/log"
+	"encoding/hex"
+	"errors"
 	"os"
 	"path"
 	"strings"
@@ -72,3 +74,162 @@ func TestServer_AppendOnlyFile(t *testing.T) {
 	}
 
 }
+
+func TestServer_RestoreAOF_Truncated(t *testing.T) {
+	goldenFile, err := os.ReadFile("testdata/test.aof.txt")
+	if err != nil {
+		t.Fatalf("expecting to be able to read the golden file: %v", err)
+	}
+
+	// The last command (incrby visits 1) is cut in half, as if the server had crashed while writing it
+	truncated := goldenFile[:len(goldenFile)-10]
+	validSize := bytes.LastIndex(goldenFile, []byte("*3\r\n$6\r\nincrby"))
+
+	t.Run("refuse to start if aof-load-truncated is disabled", func(t *testing.T) {
+		aofPath := path.Join(t.TempDir(), "test.aof")
+		if err := os.WriteFile(aofPath, truncated, 0600); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		_, _, err := startServerWithAOF(t, aofPath, "aof-load-truncated no\n")
+		if !errors.Is(err, aof.ErrTruncated) {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrTruncated)
+		}
+	})
+
+	t.Run("load up to the last valid command", func(t *testing.T) {
+		aofPath := path.Join(t.TempDir(), "test.aof")
+		if err := os.WriteFile(aofPath, truncated, 0600); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		s, _ := testServerWithAOF(t, aofPath)
+		conn := testConn(t, s)
+
+		if rsp, want := parse(t, req(t, conn, []string{"get", "second"})), "key"; rsp != want {
+			t.Fatalf("invalid response: %q want %q", rsp, want)
+		}
+
+		// "*2 SELECT 0" is the last valid command, and is kept
+		if size, want := len(readAOF(t, aofPath)), validSize; size != want {
+			t.Fatalf("the AOF has not been truncated: %d bytes, want %d", size, want)
+		}
+	})
+}
+
+func TestServer_RestoreAOF_Corrupted(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "test.aof")
+
+	goldenFile, err := os.ReadFile("testdata/test.aof.txt")
+	if err != nil {
+		t.Fatalf("expecting to be able to read the golden file: %v", err)
+	}
+
+	corrupted := bytes.Replace(goldenFile, []byte("$5\r\nvalue"), []byte("$X\r\nvalue"), 1)
+	if err := os.WriteFile(aofPath, corrupted, 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	_, _, err = startServerWithAOF(t, aofPath, "")
+	if !errors.Is(err, aof.ErrCorrupted) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrCorrupted)
+	}
+
+	if !strings.Contains(err.Error(), "offset 23") {
+		t.Fatalf("the error does not contain the offset of the invalid command: %v", err)
+	}
+}
+
+func TestServer_RestoreAOF_Encrypted(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "appendonlydir")
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	keyFile := path.Join(t.TempDir(), "aof.key")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	a, err := aof.Open(context.Background(), aofPath, aof.AlwaysSync, aof.WithEncryption(key))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	cmd := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"
+	if _, err := a.Write([]byte(cmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	_ = a.Close()
+
+	if _, _, err := startServerWithAOF(t, aofPath, ""); !errors.Is(err, aof.ErrEncrypted) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrEncrypted)
+	}
+
+	s, _, err := startServerWithAOF(t, aofPath, "aof-encryption-key-file "+keyFile+"\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	conn := testConn(t, s)
+
+	if rsp, want := parse(t, req(t, conn, []string{"get", "key"})), "value"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+// An AOF written by the versions before the multi-part AOF, at the default path, is upgraded and restored
+func TestServer_RestoreAOF_DefaultDir(t *testing.T) {
+	goldenFile, err := os.ReadFile("testdata/test.aof.txt")
+	if err != nil {
+		t.Fatalf("expecting to be able to read the golden file: %v", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+
+	if err := os.WriteFile("redis.aof", goldenFile, 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// No appenddirname: the default path is used, as done by cmd/server
+	if err := os.WriteFile("redis.conf", []byte("appendonly yes\n"), 0600); err != nil {
+		t.Fatalf("unable to write configuration file: %v", err)
+	}
+
+	appendOnlyFile, err := aof.Open(context.Background(), aof.DefaultDir, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = appendOnlyFile.Close() })
+
+	handlers := server.NewHandlers(log.ServerLogger(), appendOnlyFile)
+	s, err := server.New(handlers, append(serverOptions(), server.WithConfigurationFile("redis.conf"))...)
+	if err != nil {
+		t.Fatalf("expecting server to be able to start without problems: %v", err)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Stop() })
+
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	if rsp, want := req("get key"), "value"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("get visits"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if stat, err := os.Stat("redis.aof"); err != nil || !stat.IsDir() {
+		t.Fatalf("the AOF has not been moved into a directory: %v", err)
+	}
+}
@@ -24,6 +24,18 @@ type client struct {
 	db Storage
 	// authenticated is true when the client has successfully authenticated to the Server using the AUTH command
 	authenticated bool
+	// replaying is true for the client that restores the AOF on startup. Its commands are not written back into
+	// the AOF, and they are run while the server is loading.
+	replaying bool
+	// master is true for the client that applies the stream of the master, while the server is a replica. It can
+	// write on a read-only replica.
+	master bool
+	// listeningPort is the port where the client is listening, if it's a replica (see REPLCONF)
+	listeningPort string
+	// aofOffset and replOffset are the offsets of the last write of the client in the AOF, and in the stream sent
+	// to the replicas (see WAITAOF and WAIT)
+	aofOffset  uint64
+	replOffset int64
 }
 
 // newClient returns a client
@@ -51,6 +63,19 @@ func (c *client) command() string {
 	return c.args[0]
 }
 
+// rewriteCommand replaces the command being written into the AOF by args. The command being executed is not
+// modified. It's used when the command received cannot be replayed as is (eg: EXPIRE is relative to the moment
+// it's executed, thus it's recorded as PEXPIREAT with an absolute timestamp).
+func (c *client) rewriteCommand(args ...string) {
+	c.argsWriter = resp.NewArray(args)
+}
+
+// discardCommand prevents the command being executed from being written into the AOF. It's used when the command
+// has not modified the dataset, and replaying it could (eg: EXPIRE NX on a key that already has a timeout).
+func (c *client) discardCommand() {
+	c.argsWriter = nil
+}
+
 // writeResponse writes into the active connection, returning an error if it fails
 func (c *client) writeResponse(to io.WriterTo) error {
 	if _, err := to.WriteTo(c.conn); err != nil {
@@ -37,13 +37,41 @@ var Commands = []cmd{
 	{Name: "Move", Operation: "write", Status: "implemented", Kind: "generic"},
 	{Name: "RandomKey", Operation: "read", Status: "implemented", Kind: "generic"},
 	{Name: "Rename", Operation: "write", Status: "implemented", Kind: "generic"},
+	{Name: "RenameNX", Operation: "write", Status: "implemented", Kind: "generic"},
+	{Name: "Type", Operation: "read", Status: "implemented", Kind: "generic"},
+	{Name: "Touch", Operation: "read", Status: "implemented", Kind: "generic"},
+	{Name: "Unlink", Operation: "write", Status: "implemented", Kind: "generic"},
 	{Name: "Expire", Operation: "write", Status: "implemented", Kind: "generic"},
 	{Name: "TTL", Operation: "read", Status: "implemented", Kind: "generic"},
+	{Name: "PExpire", Operation: "write", Status: "implemented", Kind: "generic"},
+	{Name: "PTTL", Operation: "read", Status: "implemented", Kind: "generic"},
+	{Name: "ExpireAt", Operation: "write", Status: "implemented", Kind: "generic"},
+	{Name: "PExpireAt", Operation: "write", Status: "implemented", Kind: "generic"},
+	{Name: "Persist", Operation: "write", Status: "implemented", Kind: "generic"},
+	{Name: "ExpireTime", Operation: "read", Status: "implemented", Kind: "generic"},
+	{Name: "PExpireTime", Operation: "read", Status: "implemented", Kind: "generic"},
+	{Name: "Object", Operation: "read", Status: "implemented", Kind: "generic"},
+	{Name: "Copy", Operation: "write", Status: "implemented", Kind: "generic"},
+	{Name: "Dump", Operation: "read", Status: "implemented", Kind: "generic"},
+	{Name: "Restore", Operation: "write", Status: "implemented", Kind: "generic"},
+	{Name: "Migrate", Operation: "write", Status: "implemented", Kind: "generic"},
+	{Name: "Wait", Operation: "read", Status: "implemented", Kind: "generic"},
+	{Name: "WaitAOF", Operation: "read", Status: "implemented", Kind: "generic"},
 	// Server commands
 	{Name: "DBSize", Operation: "read", Status: "implemented", Kind: "server"},
 	{Name: "FlushDB", Operation: "write", Status: "implemented", Kind: "server"},
 	{Name: "FlushAll", Operation: "write", Status: "implemented", Kind: "server"},
+	{Name: "SwapDB", Operation: "write", Status: "implemented", Kind: "server"},
 	{Name: "Config", Operation: "write", Status: "partially-implemented", Kind: "server"},
+	{Name: "BGRewriteAOF", Operation: "read", Status: "implemented", Kind: "server"},
+	{Name: "Info", Operation: "read", Status: "partially-implemented", Kind: "server"},
+	{Name: "Memory", Operation: "read", Status: "partially-implemented", Kind: "server"},
+	{Name: "Schedule", Operation: "write", Status: "implemented", Kind: "server"},
+	{Name: "ReplicaOf", Operation: "read", Status: "implemented", Kind: "server"},
+	{Name: "SlaveOf", Operation: "read", Status: "implemented", Kind: "server"},
+	{Name: "PSync", Operation: "read", Status: "implemented", Kind: "server"},
+	{Name: "ReplConf", Operation: "read", Status: "partially-implemented", Kind: "server"},
+	{Name: "Role", Operation: "read", Status: "implemented", Kind: "server"},
 	// List commands
 	{Name: "SetNX", Operation: "write", Status: "implemented", Kind: "list"},
 	{Name: "LLen", Operation: "read", Status: "implemented", Kind: "list"},
@@ -1,6 +1,6 @@
 // Code generated by go generate; DO NOT EDIT.
 // To recreate run: make generate
-// 2023-01-27 22:01:03.706648 +0100 CET m=+0.003635126
+// 2026-10-19 08:01:35.158140157 +0000 UTC m=+0.001950469
 package server
 
 const (
@@ -40,18 +40,74 @@ const (
 	RandomKey = "RANDOMKEY"
 	// Rename command
 	Rename = "RENAME"
+	// RenameNX command
+	RenameNX = "RENAMENX"
+	// Type command
+	Type = "TYPE"
+	// Touch command
+	Touch = "TOUCH"
+	// Unlink command
+	Unlink = "UNLINK"
 	// Expire command
 	Expire = "EXPIRE"
 	// TTL command
 	TTL = "TTL"
+	// PExpire command
+	PExpire = "PEXPIRE"
+	// PTTL command
+	PTTL = "PTTL"
+	// ExpireAt command
+	ExpireAt = "EXPIREAT"
+	// PExpireAt command
+	PExpireAt = "PEXPIREAT"
+	// Persist command
+	Persist = "PERSIST"
+	// ExpireTime command
+	ExpireTime = "EXPIRETIME"
+	// PExpireTime command
+	PExpireTime = "PEXPIRETIME"
+	// Object command
+	Object = "OBJECT"
+	// Copy command
+	Copy = "COPY"
+	// Dump command
+	Dump = "DUMP"
+	// Restore command
+	Restore = "RESTORE"
+	// Migrate command
+	Migrate = "MIGRATE"
+	// Wait command
+	Wait = "WAIT"
+	// WaitAOF command
+	WaitAOF = "WAITAOF"
 	// DBSize command
 	DBSize = "DBSIZE"
 	// FlushDB command
 	FlushDB = "FLUSHDB"
 	// FlushAll command
 	FlushAll = "FLUSHALL"
+	// SwapDB command
+	SwapDB = "SWAPDB"
 	// Config command
 	Config = "CONFIG"
+	// BGRewriteAOF command
+	BGRewriteAOF = "BGREWRITEAOF"
+	// Info command
+	Info = "INFO"
+	// Memory command
+	Memory = "MEMORY"
+	// Schedule command
+	Schedule = "SCHEDULE"
+	// ReplicaOf command
+	ReplicaOf = "REPLICAOF"
+	// SlaveOf command
+	SlaveOf = "SLAVEOF"
+	// PSync command
+	PSync = "PSYNC"
+	// ReplConf command
+	ReplConf = "REPLCONF"
+	// Role command
+	Role = "ROLE"
 	// SetNX command
 	SetNX = "SETNX"
 	// LLen command
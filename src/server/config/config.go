@@ -24,6 +24,24 @@ func options() []option {
 		{name: "appendonly", flags: singleFlag},
 		{name: "appendfsync", flags: singleFlag},
 		{name: "appenddirname", flags: singleFlag},
+		{name: "appendfilename", flags: singleFlag},
+		{name: "auto-aof-rewrite-percentage", flags: singleFlag},
+		{name: "auto-aof-rewrite-min-size", flags: singleFlag},
+		{name: "aof-load-truncated", flags: singleFlag},
+		{name: "aof-framing", flags: singleFlag},
+		{name: "aof-use-rdb-preamble", flags: singleFlag},
+		{name: "aof-timestamp-enabled", flags: singleFlag},
+		{name: "aof-encryption-key-file", flags: singleFlag},
+		{name: "maxmemory", flags: singleFlag},
+		{name: "maxmemory-policy", flags: singleFlag},
+		{name: "maxmemory-samples", flags: singleFlag},
+		{name: "expire-tracker", flags: singleFlag},
+		{name: "replicaof", flags: singleFlag},
+		{name: "masterauth", flags: singleFlag},
+		{name: "repl-backlog-size", flags: singleFlag},
+		{name: "replica-read-only", flags: singleFlag},
+		{name: "follow-appenddirname", flags: singleFlag},
+		{name: "follow-appendfilename", flags: singleFlag},
 	}
 }
 
@@ -80,6 +98,48 @@ func (c Config) Integer(key string, def int) (int, error) {
 	return i, nil
 }
 
+// Bytes returns the value of key as a number of bytes. Units are supported, and are case-insensitive:
+//
+//	1k => 1000 bytes
+//	1kb => 1024 bytes
+//	1m => 1000000 bytes
+//	1mb => 1024*1024 bytes
+//	1g => 1000000000 bytes
+//	1gb => 1024*1024*1024 bytes
+//
+// If key does not exist, return def. If it cannot be parsed, returns ErrInvalidType
+func (c Config) Bytes(key string, def int64) (int64, error) {
+	value, ok := c.Get(key)
+	if !ok {
+		return def, nil
+	}
+
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		// Order matters: "kb" must be checked before "b" and "k"
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	number, multiplier := strings.ToLower(value), int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(number, u.suffix) {
+			number, multiplier = strings.TrimSuffix(number, u.suffix), u.multiplier
+			break
+		}
+	}
+
+	i, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: unable to convert %q to bytes: %v", ErrInvalidType, value, err)
+	}
+
+	return i * multiplier, nil
+}
+
 // Get returns the first value for key found on the file
 func (c Config) Get(key string) (value string, ok bool) {
 	values, ok := c.data[key]
@@ -143,3 +143,33 @@ func TestNew_InvalidFile(t *testing.T) {
 		t.Fatalf("expected error: %q, want %q", err, ErrInvalidFile)
 	}
 }
+
+func TestConfig_Bytes(t *testing.T) {
+	config, err := New("testdata/redis.conf")
+	if err != nil {
+		t.Fatalf("expected no error: %q", err.Error())
+	}
+
+	value, err := config.Bytes("auto-aof-rewrite-min-size", 0)
+	if err != nil {
+		t.Fatalf("expecting no error: %q", err.Error())
+	}
+
+	if want := int64(64 * 1024 * 1024); value != want {
+		t.Fatalf("invalid size: %d, want %d", value, want)
+	}
+
+	value, err = config.Bytes("non-existing-key", 1000)
+	if err != nil {
+		t.Fatalf("expecting no error: %q", err.Error())
+	}
+
+	if want := int64(1000); value != want {
+		t.Fatalf("invalid size: %d, want %d", value, want)
+	}
+
+	_, err = config.Bytes("requirepass", 0)
+	if !errors.Is(err, ErrInvalidType) {
+		t.Fatalf("expecting error: %v, want %q", err, ErrInvalidType)
+	}
+}
@@ -33,6 +33,33 @@ var ErrOperationNotPermitted = errors.New("operation not permitted")
 // ErrIndexOurOfRange is used when trying to access to a list index out of range
 var ErrIndexOurOfRange = errors.New("index out of range")
 
+// ErrPersistenceFailed is returned when the AOF cannot be written. Write commands are refused until the disk
+// recovers, otherwise the dataset would be modified without being persisted. Read commands are still served.
+var ErrPersistenceFailed = errors.New("persistence failed")
+
+// ErrLoading is returned when a client runs a command that accesses the dataset while the AOF is being restored
+var ErrLoading = errors.New("loading")
+
+// ErrOutOfMemory is returned when a command that uses more memory is run while the memory used is over maxmemory,
+// and no key can be evicted (see maxmemory-policy)
+var ErrOutOfMemory = errors.New("out of memory")
+
+// ErrReadOnly is returned when a client runs a write command on a read-only replica (see replica-read-only)
+var ErrReadOnly = errors.New("read only replica")
+
+// ExpireMode is what a database does with a key whose timeout has passed, when it's accessed (see OnExpire)
+type ExpireMode int
+
+const (
+	// ExpireDelete deletes the key, and reports it as not found
+	ExpireDelete ExpireMode = iota
+	// ExpireHide reports the key as not found, without deleting it (eg: on a replica, the master sends the DEL)
+	ExpireHide
+	// ExpireKeep handles the key as any other (eg: a replica applies the commands of the master on the keys as they
+	// are on the master)
+	ExpireKeep
+)
+
 // Storage defines the interface that the Server needs to store things
 type Storage interface {
 	atomic
@@ -40,6 +67,26 @@ type Storage interface {
 	genericOperations
 	serverOperations
 	listOperations
+	memoryOperations
+	expireOperations
+}
+
+// KeyStats are the statistics of a key: the memory it uses and its accesses. They are used to choose the keys to
+// evict when the memory used reaches maxmemory, and by OBJECT and MEMORY USAGE.
+type KeyStats struct {
+	Key string
+	// Type is the kind of value stored at key ("string", "list")
+	Type string
+	// Encoding is how the value is stored (see OBJECT ENCODING)
+	Encoding string
+	// Size is the approximated number of bytes used by the key and its value
+	Size int64
+	// Idle is the number of milliseconds since the key was last accessed
+	Idle int64
+	// Frequency is a logarithmic counter of the accesses to the key, decremented over time without accesses
+	Frequency uint8
+	// ExpiresAt is the unix timestamp in milliseconds when the key expires, or 0 if it has no timeout
+	ExpiresAt int64
 }
 
 type atomic interface {
@@ -50,12 +97,14 @@ type atomic interface {
 type stringOperations interface {
 	// Get returns value of the given key. If the key is not found, returns ErrNotFound
 	Get(key string) (string, error)
-	// Set stores or overwrites the key with the given value
+	// Set stores or overwrites the key with the given value. The timeout of the key, if any, is discarded.
 	Set(key, value string) error
 	// IncrementBy increments the counter key by amount, returning the new value
 	IncrementBy(key string, amount int) (string, error)
 	// FlushDB removes all keys in the database
 	FlushDB() error
+	// FlushDBAsync removes all keys in the database, like FlushDB, freeing them in the background
+	FlushDBAsync() error
 	// Exists returns ErrNotFound if key does not exist, return null otherwise
 	Exists(key string) error
 }
@@ -63,10 +112,19 @@ type stringOperations interface {
 type genericOperations interface {
 	// Del removes a key. Returns true if existed, False otherwise.
 	Del(key string) bool
+	// Unlink removes a key, like Del. Big values are freed in the background, so the lock is not held meanwhile.
+	Unlink(key string) bool
+	// Touch records an access to key (see OBJECT IDLETIME). Returns false if the key does not exist.
+	Touch(key string) bool
 	// RandomKey return a random key from all the records on the present database
 	RandomKey() (string, bool)
-	// Rename renames key to newkey. It returns an error when key does not exist.
+	// Rename renames key to newkey. It returns an error when key does not exist. The timeout of key is moved to
+	// newkey, and the one of newkey, if any, is discarded.
 	Rename(oldKey string, newKey string) error
+	// Keys returns all the keys stored in the database, in no particular order
+	Keys() []string
+	// Type returns the kind of value stored at key ("string", "list"). If the key is not found, returns ErrNotFound
+	Type(key string) (string, error)
 }
 
 type listOperations interface {
@@ -95,4 +153,57 @@ type listOperations interface {
 type serverOperations interface {
 	// Size returns the number of keys being stored
 	Size() int
+	// Swap exchanges all the keys, with their timeouts, with the ones of other. The caller must hold the locks of
+	// both databases.
+	Swap(other Storage) error
+}
+
+type memoryOperations interface {
+	// MemoryUsage returns the approximated number of bytes used by the database. It can be called without holding
+	// the lock.
+	MemoryUsage() int64
+	// Sample returns up to n keys chosen randomly, with their statistics
+	Sample(n int) []KeyStats
+	// SampleVolatile returns up to n keys with a timeout chosen randomly, with their statistics
+	SampleVolatile(n int) []KeyStats
+	// KeyStats returns the statistics of key. Returns false if the key does not exist.
+	KeyStats(key string) (KeyStats, bool)
+	// SetAccessStats sets the access statistics of key: idle is the number of milliseconds since its last access,
+	// and frequency its LFU counter. Returns false if the key does not exist.
+	SetAccessStats(key string, idle int64, frequency uint8) bool
+	// MemoryStats returns the number of keys, and the approximated number of bytes they use, by type
+	MemoryStats() map[string]MemoryStats
+	// LazyFreeStats returns the number of values being freed in the background, and the ones already freed. It can
+	// be called without holding the lock.
+	LazyFreeStats() LazyFreeStats
+}
+
+// MemoryStats are the number of keys of a group, and the approximated number of bytes they use
+type MemoryStats struct {
+	Keys  int
+	Bytes int64
+}
+
+// LazyFreeStats are the number of values removed from a database being freed in the background (see UNLINK), and
+// the ones already freed
+type LazyFreeStats struct {
+	Pending int64
+	Freed   int64
+}
+
+// expireOperations keep the timeouts of the keys. A timeout belongs to its key: it's discarded when the key is
+// deleted, overwritten by Set or flushed, and it's moved along with the key by Rename. A key whose timeout has
+// passed is deleted when it's accessed, as if it did not exist.
+type expireOperations interface {
+	// SetExpire sets the time when key expires, as a unix timestamp in milliseconds. If the key is not found,
+	// returns ErrNotFound
+	SetExpire(key string, expiresAt int64) error
+	// ExpiresAt returns the unix timestamp in milliseconds when key expires. Returns false if the key does not
+	// exist, or it has no timeout.
+	ExpiresAt(key string) (int64, bool)
+	// Persist removes the timeout of key. Returns true if the key had a timeout.
+	Persist(key string) bool
+	// OnExpire sets the function called with each key whose timeout has passed, when it's accessed. It returns
+	// what is done with the key, ExpireDelete by default. It's called with the lock of the database held.
+	OnExpire(fn func(key string) ExpireMode)
 }
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"ddia/src/expire"
+	"ddia/src/resp"
+	"ddia/src/server/config"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Eviction policies, set with maxmemory-policy. The allkeys policies evict any key, and the volatile ones only
+// the keys with a TTL.
+//
+// More: https://redis.io/docs/reference/eviction/
+const (
+	noEviction     = "noeviction"
+	allKeysLRU     = "allkeys-lru"
+	allKeysLFU     = "allkeys-lfu"
+	allKeysRandom  = "allkeys-random"
+	volatileLRU    = "volatile-lru"
+	volatileLFU    = "volatile-lfu"
+	volatileRandom = "volatile-random"
+	volatileTTL    = "volatile-ttl"
+)
+
+var evictionPolicies = map[string]bool{
+	noEviction: true, allKeysLRU: true, allKeysLFU: true, allKeysRandom: true,
+	volatileLRU: true, volatileLFU: true, volatileRandom: true, volatileTTL: true,
+}
+
+// freeMemory are the write commands that cannot use more memory, so they are served when the memory used cannot
+// be brought under maxmemory: they can be used to free it.
+var freeMemory = map[string]bool{
+	Del: true, Unlink: true, Expire: true, PExpire: true, ExpireAt: true, PExpireAt: true, Persist: true,
+	FlushDB: true, FlushAll: true, SwapDB: true, Move: true, Rename: true, RenameNX: true, Migrate: true,
+	LRem: true, LPop: true, RPop: true, LTrim: true, Config: true,
+}
+
+// denyOOM returns whether the command in args is refused with ErrOutOfMemory when the memory used cannot be
+// brought under maxmemory: all the write commands of the command table, except the ones that cannot use more
+// memory (eg: DEL).
+func denyOOM(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	name := strings.ToUpper(args[0])
+	if cmd, ok := getCommand(name); !ok || cmd.Operation != "write" || freeMemory[name] {
+		return false
+	}
+
+	if name == Schedule && len(args) > 1 {
+		// SCHEDULE LIST and SCHEDULE CANCEL do not add a schedule
+		sub := strings.ToUpper(args[1])
+		return sub != "LIST" && sub != "CANCEL"
+	}
+
+	return true
+}
+
+// maxMemory configures the eviction of keys when the memory used reaches a limit
+type maxMemory struct {
+	// limit is the maximum number of bytes used by the dataset (maxmemory). 0 means no limit.
+	limit int64
+	// policy chooses the keys to evict (maxmemory-policy)
+	policy string
+	// samples is the number of keys sampled to choose each key to evict (maxmemory-samples). The keys evicted are an
+	// approximation of the ones that the policy would choose: more samples are more accurate, but slower.
+	samples int
+}
+
+// readMaxMemory reads the maxmemory directives from the configuration, using def for the ones not set
+func readMaxMemory(c config.Config, def maxMemory) (m maxMemory, err error) {
+	if m.limit, err = c.Bytes("maxmemory", def.limit); err != nil {
+		return m, err
+	}
+
+	m.policy = c.GetD("maxmemory-policy", def.policy)
+	if !evictionPolicies[m.policy] {
+		return m, fmt.Errorf("%w: unknown maxmemory-policy %q", config.ErrInvalidType, m.policy)
+	}
+
+	if m.samples, err = c.Integer("maxmemory-samples", def.samples); err != nil {
+		return m, err
+	} else if m.samples <= 0 {
+		return m, fmt.Errorf("%w: maxmemory-samples must be positive", config.ErrInvalidType)
+	}
+
+	return m, nil
+}
+
+// usedMemory returns the approximated number of bytes used by all the databases
+func usedMemory(dbs []Storage) int64 {
+	var used int64
+	for _, db := range dbs {
+		used += db.MemoryUsage()
+	}
+	return used
+}
+
+// checkMemory evicts keys while the memory used is over maxmemory. It returns ErrOutOfMemory if c is running a
+// command that might use more memory, and not enough keys can be evicted.
+func (h *Handlers) checkMemory(c *client, dbs []Storage, expire expire.Tracker, m maxMemory) error {
+	if m.limit == 0 || c.replaying || h.replication.isReplica() {
+		return nil // A replica does not evict keys: its master does, and sends the DEL
+	}
+
+	if err := h.evict(dbs, expire, m); err != nil && denyOOM(c.args) {
+		return err
+	}
+
+	return nil
+}
+
+// evict deletes keys chosen by the policy until the memory used is under the limit. Each key evicted is recorded
+// on the AOF as a DEL, so it's not restored after a restart.
+func (h *Handlers) evict(dbs []Storage, expire expire.Tracker, m maxMemory) error {
+	if usedMemory(dbs) <= m.limit {
+		return nil
+	}
+
+	if m.policy == noEviction {
+		return ErrOutOfMemory
+	}
+
+	// Concurrent clients would evict more keys than needed
+	h.evictMux.Lock()
+	defer h.evictMux.Unlock()
+
+	for usedMemory(dbs) > m.limit {
+		dbIdx, key, ok := evictionCandidate(dbs, m)
+		if !ok {
+			return ErrOutOfMemory
+		}
+
+		db := dbs[dbIdx]
+		db.Lock()
+		if db.Del(key) {
+			expire.Remove(dbIdx, key)
+			h.evictedKeys.Add(1)
+			// There is no need to wait for it to be synced: at worst, the key is evicted again after a restart
+			if _, err := h.propagate(dbIdx, resp.NewArray([]string{"DEL", key})); err != nil {
+				h.logger.Printf("[ERROR] unable to write evicted key into the AOF: %v", err)
+			}
+		}
+		db.Unlock()
+	}
+
+	return nil
+}
+
+// evictionCandidate samples keys, and returns the best one to be evicted according to the policy. Returns false if
+// there are no keys that can be evicted.
+func evictionCandidate(dbs []Storage, m maxMemory) (dbIdx int, key string, ok bool) {
+	var bestScore int64
+	for idx, db := range dbs {
+		db.Lock()
+		var samples []KeyStats
+		if strings.HasPrefix(m.policy, "allkeys-") {
+			samples = db.Sample(m.samples)
+		} else {
+			samples = db.SampleVolatile(m.samples)
+		}
+		db.Unlock()
+
+		for _, stats := range samples {
+			if score := evictionScore(m.policy, stats); !ok || score > bestScore {
+				dbIdx, key, bestScore, ok = idx, stats.Key, score, true
+			}
+		}
+	}
+
+	return dbIdx, key, ok
+}
+
+// evictionScore returns how good is the key to be evicted by the policy: the higher, the better
+func evictionScore(policy string, stats KeyStats) int64 {
+	switch policy {
+	case allKeysLRU, volatileLRU:
+		return stats.Idle
+	case allKeysLFU, volatileLFU:
+		return 255 - int64(stats.Frequency)
+	case volatileTTL:
+		return -stats.ExpiresAt
+	default: // allkeys-random, volatile-random
+		return rand.Int63()
+	}
+}
@@ -0,0 +1,117 @@
+package server_test
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestServer_MaxMemory_AllKeysLRU(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "appendonlydir")
+	s, _, err := startServerWithAOF(t, aofPath, "maxmemory 4kb\nmaxmemory-policy allkeys-lru\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	conn := testConn(t, s)
+
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 100; i++ {
+		if rsp := parse(t, req(t, conn, []string{"SET", fmt.Sprintf("key-%d", i), value})); rsp != "OK" {
+			t.Fatalf("invalid response: %q", rsp)
+		}
+	}
+
+	size, err := strconv.Atoi(parse(t, req(t, conn, []string{"DBSIZE"})))
+	if err != nil || size == 0 || size >= 100 {
+		t.Fatalf("unexpected number of keys: %d (%v)", size, err)
+	}
+
+	rsp := parse(t, req(t, conn, []string{"INFO"}))
+	want := fmt.Sprintf("evicted_keys:%d\r\n", 100-size)
+	if !strings.Contains(rsp, want) || !strings.Contains(rsp, "maxmemory_policy:allkeys-lru\r\n") {
+		t.Fatalf("invalid response: %q, want %q", rsp, want)
+	}
+
+	if got := strings.Count(readAOF(t, aofPath), "$3\r\nDEL\r\n"); got != 100-size {
+		t.Fatalf("unexpected number of keys evicted on the AOF: %d, want %d", got, 100-size)
+	}
+}
+
+func TestServer_MaxMemory_VolatileTTL(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "appendonlydir")
+	s, _, err := startServerWithAOF(t, aofPath, "maxmemory 4kb\nmaxmemory-policy volatile-ttl\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	conn := testConn(t, s)
+
+	value := strings.Repeat("x", 100)
+	_ = req(t, conn, []string{"SET", "persistent", value})
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_ = req(t, conn, []string{"SET", key, value})
+		_ = req(t, conn, []string{"EXPIRE", key, "1000"})
+	}
+
+	if rsp := parse(t, req(t, conn, []string{"GET", "persistent"})); rsp != value {
+		t.Fatalf("the key without TTL has been evicted: %q", rsp)
+	}
+
+	// Once there are no keys with a TTL left, the memory cannot be freed
+	_ = req(t, conn, []string{"FLUSHDB"})
+	for i := 0; i < 100; i++ {
+		rsp := parse(t, req(t, conn, []string{"SET", fmt.Sprintf("key-%d", i), value}))
+		if strings.HasPrefix(rsp, "OOM") {
+			return
+		}
+	}
+	t.Fatalf("expecting an OOM error")
+}
+
+func TestServer_MaxMemory_NoEviction(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "appendonlydir")
+	s, _, err := startServerWithAOF(t, aofPath, "maxmemory 1kb\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	conn := testConn(t, s)
+
+	value := strings.Repeat("x", 100)
+	var i int
+	for ; parse(t, req(t, conn, []string{"SET", fmt.Sprintf("key-%d", i), value})) == "OK"; i++ {
+		if i == 100 {
+			t.Fatalf("expecting an OOM error")
+		}
+	}
+
+	rsp := parse(t, req(t, conn, []string{"SET", "key", value}))
+	if want := "OOM command not allowed when used memory > 'maxmemory'."; rsp != want {
+		t.Fatalf("invalid response: %q, want %q", rsp, want)
+	}
+
+	// Every write command that might use more memory is refused, not only SET
+	rsp = parse(t, req(t, conn, []string{"SCHEDULE", "IN", "100000", "SET", "key", value}))
+	if want := "OOM command not allowed when used memory > 'maxmemory'."; rsp != want {
+		t.Fatalf("invalid response: %q, want %q", rsp, want)
+	}
+
+	if rsp := parse(t, req(t, conn, []string{"SCHEDULE", "LIST"})); rsp != "" {
+		t.Fatalf("invalid response: %q", rsp)
+	}
+
+	// The commands that free memory are still allowed
+	if rsp := parse(t, req(t, conn, []string{"DEL", "key-0", "key-1"})); rsp != "2" {
+		t.Fatalf("invalid response: %q", rsp)
+	}
+
+	if rsp := parse(t, req(t, conn, []string{"SET", "key", value})); rsp != "OK" {
+		t.Fatalf("invalid response: %q", rsp)
+	}
+
+	if size := parse(t, req(t, conn, []string{"DBSIZE"})); size != strconv.Itoa(i-1) {
+		t.Fatalf("unexpected number of keys: %s, want %d", size, i-1)
+	}
+}
@@ -2,34 +2,134 @@ package server
 
 import (
 	"context"
+	"ddia/src/expire"
+	"ddia/src/resp"
+	"ddia/src/server/config"
+	"fmt"
 	"time"
 )
 
-// lookForKeysToExpire to called as goroutine. Every second it will look for keys to invalidate. It will invalidate
-// all keys that are stale. To stop it, close the context.
+// Expire trackers, set with expire-tracker. The heap is simpler and uses less memory, and the timing wheel scales
+// better with many clients setting timeouts at the same time (eg: millions of short-lived session keys).
+const (
+	heapTracker        = "heap"
+	timingWheelTracker = "timing-wheel"
+)
+
+// newExpireTracker returns the expire tracker named name
+func newExpireTracker(name string) (expire.Tracker, error) {
+	switch name {
+	case heapTracker:
+		return expire.NewExpire(), nil
+	case timingWheelTracker:
+		return expire.NewTimingWheel(), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown expire-tracker %q", config.ErrInvalidType, name)
+	}
+}
+
+// The keys are expired lazily, when they are accessed (see Storage.OnExpire), and actively, by a background cycle
+// that deletes the keys that are not accessed anymore. Like in Redis, the cycle runs activeExpireHz times per
+// second, and it's given a share of each period: with lots of keys to expire, the memory is reclaimed without
+// starving the clients. Unlike Redis, the keys are not sampled at random: the expire tracker returns the ones
+// whose deadline has passed, in order.
+const (
+	// activeExpireHz is the number of active expire cycles per second
+	activeExpireHz = 10
+	// activeExpireCPUPercent is the share of each period that a cycle can spend expiring keys
+	activeExpireCPUPercent = 25
+	// activeExpireKeysPerLoop is the number of keys expired between two checks of the time spent by the cycle
+	activeExpireKeysPerLoop = 20
+)
+
+// lookForKeysToExpire to called as goroutine. It runs the active expire cycle activeExpireHz times per second.
+// When a cycle runs out of time, there are still stale keys: the next cycle starts sooner, so the cycles use up
+// to half of the time instead of activeExpireCPUPercent. To stop it, close the context.
 func (s *Server) lookForKeysToExpire(ctx context.Context) {
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+	period := time.Second / activeExpireHz
+	budget := period * activeExpireCPUPercent / 100
+
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if s.handlers.replication.isReplica() {
+			timer.Reset(period) // The master expires the keys, and sends the DEL
+			continue
+		}
+
+		if s.activeExpireCycle(budget) {
+			timer.Reset(period)
+		} else {
+			s.handlers.expireCyclesCapped.Add(1)
+			timer.Reset(budget)
+		}
+	}
+}
 
-	findAndExpire := func() {
-		for {
-			database, key, isThereSomethingToExpire := s.expire.GetExpired(time.Now().Unix())
+// activeExpireCycle deletes the keys whose timeout has passed, for up to budget. Returns false if it has run out
+// of time before expiring all of them.
+func (s *Server) activeExpireCycle(budget time.Duration) bool {
+	start := time.Now()
+	for {
+		for i := 0; i < activeExpireKeysPerLoop; i++ {
+			database, key, isThereSomethingToExpire := s.expire.GetExpired(time.Now().UnixMilli())
 			if !isThereSomethingToExpire {
-				break
+				return true
 			}
 
-			s.options.dbs[database].Lock()
-			s.options.dbs[database].Del(key)
-			s.options.dbs[database].Unlock()
+			s.expireKey(database, key)
+		}
+
+		if time.Since(start) > budget {
+			return false
 		}
 	}
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			findAndExpire()
+// expireKey deletes key from database if its timeout has passed. The tracker only holds deadlines: the key might have
+// been deleted, overwritten or renamed since its deadline was tracked, and in that case it's left untouched.
+func (s *Server) expireKey(database int, key string) {
+	db := s.options.dbs[database]
+	db.Lock()
+	defer db.Unlock()
+
+	// An expired key is deleted when it's accessed, and recorded by Handlers.expired
+	if expiresAt, volatile := db.ExpiresAt(key); volatile {
+		s.expire.AddUpdate(database, key, expiresAt) // The timeout has been extended while it was being popped
+	}
+}
+
+// expired is called with each key of the database dbIdx accessed after its timeout has passed, and returns what
+// is done with it. On a master, it's deleted: the deletion is written on the AOF like any other, but there is no
+// need to wait for it to be synced, as the key would expire again when replaying the AOF.
+//
+// As in Redis, a replica does not delete the key: only the master does, and sends the DEL. Its clients do not see
+// the key, but the commands of the master still do (see replication.keepExpired): the timeout might not have
+// passed yet on the master, or it might have been removed in the meantime.
+func (h *Handlers) expired(dbIdx int, key string) ExpireMode {
+	if h.replication.isReplica() {
+		if h.replication.keepExpired.Load() > 0 {
+			return ExpireKeep
 		}
+		return ExpireHide
 	}
+
+	h.expiredKeys.Add(1)
+
+	if h.loading.inProgress.Load() {
+		return ExpireDelete // The AOF being restored already has the timeout of the key
+	}
+
+	if _, err := h.propagate(dbIdx, resp.NewArray([]string{"DEL", key})); err != nil {
+		h.logger.Printf("[ERROR] unable to write expired key into the AOF: %v", err)
+	}
+
+	return ExpireDelete
 }
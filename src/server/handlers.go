@@ -5,6 +5,8 @@ import (
 	"ddia/src/resp"
 	"fmt"
 	"io"
+	"sync"
+	syncatomic "sync/atomic"
 )
 
 // Handlers define the commands being handled by the Redis Server. A new command should be registered
@@ -12,11 +14,23 @@ import (
 type Handlers struct {
 	logger logger.Logger
 	aof    io.Writer
+	// loading is in progress while the AOF is being restored on startup
+	loading loading
+	// evictMux prevents concurrent clients from evicting keys at the same time (see evict)
+	evictMux    sync.Mutex
+	evictedKeys syncatomic.Int64
+	// expiredKeys is the number of keys deleted because their timeout has passed, either lazily or actively
+	expiredKeys syncatomic.Int64
+	// expireCyclesCapped is the number of active expire cycles that ran out of time (see activeExpireCycle)
+	expireCyclesCapped syncatomic.Int64
+	// replication keeps the stream of commands sent to the replicas, and the link with the master (see PSYNC and
+	// REPLICAOF)
+	replication *replication
 }
 
 // NewHandlers returns a Handlers
 func NewHandlers(logger logger.Logger, aof io.Writer) *Handlers {
-	return &Handlers{logger: logger, aof: aof}
+	return &Handlers{logger: logger, aof: aof, replication: newReplication(defaultBacklogSize)}
 }
 
 // UnknownCommand returns an error when the command is unknown
@@ -3,9 +3,12 @@ package server
 import (
 	"ddia/src/expire"
 	"ddia/src/resp"
+	"ddia/src/storage/rdb"
 	"errors"
+	"fmt"
+	"math"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
@@ -20,6 +23,17 @@ import (
 //
 // More: https://redis.io/commands/del/
 func (h *Handlers) Del(c *client) error {
+	return h.del(c, c.db.Del)
+}
+
+// Unlink is like DEL, but the values of the keys are freed in the background: the database is not locked while
+// big values (eg: a list with a million elements) are being freed.
+// More: https://redis.io/commands/unlink/
+func (h *Handlers) Unlink(c *client) error {
+	return h.del(c, c.db.Unlink)
+}
+
+func (h *Handlers) del(c *client, del func(key string) bool) error {
 	if len(c.args) <= 1 {
 		return ErrWrongNumberArguments
 	}
@@ -29,7 +43,7 @@ func (h *Handlers) Del(c *client) error {
 	countDeleted := 0
 	err := h.atomic(c, func() error {
 		for _, key := range keys {
-			if c.db.Del(key) {
+			if del(key) {
 				countDeleted++
 			}
 		}
@@ -72,6 +86,49 @@ func (h *Handlers) Exists(c *client) error {
 	return c.writeResponse(resp.NewInteger(1))
 }
 
+// Touch records an access to each key given (see OBJECT IDLETIME), and returns the number of keys that exist.
+// More: https://redis.io/commands/touch/
+func (h *Handlers) Touch(c *client) error {
+	if len(c.args) <= 1 {
+		return ErrWrongNumberArguments
+	}
+
+	touched := 0
+	if err := h.atomic(c, func() error {
+		for _, key := range c.args[1:] {
+			if c.db.Touch(key) {
+				touched++
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.writeResponse(resp.NewInteger(touched))
+}
+
+// Type returns the kind of the value stored at key: "string" or "list", or "none" if the key does not exist.
+// More: https://redis.io/commands/type/
+func (h *Handlers) Type(c *client) error {
+	if err := c.requiredArgs(1); err != nil {
+		return err
+	}
+
+	kind := ""
+	err := h.atomic(c, func() (err error) {
+		kind, err = c.db.Type(c.args[1])
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		kind = "none"
+	} else if err != nil {
+		return err
+	}
+
+	return c.writeResponse(resp.NewSimpleString(kind))
+}
+
 // RandomKey return a random key from the currently selected database.
 // More: https://redis.io/commands/randomkey/
 func (h *Handlers) RandomKey(c *client) error {
@@ -95,9 +152,10 @@ func (h *Handlers) RandomKey(c *client) error {
 	return c.writeResponse(resp.NewStr(key))
 }
 
-// Rename renames key to newkey. It returns an error when key does not exist.
+// Rename renames key to newkey. It returns an error when key does not exist. The timeout of key, if any, is
+// moved to newkey, and the one of newkey is discarded.
 // More: https://redis.io/commands/rename/
-func (h *Handlers) Rename(c *client) error {
+func (h *Handlers) Rename(c *client, expire expire.Tracker) error {
 	if err := c.requiredArgs(2); err != nil {
 		return err
 	}
@@ -105,7 +163,15 @@ func (h *Handlers) Rename(c *client) error {
 	key, newKey := c.args[1], c.args[2]
 
 	err := h.atomic(c, func() (err error) {
-		return c.db.Rename(key, newKey)
+		if err := c.db.Rename(key, newKey); err != nil {
+			return err
+		}
+
+		expire.Remove(c.dbIdx, key)
+		if expiresAt, ok := c.db.ExpiresAt(newKey); ok {
+			expire.AddUpdate(c.dbIdx, newKey, expiresAt)
+		}
+		return nil
 	})
 
 	if err != nil {
@@ -115,64 +181,341 @@ func (h *Handlers) Rename(c *client) error {
 	return c.writeResponse(resp.NewStr("OK"))
 }
 
-func (h *Handlers) TTL(c *client, expire *expire.Expire) error {
+// RenameNX renames key to newkey only if newkey does not exist yet. It returns 1 if key has been renamed, 0 if
+// newkey already exists. Like RENAME, the timeout of key is moved to newkey.
+// More: https://redis.io/commands/renamenx/
+func (h *Handlers) RenameNX(c *client, expire expire.Tracker) error {
+	if err := c.requiredArgs(2); err != nil {
+		return err
+	}
+
+	key, newKey := c.args[1], c.args[2]
+
+	renamed := false
+	err := h.atomic(c, func() error {
+		if err := c.db.Exists(key); err != nil {
+			return err
+		}
+
+		if err := c.db.Exists(newKey); err == nil {
+			c.discardCommand()
+			return nil
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		if err := c.db.Rename(key, newKey); err != nil {
+			return err
+		}
+
+		expire.Remove(c.dbIdx, key)
+		if expiresAt, ok := c.db.ExpiresAt(newKey); ok {
+			expire.AddUpdate(c.dbIdx, newKey, expiresAt)
+		}
+		renamed = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !renamed {
+		return c.writeResponse(resp.NewInteger(0))
+	}
+
+	return c.writeResponse(resp.NewInteger(1))
+}
+
+// TTL returns the remaining time to live of a key that has a timeout, in seconds. It returns -2 if the key does
+// not exist, and -1 if the key exists but has no associated expire.
+//
+//	TTL key
+//
+// More: https://redis.io/commands/ttl/
+func (h *Handlers) TTL(c *client) error {
+	return h.ttl(c, func(expiresAt int64) int64 {
+		return (expiresAt - time.Now().UnixMilli() + 500) / 1000
+	})
+}
+
+// PTTL is like TTL, but the time to live is returned in milliseconds.
+//
+//	PTTL key
+//
+// More: https://redis.io/commands/pttl/
+func (h *Handlers) PTTL(c *client) error {
+	return h.ttl(c, func(expiresAt int64) int64 {
+		return expiresAt - time.Now().UnixMilli()
+	})
+}
+
+// ExpireTime returns the absolute Unix timestamp (since January 1, 1970) in seconds at which the given key will
+// expire, rounded to the nearest second as Redis does. It returns -2 if the key does not exist, and -1 if the key
+// exists but has no associated expire.
+//
+//	EXPIRETIME key
+//
+// More: https://redis.io/commands/expiretime/
+func (h *Handlers) ExpireTime(c *client) error {
+	return h.ttl(c, func(expiresAt int64) int64 {
+		return (expiresAt + 500) / 1000
+	})
+}
+
+// PExpireTime is like EXPIRETIME, but the timestamp is returned in milliseconds.
+//
+//	PEXPIRETIME key
+//
+// More: https://redis.io/commands/pexpiretime/
+func (h *Handlers) PExpireTime(c *client) error {
+	return h.ttl(c, func(expiresAt int64) int64 {
+		return expiresAt
+	})
+}
+
+// ttl replies with the deadline of the key (unix timestamp in milliseconds) converted by reply, or -2 if the key
+// does not exist, and -1 if the key exists but has no associated expire.
+func (h *Handlers) ttl(c *client, reply func(expiresAt int64) int64) error {
 	if err := c.requiredArgs(1); err != nil {
 		return err
 	}
 
-	var ttl int
+	var result int64
 
 	key := c.args[1]
 	if err := h.atomic(c, func() error {
-		var ok bool
-
-		if _, err := c.db.Get(key); errors.Is(err, ErrNotFound) {
-			ttl = -2 // [...] if the key does not exist.
-			return nil
+		if err := c.db.Exists(key); errors.Is(err, ErrNotFound) {
+			result = -2 // [...] if the key does not exist.
 		} else if err != nil {
 			return err
-		} else if ttl, ok = expire.TTL(key); !ok {
-			ttl = -1 // [...] if the key exists but has no associated expire.
+		} else if expiresAt, ok := c.db.ExpiresAt(key); !ok {
+			result = -1 // [...] if the key exists but has no associated expire.
+		} else {
+			result = reply(expiresAt)
 		}
 		return nil
 	}); err != nil {
-		return nil
+		return err
 	}
 
-	return c.writeResponse(resp.NewInteger(ttl))
+	return c.writeResponse(resp.NewInteger(int(result)))
 }
 
 // Expire set a timeout on key. After the timeout has expired, the key will
 // automatically be deleted. A key with an associated timeout is often said to be
 // volatile in Redis terminology.
 //
+//	EXPIRE key seconds [NX | XX | GT | LT]
+//
 // More: https://redis.io/commands/expire/
-func (h *Handlers) Expire(c *client, expire *expire.Expire) error {
-	if err := c.requiredArgs(2); err != nil {
+func (h *Handlers) Expire(c *client, expire expire.Tracker) error {
+	return h.expireCommand(c, expire, func(seconds int64) (int64, bool) {
+		return relativeDeadline(seconds, 1000)
+	})
+}
+
+// PExpire works exactly like EXPIRE but the time to live of the key is specified in milliseconds.
+//
+//	PEXPIRE key milliseconds [NX | XX | GT | LT]
+//
+// More: https://redis.io/commands/pexpire/
+func (h *Handlers) PExpire(c *client, expire expire.Tracker) error {
+	return h.expireCommand(c, expire, func(milliseconds int64) (int64, bool) {
+		return relativeDeadline(milliseconds, 1)
+	})
+}
+
+// ExpireAt has the same effect and semantic as EXPIRE, but instead of specifying the number of seconds
+// representing the TTL, it takes an absolute Unix timestamp (seconds since January 1, 1970).
+//
+//	EXPIREAT key unix-time-seconds [NX | XX | GT | LT]
+//
+// More: https://redis.io/commands/expireat/
+func (h *Handlers) ExpireAt(c *client, expire expire.Tracker) error {
+	return h.expireCommand(c, expire, func(seconds int64) (int64, bool) {
+		return seconds * 1000, seconds <= math.MaxInt64/1000 && seconds >= math.MinInt64/1000
+	})
+}
+
+// PExpireAt has the same effect and semantic as EXPIRE, but the time at which the key will expire is specified as
+// an absolute Unix timestamp in milliseconds. It's the command used on the AOF to record expirations.
+//
+//	PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
+//
+// More: https://redis.io/commands/pexpireat/
+func (h *Handlers) PExpireAt(c *client, expire expire.Tracker) error {
+	return h.expireCommand(c, expire, func(milliseconds int64) (int64, bool) {
+		return milliseconds, true
+	})
+}
+
+// Persist removes the existing timeout on key, turning the key from volatile to persistent. It returns 1 if the
+// timeout has been removed, and 0 if the key does not exist or does not have an associated timeout.
+//
+//	PERSIST key
+//
+// More: https://redis.io/commands/persist/
+func (h *Handlers) Persist(c *client, expire expire.Tracker) error {
+	if err := c.requiredArgs(1); err != nil {
 		return err
 	}
 
-	key, _seconds := c.args[1], c.args[2]
+	result := 0
+
+	key := c.args[1]
+	if err := h.atomic(c, func() error {
+		if err := c.db.Exists(key); errors.Is(err, ErrNotFound) {
+			c.discardCommand()
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !c.db.Persist(key) {
+			c.discardCommand()
+			return nil
+		}
+
+		expire.Remove(c.dbIdx, key)
+		result = 1
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.writeResponse(resp.NewInteger(result))
+}
+
+// expireFlags are the conditions to set the timeout of EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT:
+//
+//	NX: only if the key has no expiry
+//	XX: only if the key has an existing expiry
+//	GT: only if the new expiry is greater than the current one. A key without expiry has an infinite TTL.
+//	LT: only if the new expiry is less than the current one
+type expireFlags struct {
+	nx, xx, gt, lt bool
+}
+
+// parseExpireFlags parses the flags of the expire commands. The error returned is the one to reply to the client.
+func parseExpireFlags(args []string) (flags expireFlags, err error) {
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "GT":
+			flags.gt = true
+		case "LT":
+			flags.lt = true
+		default:
+			return flags, fmt.Errorf("ERR Unsupported option %s", arg)
+		}
+	}
+
+	if flags.nx && (flags.xx || flags.gt || flags.lt) {
+		return flags, errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+	} else if flags.gt && flags.lt {
+		return flags, errors.New("ERR GT and LT options at the same time are not compatible")
+	}
+
+	return flags, nil
+}
+
+// allow returns true if the timeout of a key can be set to expiresAt, given its current timeout (if volatile)
+func (f expireFlags) allow(current int64, volatile bool, expiresAt int64) bool {
+	switch {
+	case f.nx && volatile, f.xx && !volatile:
+		return false
+	case f.gt && (!volatile || expiresAt <= current):
+		return false
+	case f.lt && volatile && expiresAt >= current:
+		return false
+	default:
+		return true
+	}
+}
+
+// relativeDeadline returns the unix timestamp in milliseconds after n units of unit milliseconds from now. Returns
+// false if it overflows.
+func relativeDeadline(n, unit int64) (int64, bool) {
+	if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+		return 0, false
+	}
+
+	now := time.Now().UnixMilli()
+	if n*unit > math.MaxInt64-now {
+		return 0, false
+	}
+
+	return now + n*unit, true
+}
+
+// expireCommand parses the arguments of EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT, and sets the timeout of the key.
+// deadline converts the time argument into a unix timestamp in milliseconds, returning false if it overflows.
+func (h *Handlers) expireCommand(c *client, expire expire.Tracker, deadline func(n int64) (int64, bool)) error {
+	if len(c.args) < 3 {
+		return ErrWrongNumberArguments
+	}
+
+	key := c.args[1]
+
+	n, err := strconv.ParseInt(c.args[2], 10, 64)
+	if err != nil {
+		return ErrValueNotInt
+	}
 
-	seconds, err := strconv.Atoi(_seconds)
+	flags, err := parseExpireFlags(c.args[3:])
 	if err != nil {
-		return ErrWrongKind
+		return c.writeResponse(resp.NewError(err.Error()))
 	}
 
+	expiresAt, ok := deadline(n)
+	if !ok {
+		msg := fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(c.command()))
+		return c.writeResponse(resp.NewError(msg))
+	}
+
+	return h.expireAt(c, expire, key, expiresAt, flags)
+}
+
+// expireAt sets the expiration time (unix timestamp in milliseconds) of key, if allowed by flags. If the time is
+// in the past, the key is deleted right away. The command is always recorded on the AOF with an absolute
+// timestamp (PEXPIREAT), or as a DEL if the key has been deleted, so replaying the AOF after a restart does not
+// extend the life of the key. If nothing has been changed, the command is not recorded.
+func (h *Handlers) expireAt(c *client, expire expire.Tracker, key string, expiresAt int64, flags expireFlags) error {
 	result := 1 // if the timeout was set.
 
-	expirationTime := time.Now().Add(time.Duration(seconds) * time.Second).Unix()
 	if err := h.atomic(c, func() error {
-		// Make sure that
-		_, err := c.db.Get(key)
+		// Make sure that the key exists, whatever its kind
+		err := c.db.Exists(key)
 		if errors.Is(err, ErrNotFound) {
 			result = 0 // if the timeout was not set. e.g. key doesn't exist, or operation skipped due to the provided arguments.
-			return nil // No need
+			c.discardCommand()
+			return nil
 		} else if err != nil {
 			return err
 		}
 
-		expire.AddUpdate(c.dbIdx, key, expirationTime)
+		if current, volatile := c.db.ExpiresAt(key); !flags.allow(current, volatile, expiresAt) {
+			result = 0
+			c.discardCommand()
+			return nil
+		}
+
+		if expiresAt <= time.Now().UnixMilli() {
+			// The deadline has already passed: the key is deleted instead of being expired
+			c.db.Del(key)
+			expire.Remove(c.dbIdx, key)
+			c.rewriteCommand("DEL", key)
+			return nil
+		}
+
+		if err := c.db.SetExpire(key, expiresAt); err != nil {
+			return err
+		}
+		expire.AddUpdate(c.dbIdx, key, expiresAt)
+		c.rewriteCommand("PEXPIREAT", key, strconv.FormatInt(expiresAt, 10))
 		return nil
 	}); err != nil {
 		return err
@@ -183,9 +526,9 @@ func (h *Handlers) Expire(c *client, expire *expire.Expire) error {
 
 // Move key from the currently selected database (see SELECT) to the specified
 // destination database. When key already exists in the destination database, or
-// it does not exist in the source database, it does nothing.
+// it does not exist in the source database, it does nothing. The key is moved whatever its kind, with its timeout.
 // More: https://redis.io/commands/move/
-func (h *Handlers) Move(c *client, dbs []Storage, multiDBMutex *sync.Mutex) error {
+func (h *Handlers) Move(c *client, dbs []Storage, locks *dbLocks, expire expire.Tracker) error {
 	if err := c.requiredArgs(2); err != nil {
 		return err
 	}
@@ -199,45 +542,323 @@ func (h *Handlers) Move(c *client, dbs []Storage, multiDBMutex *sync.Mutex) erro
 
 	if dbIdx < 0 || dbIdx >= len(dbs) {
 		return c.writeResponse(resp.NewInteger(0))
+	} else if dbIdx == c.dbIdx {
+		return c.writeResponse(resp.NewError("ERR source and destination objects are the same"))
 	}
 
-	// This prevents death lock situation where:
-	//   Process 1: locked DB 2, trying to acquire lock of DB 3
-	//   Process 2: locked DB 3, trying to acquire lock of DB 2
-	// If Process 1 and 2 need to fight for the same lock (multiDBMutex) then
-	// this race condition disappear
-	multiDBMutex.Lock()
-	defer multiDBMutex.Unlock()
-
-	err = h.atomic(c, func() error {
-		v, err := c.db.Get(key)
-		if err != nil {
+	moved := false
+	if err := h.atomicDBs(c, locks, []int{c.dbIdx, dbIdx}, func() error {
+		var err error
+		moved, err = copyKey(c.db, dbs[dbIdx], dbIdx, key, key, false, expire)
+		if err != nil || !moved {
+			// When key already exists in the destination database, [...] it does nothing.
+			c.discardCommand()
 			return err
 		}
 
-		otherDB := dbs[dbIdx]
+		c.db.Del(key)
+		expire.Remove(c.dbIdx, key)
+		return nil
+	}); err != nil {
+		return err
+	}
 
-		otherDB.Lock()
-		defer otherDB.Unlock()
+	if !moved {
+		return c.writeResponse(resp.NewInteger(0))
+	}
 
-		if _, err := otherDB.Get(key); errors.Is(err, ErrNotFound) {
-			// When key already exists in the destination database, [...] it does nothing.
-		} else if err != nil {
+	return c.writeResponse(resp.NewInteger(1))
+}
+
+// Copy copies the value stored at the source key to the destination key, whatever its kind, with its timeout.
+// By default, the destination key is created in the database selected by the client: the DB option allows
+// specifying another one. The command returns 0 when the destination key already exists, unless REPLACE is given.
+//
+//	COPY source destination [DB destination-db] [REPLACE]
+//
+// More: https://redis.io/commands/copy/
+func (h *Handlers) Copy(c *client, dbs []Storage, locks *dbLocks, expire expire.Tracker) error {
+	if len(c.args) < 3 {
+		return ErrWrongNumberArguments
+	}
+
+	src, dst := c.args[1], c.args[2]
+	dbIdx, replace := c.dbIdx, false
+	for i := 3; i < len(c.args); i++ {
+		switch strings.ToUpper(c.args[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(c.args) {
+				return c.writeResponse(resp.NewError("ERR syntax error"))
+			}
+
+			idx, err := strconv.Atoi(c.args[i+1])
+			if err != nil {
+				return ErrValueNotInt
+			}
+			if idx < 0 || idx >= len(dbs) {
+				return c.writeResponse(resp.NewError("ERR DB index is out of range"))
+			}
+			dbIdx = idx
+			i++
+		default:
+			return c.writeResponse(resp.NewError("ERR syntax error"))
+		}
+	}
+
+	if dbIdx == c.dbIdx && src == dst {
+		return c.writeResponse(resp.NewError("ERR source and destination objects are the same"))
+	}
+
+	copied := false
+	if err := h.atomicDBs(c, locks, []int{c.dbIdx, dbIdx}, func() error {
+		var err error
+		copied, err = copyKey(c.db, dbs[dbIdx], dbIdx, src, dst, replace, expire)
+		if err != nil || !copied {
+			c.discardCommand()
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if !copied {
+		return c.writeResponse(resp.NewInteger(0))
+	}
+
+	return c.writeResponse(resp.NewInteger(1))
+}
+
+// copyKey copies key from src into dstKey of dst, the database dstIdx, with its value and its timeout. Returns false
+// if key does not exist, or if dstKey exists and replace is false. The caller must hold the locks of both databases.
+func copyKey(src, dst Storage, dstIdx int, key, dstKey string, replace bool, expire expire.Tracker) (bool, error) {
+	r, ok := dumpKey(src, dstIdx, key)
+	if !ok {
+		return false, nil
+	}
+
+	if err := dst.Exists(dstKey); err == nil {
+		if !replace {
+			return false, nil
+		}
+		dst.Del(dstKey)
+		expire.Remove(dstIdx, dstKey)
+	} else if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+
+	r.Key = dstKey
+	if err := restoreKey(dst, r); err != nil {
+		return false, err
+	}
+
+	if r.ExpiresAt != 0 {
+		expire.AddUpdate(dstIdx, dstKey, r.ExpiresAt)
+	}
+
+	return true, nil
+}
+
+// Dump serializes the value stored at key, with its timeout, in a format that RESTORE understands. The value is
+// versioned and checksummed: RESTORE refuses values that are corrupted, or created by another version. It returns
+// null if the key does not exist.
+// More: https://redis.io/commands/dump/
+func (h *Handlers) Dump(c *client) error {
+	if err := c.requiredArgs(1); err != nil {
+		return err
+	}
+
+	var payload []byte
+	if err := h.atomic(c, func() error {
+		r, ok := dumpKey(c.db, c.dbIdx, c.args[1])
+		if !ok {
+			return nil
+		}
+
+		var err error
+		payload, err = rdb.Dump(r)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	if payload == nil {
+		return c.writeResponse(resp.NewNullStr())
+	}
+
+	return c.writeResponse(resp.NewStr(string(payload)))
+}
+
+// Restore creates key from a value serialized by DUMP.
+//
+//	RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+//
+// ttl is the timeout of the key in milliseconds, or the unix timestamp in milliseconds when it expires with ABSTTL.
+// If it's 0, the key has no timeout, whatever the one it had when it was dumped. It returns an error if key already
+// exists, unless REPLACE is given. IDLETIME and FREQ set the access statistics of the key (see OBJECT).
+//
+// More: https://redis.io/commands/restore/
+func (h *Handlers) Restore(c *client, expire expire.Tracker) error {
+	if len(c.args) < 4 {
+		return ErrWrongNumberArguments
+	}
+
+	key, payload := c.args[1], c.args[3]
+
+	ttl, err := strconv.ParseInt(c.args[2], 10, 64)
+	if err != nil {
+		return ErrValueNotInt
+	} else if ttl < 0 {
+		return c.writeResponse(resp.NewError("ERR Invalid TTL value, must be >= 0"))
+	}
+
+	replace, absTTL, idle, frequency := false, false, int64(-1), int64(-1)
+	for i := 4; i < len(c.args); i++ {
+		switch option := strings.ToUpper(c.args[i]); option {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			if i+1 >= len(c.args) {
+				return c.writeResponse(resp.NewError("ERR syntax error"))
+			}
+			i++
+
+			n, err := strconv.ParseInt(c.args[i], 10, 64)
+			if option == "IDLETIME" {
+				if err != nil || n < 0 {
+					return c.writeResponse(resp.NewError("ERR Invalid IDLETIME value, must be >= 0"))
+				}
+				idle = n * 1000
+			} else {
+				if err != nil || n < 0 || n > 255 {
+					return c.writeResponse(resp.NewError("ERR Invalid FREQ value, must be >= 0 and <= 255"))
+				}
+				frequency = n
+			}
+		default:
+			return c.writeResponse(resp.NewError("ERR syntax error"))
+		}
+	}
+
+	r, err := rdb.Undump([]byte(payload))
+	if err != nil {
+		return c.writeResponse(resp.NewError("ERR DUMP payload version or checksum are wrong"))
+	}
+
+	now := time.Now().UnixMilli()
+	switch {
+	case ttl == 0:
+		r.ExpiresAt = 0
+	case absTTL:
+		r.ExpiresAt = ttl
+	default:
+		r.ExpiresAt = now + ttl
+	}
+	r.Key, r.DB = key, c.dbIdx
+
+	busy := false
+	if err := h.atomic(c, func() error {
+		if err := c.db.Exists(key); err == nil {
+			if !replace {
+				busy = true
+				c.discardCommand()
+				return nil
+			}
+			c.db.Del(key)
+			expire.Remove(c.dbIdx, key)
+		} else if !errors.Is(err, ErrNotFound) {
 			return err
 		}
 
-		if err := otherDB.Set(key, v); err != nil {
+		if r.ExpiresAt != 0 && r.ExpiresAt <= now {
+			// The key would be expired right away: it's not created
+			c.rewriteCommand("DEL", key)
+			return nil
+		}
+
+		if err := restoreKey(c.db, r); err != nil {
 			return err
 		}
+		if r.ExpiresAt != 0 {
+			expire.AddUpdate(c.dbIdx, key, r.ExpiresAt)
+		}
 
-		c.db.Del(key)
+		if idle >= 0 || frequency >= 0 {
+			stats, _ := c.db.KeyStats(key)
+			if idle < 0 {
+				idle = stats.Idle
+			}
+			if frequency < 0 {
+				frequency = int64(stats.Frequency)
+			}
+			c.db.SetAccessStats(key, idle, uint8(frequency))
+		}
 
+		// Recorded with the absolute timeout, so replaying the AOF does not extend the life of the key
+		dump, err := rdb.Dump(r)
+		if err != nil {
+			return err
+		}
+		if r.ExpiresAt != 0 {
+			c.rewriteCommand("RESTORE", key, strconv.FormatInt(r.ExpiresAt, 10), string(dump), "REPLACE", "ABSTTL")
+		} else {
+			c.rewriteCommand("RESTORE", key, "0", string(dump), "REPLACE")
+		}
 		return nil
-	})
+	}); err != nil {
+		return err
+	}
 
-	if err != nil {
-		return c.writeResponse(resp.NewInteger(0))
+	if busy {
+		return c.writeResponse(resp.NewError("BUSYKEY Target key name already exists."))
 	}
 
-	return c.writeResponse(resp.NewInteger(1))
+	return c.writeResponse(resp.NewSimpleString("OK"))
+}
+
+// Object inspects the internals of the value stored at key, without recording it as an access.
+//
+//	OBJECT ENCODING key: how the value is stored ("int", "embstr", "raw" or "linkedlist")
+//	OBJECT IDLETIME key: seconds since the key was last accessed
+//	OBJECT FREQ key: logarithmic access frequency counter of the key (see maxmemory-policy allkeys-lfu)
+//	OBJECT REFCOUNT key: number of references to the value, always 1
+//
+// Both the idle time and the frequency are tracked whatever the maxmemory-policy is.
+//
+// More: https://redis.io/commands/object/
+func (h *Handlers) Object(c *client) error {
+	if err := c.requiredArgs(2); err != nil {
+		return err
+	}
+
+	subcommand, key := strings.ToUpper(c.args[1]), c.args[2]
+
+	var stats KeyStats
+	var ok bool
+	if err := h.atomic(c, func() error {
+		stats, ok = c.db.KeyStats(key)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if !ok {
+		return c.writeResponse(resp.NewNullStr())
+	}
+
+	switch subcommand {
+	case "ENCODING":
+		return c.writeResponse(resp.NewStr(stats.Encoding))
+	case "IDLETIME":
+		return c.writeResponse(resp.NewInteger(int(stats.Idle / 1000)))
+	case "FREQ":
+		return c.writeResponse(resp.NewInteger(int(stats.Frequency)))
+	case "REFCOUNT":
+		return c.writeResponse(resp.NewInteger(1))
+	default:
+		return c.writeResponse(resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'.", c.args[1])))
+	}
 }
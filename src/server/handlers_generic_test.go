@@ -1,6 +1,20 @@
 package server_test
 
-import "testing"
+import (
+	"bytes"
+	"ddia/src/resp"
+	"ddia/src/server"
+	"ddia/src/server/config"
+	"ddia/testing/log"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestHandler_SetGetDel(t *testing.T) {
 	req := makeReq(t)
@@ -65,6 +79,56 @@ func TestHandler_Rename(t *testing.T) {
 	}
 }
 
+func TestHandler_RenameNX(t *testing.T) {
+	req := makeReq(t)
+
+	req("set hello world")
+	req("set other value")
+	req("expire hello 3600")
+
+	tests := []struct{ cmd, want string }{
+		{"renamenx hello other", "0"},
+		{"get other", "value"},
+		{"renamenx hello new-hello", "1"},
+		{"get new-hello", "world"},
+		{"exists hello", "0"},
+		{"renamenx missing key", ""},
+	}
+
+	for _, tt := range tests {
+		if got := req(tt.cmd); got != tt.want {
+			t.Fatalf("%s: unexpected response: %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	if rsp := req("ttl new-hello"); rsp == "-1" || rsp == "-2" {
+		t.Fatalf("expecting key to keep its TTL, got %q", rsp)
+	}
+}
+
+func TestHandler_TypeTouchUnlink(t *testing.T) {
+	req := makeReq(t)
+
+	req("set key value")
+	req("rpush list a b c")
+
+	tests := []struct{ cmd, want string }{
+		{"type key", "string"},
+		{"type list", "list"},
+		{"type missing", "none"},
+		{"touch key list missing", "2"},
+		{"unlink key list missing", "2"},
+		{"dbsize", "0"},
+		{"unlink", "ERR wrong number of arguments for 'unlink' command"},
+	}
+
+	for _, tt := range tests {
+		if got := req(tt.cmd); got != tt.want {
+			t.Fatalf("%s: unexpected response: %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
 func TestMove(t *testing.T) {
 	req := makeReq(t)
 
@@ -85,3 +149,624 @@ func TestMove(t *testing.T) {
 		t.Fatalf("unexpected value: %q, want %q", got, want)
 	}
 }
+
+func TestMove_AnyKind(t *testing.T) {
+	req := makeReq(t)
+
+	req("rpush list a b c")
+	req("expire list 3600")
+
+	if got, want := req("move list 1"), "1"; got != want {
+		t.Fatalf("unexpected response: %q, want %q", got, want)
+	}
+
+	req("select 1")
+	if got, want := req("lrange list 0 -1"), "a b c"; got != want {
+		t.Fatalf("unexpected value: %q, want %q", got, want)
+	}
+
+	if got := req("ttl list"); got == "-1" || got == "-2" {
+		t.Fatalf("expecting the key to keep its TTL, got %q", got)
+	}
+}
+
+func TestHandler_Copy(t *testing.T) {
+	req := makeReq(t)
+
+	req("rpush list a b c")
+	req("set string value")
+	req("expire string 3600")
+
+	tests := []struct{ cmd, want string }{
+		{"copy list other", "1"},
+		{"lrange other 0 -1", "a b c"},
+		{"copy list other", "0"},
+		{"copy string other replace", "1"},
+		{"get other", "value"},
+		{"copy missing other replace", "0"},
+		{"copy string string", "ERR source and destination objects are the same"},
+		{"copy string string db 1", "1"},
+		{"copy string string db 16", "ERR DB index is out of range"},
+		{"copy string string foo", "ERR syntax error"},
+		{"select 1", "OK"},
+		{"get string", "value"},
+	}
+
+	for _, tt := range tests {
+		if got := req(tt.cmd); got != tt.want {
+			t.Fatalf("%s: unexpected response: %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	// The timeout is copied with the key
+	if got := req("ttl string"); got == "-1" || got == "-2" {
+		t.Fatalf("expecting the key to keep its TTL, got %q", got)
+	}
+}
+
+func TestHandler_DumpRestore(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+	s, _ := testServerWithAOF(t, aofPath)
+	conn := testConn(t, s)
+	req := func(args ...string) string {
+		return parse(t, req(t, conn, args))
+	}
+
+	req("rpush", "list", "a", "b c", "\r\n")
+	req("pexpire", "list", "3600000")
+	payload := req("dump", "list")
+
+	if rsp, want := req("dump", "missing"), "null"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"restore", "copy", "0", payload}, "OK"},
+		{[]string{"lrange", "copy", "0", "-1"}, "a b c \r\n"},
+		{[]string{"restore", "copy", "0", payload}, "BUSYKEY Target key name already exists."},
+		{[]string{"restore", "copy", "0", payload, "replace", "idletime", "1000"}, "OK"},
+		{[]string{"object", "idletime", "copy"}, "1000"},
+		{[]string{"restore", "other", "0", payload[:len(payload)-1]}, "ERR DUMP payload version or checksum are wrong"},
+		{[]string{"restore", "other", "-1", payload}, "ERR Invalid TTL value, must be >= 0"},
+		{[]string{"restore", "other", "0", payload, "freq", "256"}, "ERR Invalid FREQ value, must be >= 0 and <= 255"},
+		{[]string{"restore", "expired", "1", payload, "absttl"}, "OK"},
+		{[]string{"exists", "expired"}, "0"},
+	}
+
+	for _, tt := range tests {
+		if got := req(tt.args...); got != tt.want {
+			t.Fatalf("%v: unexpected response: %q, want %q", tt.args[:2], got, tt.want)
+		}
+	}
+
+	// With a TTL of 0, the key does not expire, whatever the timeout it had when dumped
+	if rsp, want := req("ttl", "copy"), "-1"; rsp != want {
+		t.Fatalf("expecting the key not to expire, got %q", rsp)
+	}
+
+	req("restore", "short", "60000", payload)
+	if rsp, _ := strconv.Atoi(req("ttl", "short")); rsp <= 0 || rsp > 60 {
+		t.Fatalf("expecting the TTL given, got %d", rsp)
+	}
+
+	// With ABSTTL, the TTL is the unix time in milliseconds when the key expires
+	expiresAt := time.Now().Add(2 * time.Hour).UnixMilli()
+	req("restore", "absolute", strconv.FormatInt(expiresAt, 10), payload, "absttl")
+	if rsp, want := req("pexpiretime", "absolute"), strconv.FormatInt(expiresAt, 10); rsp != want {
+		t.Fatalf("expecting the expiration given, got %q want %q", rsp, want)
+	}
+
+	// Replaying the AOF restores the same timeouts
+	_ = conn.Close()
+	if err := s.Stop(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	s, _ = testServerWithAOF(t, aofPath)
+	conn = testConn(t, s)
+	if rsp, want := req("ttl", "copy"), "-1"; rsp != want {
+		t.Fatalf("expecting the key not to expire after a restart, got %q", rsp)
+	}
+
+	if rsp, want := req("pexpiretime", "absolute"), strconv.FormatInt(expiresAt, 10); rsp != want {
+		t.Fatalf("expecting the expiration given after a restart, got %q want %q", rsp, want)
+	}
+}
+
+func TestHandler_Migrate(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+	source, _ := testServerWithAOF(t, aofPath)
+	target := testServer(t)
+
+	host, port, _ := net.SplitHostPort(target.Addr())
+	targetConn := testConn(t, target)
+	treq := func(args string) string {
+		return parse(t, req(t, targetConn, strings.Split(args, " ")))
+	}
+
+	conn := testConn(t, source)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	req("set key value")
+	req("rpush list a b c")
+	req("expire list 3600")
+	req("set copied value")
+
+	migrate := "migrate " + host + " " + port
+
+	tests := []struct{ cmd, want string }{
+		{migrate + " key 3 1000", "OK"},
+		{"exists key", "0"},
+		{migrate + " missing 3 1000", "NOKEY"},
+		{migrate + "  3 1000 keys list missing", "OK"},
+		{migrate + " copied 3 1000 copy", "OK"},
+		{"exists copied", "1"},
+		{migrate + " copied 3 1000", "ERR Target instance replied with error: BUSYKEY Target key name already exists."},
+		{migrate + " copied 3 1000 replace", "OK"},
+		{"migrate localhost 1 key 3 1000", "NOKEY"},
+	}
+
+	for _, tt := range tests {
+		if got := req(tt.cmd); got != tt.want {
+			t.Fatalf("%s: unexpected response: %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	req("set key value")
+	if rsp := req("migrate localhost 1 key 3 1000"); !strings.HasPrefix(rsp, "IOERR") {
+		t.Fatalf("expecting IOERR, got %q", rsp)
+	}
+
+	treq("select 3")
+	for cmd, want := range map[string]string{"get key": "value", "lrange list 0 -1": "a b c", "get copied": "value"} {
+		if got := treq(cmd); got != want {
+			t.Fatalf("%s: unexpected response: %q, want %q", cmd, got, want)
+		}
+	}
+
+	if rsp := treq("ttl list"); rsp == "-1" || rsp == "-2" {
+		t.Fatalf("expecting the key to keep its TTL, got %q", rsp)
+	}
+
+	// The keys migrated are deleted after a restart too
+	_ = conn.Close()
+	if err := source.Stop(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	source, _ = testServerWithAOF(t, aofPath)
+	conn = testConn(t, source)
+	if rsp, want := req("dbsize"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestExpire_AOF(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+
+	s, _ := testServerWithAOF(t, aofPath)
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	t.Run("relative expirations are recorded as absolute", func(t *testing.T) {
+		req("set key value")
+		before := time.Now()
+		req("expire key 100")
+
+		content := readAOF(t, aofPath)
+		if strings.Contains(content, "expire") {
+			t.Fatalf("EXPIRE should not be recorded as is:\n%s", content)
+		}
+
+		const prefix = "PEXPIREAT\r\n$3\r\nkey\r\n$13\r\n"
+		idx := strings.Index(content, prefix)
+		if idx == -1 {
+			t.Fatalf("PEXPIREAT not found on the AOF:\n%s", content)
+		}
+
+		ms, err := strconv.ParseInt(content[idx+len(prefix):idx+len(prefix)+13], 10, 64)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		deadline := time.UnixMilli(ms)
+		if deadline.Before(before.Add(99*time.Second)) || deadline.After(before.Add(101*time.Second)) {
+			t.Fatalf("unexpected deadline: %s, expecting ~100s from %s", deadline, before)
+		}
+	})
+
+	t.Run("deadlines in the past are recorded as DEL", func(t *testing.T) {
+		req("set gone value")
+		if rsp, want := req("expire gone 0"), "1"; rsp != want {
+			t.Fatalf("invalid response: %q want %q", rsp, want)
+		}
+
+		if rsp, want := req("exists gone"), "0"; rsp != want {
+			t.Fatalf("invalid response: %q want %q", rsp, want)
+		}
+
+		if content := readAOF(t, aofPath); !strings.Contains(content, "DEL\r\n$4\r\ngone\r\n") {
+			t.Fatalf("DEL not found on the AOF:\n%s", content)
+		}
+	})
+
+	t.Run("commands that do not change the timeout are not recorded", func(t *testing.T) {
+		req("set conditional value")
+		req("expire conditional 100")
+		before := readAOF(t, aofPath)
+
+		if rsp, want := req("expire conditional 50 GT"), "0"; rsp != want {
+			t.Fatalf("invalid response: %q want %q", rsp, want)
+		}
+		if rsp, want := req("pexpire non-existing 50"), "0"; rsp != want {
+			t.Fatalf("invalid response: %q want %q", rsp, want)
+		}
+
+		if after := readAOF(t, aofPath); after != before {
+			t.Fatalf("unexpected commands recorded:\n%s", after[len(before):])
+		}
+
+		req("persist conditional")
+		if content := readAOF(t, aofPath); !strings.Contains(content, "persist\r\n$11\r\nconditional\r\n") {
+			t.Fatalf("PERSIST not found on the AOF:\n%s", content)
+		}
+	})
+
+	t.Run("expired keys are recorded as DEL", func(t *testing.T) {
+		req("set short-lived value")
+		req("expire short-lived 1")
+
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			if strings.Contains(readAOF(t, aofPath), "DEL\r\n$11\r\nshort-lived\r\n") {
+				return
+			}
+		}
+
+		t.Fatalf("DEL not found on the AOF:\n%s", readAOF(t, aofPath))
+	})
+}
+
+func TestExpire_RestoreAOF_DeadlinePassed(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+
+	buf := &bytes.Buffer{}
+	for _, cmd := range [][]string{
+		{"SELECT", "0"},
+		{"SET", "expired", "value"},
+		{"PEXPIREAT", "expired", "1000"}, // 1970
+		{"SET", "alive", "value"},
+		{"PEXPIREAT", "alive", strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)},
+	} {
+		_, _ = resp.NewArray(cmd).WriteTo(buf)
+	}
+
+	if err := os.WriteFile(aofPath, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	s, _ := testServerWithAOF(t, aofPath)
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	if rsp, want := req("exists expired"), "0"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("get alive"), "value"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestHandler_Object(t *testing.T) {
+	req := makeReq(t)
+
+	_ = req("set counter 10")
+	_ = req("set short hello")
+	_ = req("set long " + strings.Repeat("x", 45))
+	_ = req("rpush list a b c")
+
+	for key, want := range map[string]string{"counter": "int", "short": "embstr", "long": "raw", "list": "linkedlist"} {
+		if rsp := req("object encoding " + key); rsp != want {
+			t.Fatalf("invalid encoding of %q: %q want %q", key, rsp, want)
+		}
+	}
+
+	if rsp, want := req("object idletime counter"), "0"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if freq, err := strconv.Atoi(req("object freq counter")); err != nil || freq == 0 {
+		t.Fatalf("invalid frequency: %d (%v)", freq, err)
+	}
+
+	if rsp, want := req("object refcount counter"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("object encoding non-existing"), "null"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("object foo counter"), "ERR unknown subcommand 'foo'."; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestHandler_ExpireMilliseconds(t *testing.T) {
+	req := makeReq(t)
+
+	req("set key value")
+	if rsp, want := req("pexpire key 10200"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if pttl, err := strconv.Atoi(req("pttl key")); err != nil || pttl <= 9700 || pttl > 10200 {
+		t.Fatalf("invalid pttl: %d (%v)", pttl, err)
+	}
+
+	if rsp, want := req("ttl key"), "10"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	deadline := time.Now().Add(time.Hour).Unix()
+	if rsp, want := req("expireat key "+strconv.FormatInt(deadline, 10)), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("expiretime key"), strconv.FormatInt(deadline, 10); rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("pexpiretime key"), strconv.FormatInt(deadline*1000, 10); rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	// A deadline in milliseconds is rounded to the nearest second, as Redis does
+	for ms, want := range map[int64]int64{600: deadline + 1, 400: deadline, 500: deadline + 1} {
+		req("pexpireat key " + strconv.FormatInt(deadline*1000+ms, 10))
+		if rsp := req("expiretime key"); rsp != strconv.FormatInt(want, 10) {
+			t.Fatalf("invalid response with %d ms: %q want %d", ms, rsp, want)
+		}
+	}
+
+	if rsp, want := req("persist key"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	for cmd, want := range map[string]string{
+		"persist key": "0", "ttl key": "-1", "pttl key": "-1", "expiretime key": "-1",
+		"ttl non-existing": "-2", "pttl non-existing": "-2", "pexpiretime non-existing": "-2",
+	} {
+		if rsp := req(cmd); rsp != want {
+			t.Fatalf("invalid response to %q: %q want %q", cmd, rsp, want)
+		}
+	}
+
+	req("set short-lived value")
+	req("pexpire short-lived 100")
+	for start := time.Now(); req("exists short-lived") != "0"; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the key has not expired")
+		}
+	}
+}
+
+func TestHandler_ExpireFlags(t *testing.T) {
+	req := makeReq(t)
+
+	req("set key value")
+
+	for _, tc := range []struct{ cmd, want string }{
+		{"expire key 100 XX", "0"}, // No timeout yet
+		{"expire key 100 GT", "0"}, // A key without timeout has an infinite TTL
+		{"expire key 100 NX", "1"},
+		{"expire key 200 NX", "0"},
+		{"expire key 50 GT", "0"},
+		{"expire key 200 gt", "1"},
+		{"expire key 300 LT", "0"},
+		{"expire key 100 XX LT", "1"},
+		{"ttl key", "100"},
+		{"persist key", "1"},
+		{"pexpire key 100000 LT", "1"},
+		{"ttl key", "100"},
+		{"expire key 100 NX XX", "ERR NX and XX, GT or LT options at the same time are not compatible"},
+		{"expire key 100 GT LT", "ERR GT and LT options at the same time are not compatible"},
+		{"expire key 100 FOO", "ERR Unsupported option FOO"},
+		{"expire key 9223372036854775807", "ERR invalid expire time in 'expire' command"},
+		{"expire key abc", "ERR value is not an integer or out of range"},
+	} {
+		if rsp := req(tc.cmd); rsp != tc.want {
+			t.Fatalf("invalid response to %q: %q want %q", tc.cmd, rsp, tc.want)
+		}
+	}
+}
+
+func TestHandler_TTLFollowsKey(t *testing.T) {
+	req := makeReq(t)
+
+	for _, tc := range []struct{ cmd, want string }{
+		// Each database has its own timeouts
+		{"set key value", "OK"},
+		{"expire key 100", "1"},
+		{"select 1", "OK"},
+		{"set key value", "OK"},
+		{"ttl key", "-1"},
+		{"expire key 200", "1"},
+		{"select 0", "OK"},
+		{"ttl key", "100"},
+		// DEL discards the timeout
+		{"del key", "1"},
+		{"set key value", "OK"},
+		{"ttl key", "-1"},
+		// SET discards the timeout, commands that modify the value keep it
+		{"expire key 100", "1"},
+		{"set key other-value", "OK"},
+		{"ttl key", "-1"},
+		{"set counter 1", "OK"},
+		{"expire counter 100", "1"},
+		{"incr counter", "2"},
+		{"ttl counter", "100"},
+		{"rpush list a b", "2"},
+		{"expire list 100", "1"},
+		{"lpop list", "a"},
+		{"ttl list", "100"},
+		// RENAME moves the timeout, and discards the one of the new key
+		{"set renamed value", "OK"},
+		{"expire renamed 300", "1"},
+		{"rename counter renamed", "OK"},
+		{"ttl counter", "-2"},
+		{"ttl renamed", "100"},
+		{"rename key renamed", "OK"},
+		{"ttl renamed", "-1"},
+		// MOVE moves the timeout, and does nothing if the key exists on the destination
+		{"set moved value", "OK"},
+		{"expire moved 100", "1"},
+		{"move moved 2", "1"},
+		{"ttl moved", "-2"},
+		{"set moved value", "OK"},
+		{"move moved 2", "0"},
+		{"move moved 0", "ERR source and destination objects are the same"},
+		{"select 2", "OK"},
+		{"ttl moved", "100"},
+		{"get moved", "value"},
+		// FLUSHDB and FLUSHALL discard the timeouts
+		{"flushdb", "OK"},
+		{"set moved value", "OK"},
+		{"ttl moved", "-1"},
+		{"select 1", "OK"},
+		{"flushall", "OK"},
+		{"set key value", "OK"},
+		{"ttl key", "-1"},
+	} {
+		if rsp := req(tc.cmd); rsp != tc.want {
+			t.Fatalf("invalid response to %q: %q want %q", tc.cmd, rsp, tc.want)
+		}
+	}
+}
+
+func TestHandler_StaleDeadlines(t *testing.T) {
+	req := makeReq(t)
+
+	// Each key is given a timeout that is discarded afterwards. None of them must be expired.
+	for _, cmd := range []string{
+		"set deleted value", "pexpire deleted 100", "del deleted", "set deleted new-value",
+		"set overwritten value", "pexpire overwritten 100", "set overwritten new-value",
+		"set persisted value", "pexpire persisted 100", "persist persisted",
+		"set renamed value", "pexpire renamed 100", "rename renamed other", "set renamed new-value", "persist other",
+		"set moved value", "pexpire moved 100", "move moved 1", "set moved new-value",
+		"set flushed value", "pexpire flushed 100", "select 1", "flushdb", "set flushed new-value", "select 0",
+	} {
+		req(cmd)
+	}
+
+	time.Sleep(300 * time.Millisecond) // Let a few active expire cycles run
+
+	for _, key := range []string{"deleted", "overwritten", "persisted", "renamed", "moved", "other"} {
+		if rsp := req("exists " + key); rsp != "1" {
+			t.Fatalf("the key %q has been expired", key)
+		}
+	}
+
+	req("select 1")
+	if rsp, want := req("get flushed"), "new-value"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestExpire_Lazy(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+
+	s, _ := testServerWithAOF(t, aofPath)
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	req("set key value")
+	req("pexpire key 20")
+	time.Sleep(30 * time.Millisecond)
+
+	// The key is not returned, even if the active expire cycle has not deleted it yet
+	for cmd, want := range map[string]string{"get key": "", "ttl key": "-2", "exists key": "0"} {
+		if rsp := req(cmd); rsp != want {
+			t.Fatalf("invalid response to %q: %q want %q", cmd, rsp, want)
+		}
+	}
+
+	if content := readAOF(t, aofPath); !strings.Contains(content, "DEL\r\n$3\r\nkey\r\n") {
+		t.Fatalf("DEL not found on the AOF:\n%s", content)
+	}
+
+	if rsp := req("info stats"); !strings.Contains(rsp, "expired_keys:1\r\n") {
+		t.Fatalf("invalid response: %q", rsp)
+	}
+}
+
+func TestExpire_ActiveCycle(t *testing.T) {
+	req := makeReq(t)
+
+	for i := 0; i < 1000; i++ {
+		req("set key-" + strconv.Itoa(i) + " value")
+		req("pexpire key-" + strconv.Itoa(i) + " 10")
+	}
+
+	// The keys are deleted without being accessed, in less than a second
+	for start := time.Now(); req("dbsize") != "0"; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the keys have not expired: %s keys left", req("dbsize"))
+		}
+	}
+
+	if rsp := req("info stats"); !strings.Contains(rsp, "expired_keys:1000\r\n") {
+		t.Fatalf("invalid response: %q", rsp)
+	}
+}
+
+func TestExpire_TimingWheel(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "appendonlydir")
+	s, _, err := startServerWithAOF(t, aofPath, "expire-tracker timing-wheel\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	for i := 0; i < 100; i++ {
+		req("set key-" + strconv.Itoa(i) + " value")
+		req("pexpire key-" + strconv.Itoa(i) + " " + strconv.Itoa(10+i))
+	}
+	req("set persisted value")
+	req("pexpire persisted 10")
+	req("persist persisted")
+
+	for start := time.Now(); req("dbsize") != "1"; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the keys have not expired: %s keys left", req("dbsize"))
+		}
+	}
+
+	if rsp, want := req("exists persisted"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	configPath := path.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(configPath, []byte("expire-tracker foo\n"), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	_, err = server.New(server.NewHandlers(log.ServerLogger(), nil), server.WithConfigurationFile(configPath))
+	if !errors.Is(err, config.ErrInvalidType) {
+		t.Fatalf("expecting ErrInvalidType, got: %v", err)
+	}
+}
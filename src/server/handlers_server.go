@@ -1,12 +1,133 @@
 package server
 
 import (
+	"ddia/src/expire"
 	"ddia/src/resp"
 	"ddia/src/server/config"
+	"ddia/src/storage/aof"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// BGRewriteAOF instructs Redis to start an Append Only File rewrite process. The rewrite will create a small
+// optimized version of the current Append Only File. If BGREWRITEAOF fails, no data gets lost as the old AOF will
+// be untouched. If preamble is true, the dataset is written as a snapshot (see aof-use-rdb-preamble).
+// More: https://redis.io/commands/bgrewriteaof/
+func (h *Handlers) BGRewriteAOF(c *client, dbs []Storage, locks *dbLocks, sched *scheduler, preamble bool) error {
+	if err := c.requiredArgs(0); err != nil {
+		return err
+	}
+
+	err := h.rewriteAOF(dbs, locks, sched, preamble)
+	if errors.Is(err, aof.ErrRewriteInProgress) {
+		return c.writeResponse(resp.NewError("ERR Background append only file rewriting already in progress"))
+	} else if errors.Is(err, aof.ErrRewriteNotSupported) {
+		return c.writeResponse(resp.NewError("ERR Background append only file rewriting is not supported: appendonly is disabled"))
+	} else if err != nil {
+		return err
+	}
+
+	return c.writeResponse(resp.NewSimpleString("Background append only file rewriting started"))
+}
+
+// Info returns information and statistics about the server. Only the "memory", "persistence", "stats" and
+// "replication" sections are supported.
+//
+//	INFO [section [section ...]]
+//
+// More: https://redis.io/commands/info/
+func (h *Handlers) Info(c *client, dbs []Storage, m maxMemory) error {
+	sections := map[string]bool{}
+	for _, section := range c.args[1:] {
+		sections[strings.ToLower(section)] = true
+	}
+
+	all := len(sections) == 0 || sections["all"] || sections["default"] || sections["everything"]
+
+	var info strings.Builder
+	if all || sections["memory"] {
+		fmt.Fprintf(&info, "# Memory\r\n")
+		fmt.Fprintf(&info, "used_memory:%d\r\n", usedMemory(dbs))
+		fmt.Fprintf(&info, "maxmemory:%d\r\n", m.limit)
+		fmt.Fprintf(&info, "maxmemory_policy:%s\r\n", m.policy)
+		lazyFree := lazyFreeStats(dbs)
+		fmt.Fprintf(&info, "lazyfree_pending_objects:%d\r\n", lazyFree.Pending)
+		fmt.Fprintf(&info, "lazyfreed_objects:%d\r\n", lazyFree.Freed)
+	}
+	if all || sections["persistence"] {
+		h.infoPersistence(&info)
+	}
+	if all || sections["stats"] {
+		fmt.Fprintf(&info, "# Stats\r\n")
+		fmt.Fprintf(&info, "expired_keys:%d\r\n", h.expiredKeys.Load())
+		fmt.Fprintf(&info, "expired_time_cap_reached_count:%d\r\n", h.expireCyclesCapped.Load())
+		fmt.Fprintf(&info, "evicted_keys:%d\r\n", h.evictedKeys.Load())
+		h.replication.stats(&info)
+	}
+	if all || sections["replication"] {
+		h.replication.info(&info)
+	}
+
+	return c.writeResponse(resp.NewStr(info.String()))
+}
+
+// lazyFreeStats returns the values being freed in the background, and the ones already freed, of all the databases
+func lazyFreeStats(dbs []Storage) LazyFreeStats {
+	var stats LazyFreeStats
+	for _, db := range dbs {
+		s := db.LazyFreeStats()
+		stats.Pending += s.Pending
+		stats.Freed += s.Freed
+	}
+	return stats
+}
+
+func (h *Handlers) infoPersistence(w io.Writer) {
+	var stats aof.Stats
+	s, enabled := h.aof.(aofStats)
+	if enabled {
+		stats = s.Stats()
+	}
+
+	status := "ok"
+	if stats.Err != nil {
+		status = "err"
+	}
+
+	fmt.Fprintf(w, "# Persistence\r\n")
+	loading := h.loading.inProgress.Load()
+	fmt.Fprintf(w, "loading:%d\r\n", boolToInt(loading))
+	if loading {
+		percentage, eta := h.loading.progress()
+		fmt.Fprintf(w, "loading_start_time:%d\r\n", h.loading.startedAt.Load())
+		fmt.Fprintf(w, "loading_total_bytes:%d\r\n", h.loading.total.Load())
+		fmt.Fprintf(w, "loading_loaded_bytes:%d\r\n", h.loading.loaded.Load())
+		fmt.Fprintf(w, "loading_loaded_perc:%.2f\r\n", percentage)
+		fmt.Fprintf(w, "loading_eta_seconds:%d\r\n", eta)
+	}
+	fmt.Fprintf(w, "aof_enabled:%d\r\n", boolToInt(enabled))
+	fmt.Fprintf(w, "aof_rewrite_in_progress:%d\r\n", boolToInt(stats.RewriteInProgress))
+	fmt.Fprintf(w, "aof_last_write_status:%s\r\n", status)
+	if stats.Err != nil {
+		fmt.Fprintf(w, "aof_last_write_error:%s\r\n", stats.Err)
+	}
+	if enabled {
+		fmt.Fprintf(w, "aof_current_size:%d\r\n", stats.Size)
+		fmt.Fprintf(w, "aof_base_size:%d\r\n", stats.BaseSize)
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 // Config returns stuff from the Config.
 //
 // TODO: This command has been included to try to make redis-benchmark cli to work. I'm returning hardcoded stuff
@@ -44,37 +165,106 @@ func (h *Handlers) DBSize(c *client) error {
 		return nil
 	}
 
-	return c.writeResponse(resp.NewInteger(c.db.Size()))
+	size := 0
+	if err := h.atomic(c, func() error {
+		size = c.db.Size()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.writeResponse(resp.NewInteger(size))
 }
 
-// FlushAll delete all the keys of all the existing databases, not just the currently selected one.
+// FlushAll delete all the keys of all the existing databases, not just the currently selected one. With ASYNC,
+// the keys are freed in the background. The databases are flushed at once: no client sees some of them flushed and
+// others not.
 // More: https://redis.io/commands/flushall
-func (h *Handlers) FlushAll(c *client, dbs []Storage) error {
-	if err := c.requiredArgs(0); err != nil {
+func (h *Handlers) FlushAll(c *client, dbs []Storage, locks *dbLocks) error {
+	if len(c.args) > 2 {
+		return ErrWrongNumberArguments
+	}
+
+	flush, ok := flushFunc(c)
+	if !ok {
+		return c.writeResponse(resp.NewError("ERR syntax error"))
+	}
+
+	if err := h.atomicAllDBs(c, locks, func() error {
+		for _, db := range dbs {
+			if err := flush(db); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
 		return err
 	}
 
-	for _, db := range dbs {
-		db.Lock()
-		if err := db.FlushDB(); err != nil {
-			db.Unlock()
-			return err
+	return c.writeResponse(resp.NewSimpleString("OK"))
+}
+
+// SwapDB swaps two databases: the clients connected to one of them see the keys of the other one right away. The
+// timeouts are swapped with the keys.
+// More: https://redis.io/commands/swapdb/
+func (h *Handlers) SwapDB(c *client, dbs []Storage, locks *dbLocks, expire expire.Tracker) error {
+	if err := c.requiredArgs(2); err != nil {
+		return err
+	}
+
+	first, err := strconv.Atoi(c.args[1])
+	if err != nil {
+		return c.writeResponse(resp.NewError("ERR invalid first DB index"))
+	}
+
+	second, err := strconv.Atoi(c.args[2])
+	if err != nil {
+		return c.writeResponse(resp.NewError("ERR invalid second DB index"))
+	}
+
+	if first < 0 || first >= len(dbs) || second < 0 || second >= len(dbs) {
+		return c.writeResponse(resp.NewError("ERR DB index is out of range"))
+	}
+
+	if err := h.atomicDBs(c, locks, []int{first, second}, func() error {
+		if first == second {
+			c.discardCommand()
+			return nil
 		}
-		db.Unlock()
+
+		// The expire tracker keeps the deadlines by database: they are added for the database the keys are going
+		// to. The ones left behind are stale, and discarded when they are found (see expireKey).
+		for from, to := range map[int]int{first: second, second: first} {
+			for _, key := range dbs[from].Keys() {
+				if expiresAt, ok := dbs[from].ExpiresAt(key); ok {
+					expire.AddUpdate(to, key, expiresAt)
+				}
+			}
+		}
+
+		return dbs[first].Swap(dbs[second])
+	}); err != nil {
+		return err
 	}
 
 	return c.writeResponse(resp.NewSimpleString("OK"))
 }
 
-// FlushDB delete all the keys of the currently selected DB. This command never fails.
+// FlushDB delete all the keys of the currently selected DB. This command never fails. With ASYNC, the keys are
+// freed in the background.
 // More: https://redis.io/commands/flushdb/
 func (h *Handlers) FlushDB(c *client) error {
-	if err := c.requiredArgs(0); err != nil {
-		return err
+	if len(c.args) > 2 {
+		return ErrWrongNumberArguments
+	}
+
+	flush, ok := flushFunc(c)
+	if !ok {
+		return c.writeResponse(resp.NewError("ERR syntax error"))
 	}
 
 	err := h.atomic(c, func() error {
-		return c.db.FlushDB()
+		return flush(c.db)
 	})
 	if err != nil {
 		return err
@@ -82,3 +272,118 @@ func (h *Handlers) FlushDB(c *client) error {
 
 	return c.writeResponse(resp.NewSimpleString("OK"))
 }
+
+// flushFunc returns the function that flushes a database, as asked by the optional argument of FLUSHDB and
+// FLUSHALL: ASYNC or SYNC (default). Returns false if the argument is not valid.
+func flushFunc(c *client) (func(db Storage) error, bool) {
+	if len(c.args) < 2 {
+		return Storage.FlushDB, true
+	}
+
+	switch strings.ToUpper(c.args[1]) {
+	case "ASYNC":
+		return Storage.FlushDBAsync, true
+	case "SYNC":
+		return Storage.FlushDB, true
+	default:
+		return nil, false
+	}
+}
+
+// Memory reports the memory used by the dataset. Only the USAGE and STATS subcommands are supported.
+//
+//	MEMORY USAGE key [SAMPLES count]: number of bytes used by the key and its value
+//	MEMORY STATS: memory used, and the number of keys and bytes used by database and type
+//
+// The memory used is an estimation of the size of the structures that hold the dataset, not the memory of the
+// process. SAMPLES is accepted for compatibility: the size of the elements of a list is tracked as they are
+// modified, so it's never estimated from a sample of them.
+//
+// More: https://redis.io/commands/memory-usage/ and https://redis.io/commands/memory-stats/
+func (h *Handlers) Memory(c *client, dbs []Storage) error {
+	if len(c.args) < 2 {
+		return ErrWrongNumberArguments
+	}
+
+	switch subcommand := strings.ToUpper(c.args[1]); subcommand {
+	case "USAGE":
+		return h.memoryUsage(c)
+	case "STATS":
+		return h.memoryStats(c, dbs)
+	default:
+		return c.writeResponse(resp.NewError(fmt.Sprintf("ERR unknown subcommand '%s'.", c.args[1])))
+	}
+}
+
+func (h *Handlers) memoryUsage(c *client) error {
+	if len(c.args) != 3 && len(c.args) != 5 {
+		return ErrWrongNumberArguments
+	}
+
+	if len(c.args) == 5 {
+		if strings.ToUpper(c.args[3]) != "SAMPLES" {
+			return c.writeResponse(resp.NewError("ERR syntax error"))
+		}
+		if samples, err := strconv.Atoi(c.args[4]); err != nil || samples < 0 {
+			return ErrValueNotInt
+		}
+	}
+
+	var stats KeyStats
+	var ok bool
+	if err := h.atomic(c, func() error {
+		stats, ok = c.db.KeyStats(c.args[2])
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if !ok {
+		return c.writeResponse(resp.NewNullStr())
+	}
+
+	return c.writeResponse(resp.NewInteger(int(stats.Size)))
+}
+
+// memoryStats replies with a flat list of names and values. The databases without keys are omitted:
+//
+//	total.allocated, keys.count, db.{idx}.keys, db.{idx}.bytes, db.{idx}.{type}.keys, db.{idx}.{type}.bytes
+func (h *Handlers) memoryStats(c *client, dbs []Storage) error {
+	if err := c.requiredArgs(1); err != nil {
+		return err
+	}
+
+	var total MemoryStats
+	var breakdown []string
+	for idx, db := range dbs {
+		db.Lock()
+		byType := db.MemoryStats()
+		db.Unlock()
+
+		types := make([]string, 0, len(byType))
+		var dbStats MemoryStats
+		for t, s := range byType {
+			types = append(types, t)
+			dbStats.Keys += s.Keys
+			dbStats.Bytes += s.Bytes
+		}
+		sort.Strings(types)
+
+		if dbStats.Keys == 0 {
+			continue
+		}
+		total.Keys += dbStats.Keys
+		total.Bytes += dbStats.Bytes
+
+		prefix := fmt.Sprintf("db.%d.", idx)
+		breakdown = append(breakdown,
+			prefix+"keys", strconv.Itoa(dbStats.Keys), prefix+"bytes", strconv.FormatInt(dbStats.Bytes, 10))
+		for _, t := range types {
+			breakdown = append(breakdown,
+				prefix+t+".keys", strconv.Itoa(byType[t].Keys), prefix+t+".bytes", strconv.FormatInt(byType[t].Bytes, 10))
+		}
+	}
+
+	stats := []string{"total.allocated", strconv.FormatInt(total.Bytes, 10), "keys.count", strconv.Itoa(total.Keys)}
+	return c.writeResponse(resp.NewArray(append(stats, breakdown...)))
+}
@@ -1,6 +1,21 @@
 package server_test
 
-import "testing"
+import (
+	"context"
+	"ddia/src/resp"
+	"ddia/src/server"
+	"ddia/src/storage/aof"
+	"ddia/src/storage/rdb"
+	"ddia/testing/log"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestHandler_DBSize(t *testing.T) {
 	req := makeReq(t)
@@ -51,6 +66,80 @@ func TestHandler_FlushAll(t *testing.T) {
 	})
 }
 
+// FLUSHALL is written into the AOF once, whatever the number of databases
+func TestHandler_FlushAll_AOF(t *testing.T) {
+	for _, cmd := range []string{"flushall", "flushall async"} {
+		aofPath := path.Join(t.TempDir(), "redis.aof")
+
+		s, _ := testServerWithAOF(t, aofPath)
+		conn := testConn(t, s)
+		req := func(args string) string {
+			return parse(t, req(t, conn, strings.Split(args, " ")))
+		}
+
+		req("set hello world")
+		req("select 1")
+		req("set hello world")
+		if rsp, want := req(cmd), "OK"; rsp != want {
+			t.Fatalf("invalid response: %q want %q", rsp, want)
+		}
+
+		want := &strings.Builder{}
+		_, _ = resp.NewArray([]string{"SELECT", "1"}).WriteTo(want)
+		_, _ = resp.NewArray(strings.Split(cmd, " ")).WriteTo(want)
+		if content := readAOF(t, aofPath); !strings.HasSuffix(content, want.String()) {
+			t.Fatalf("%s has not been written into the AOF: %q", cmd, content)
+		}
+
+		_ = conn.Close()
+		if err := s.Stop(); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		// Once replayed, the databases are still empty
+		s, _ = testServerWithAOF(t, aofPath)
+		conn = testConn(t, s)
+		for _, db := range []string{"0", "1"} {
+			req("select " + db)
+			if rsp, want := req("dbsize"), "0"; rsp != want {
+				t.Fatalf("invalid response on DB %s after %s: %q want %q", db, cmd, rsp, want)
+			}
+		}
+	}
+}
+
+func TestHandler_FlushAsync(t *testing.T) {
+	req := makeReq(t)
+
+	req("rpush list a b c")
+	req("select 1")
+	req("set key value")
+
+	tests := []struct{ cmd, want string }{
+		{"flushdb async", "OK"},
+		{"dbsize", "0"},
+		{"flushdb later", "ERR syntax error"},
+		{"set key value", "OK"},
+		{"flushall async", "OK"},
+		{"select 0", "OK"},
+		{"dbsize", "0"},
+		{"flushall sync", "OK"},
+	}
+
+	for _, tt := range tests {
+		if got := req(tt.cmd); got != tt.want {
+			t.Fatalf("%s: unexpected response: %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	for start := time.Now(); !strings.Contains(req("info memory"), "lazyfreed_objects:3\r\n"); {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the keys have not been freed: %q", req("info memory"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestHandler_FlushDB(t *testing.T) {
 	req := makeReq(t)
 
@@ -76,3 +165,479 @@ func TestHandler_FlushDB(t *testing.T) {
 		}
 	})
 }
+
+func TestHandler_SwapDB(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+
+	s, _ := testServerWithAOF(t, aofPath)
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	req("set key db-0")
+	req("pexpire key 100")
+	req("select 1")
+	req("rpush list db-1")
+
+	if rsp, want := req("swapdb 0 1"), "OK"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	// The client connected to DB 1 sees the keys of DB 0 right away
+	if rsp, want := req("get key"), "db-0"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("swapdb 0 16"), "ERR DB index is out of range"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	// The key expires on its new database
+	for start := time.Now(); req("dbsize") != "0"; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the key has not expired after being swapped")
+		}
+	}
+
+	_ = conn.Close()
+	if err := s.Stop(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	s, _ = testServerWithAOF(t, aofPath)
+	conn = testConn(t, s)
+
+	if rsp, want := req("lrange list 0 -1"), "db-1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+// Concurrent commands locking the same databases in a different order must not deadlock
+func TestHandler_MultiDBLocks(t *testing.T) {
+	s := testServer(t)
+
+	var wg sync.WaitGroup
+	for i, cmd := range []string{"move key 1", "move key 0", "swapdb 0 1", "swapdb 1 0", "copy key key db 1 replace"} {
+		wg.Add(1)
+		go func(db int, cmd string) {
+			defer wg.Done()
+
+			conn := testConn(t, s)
+			req(t, conn, []string{"select", strconv.Itoa(db % 2)})
+			for j := 0; j < 100; j++ {
+				req(t, conn, []string{"set", "key", "value"})
+				req(t, conn, strings.Split(cmd, " "))
+			}
+		}(i, cmd)
+	}
+
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("deadlock: the commands have not finished")
+	}
+}
+
+func TestHandler_BGRewriteAOF(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+
+	s, appendOnlyFile := testServerWithAOF(t, aofPath)
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	for i := 0; i < 100; i++ {
+		req("incr visits")
+	}
+	req("set key value")
+	req("rpush list one two three")
+	req("expire key 3600")
+	req("select 1")
+	req("set other-db value")
+
+	before := readAOF(t, aofPath)
+
+	if rsp, want := req("bgrewriteaof"), "Background append only file rewriting started"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	for appendOnlyFile.RewriteInProgress() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if after := readAOF(t, aofPath); len(after) >= len(before) {
+		t.Fatalf("the AOF has not been compacted: %d bytes, before %d bytes", len(after), len(before))
+	}
+
+	// Written after the rewrite, must be appended to the new incremental file
+	req("set after rewrite")
+
+	_ = conn.Close()
+	if err := s.Stop(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// Restore the compacted AOF on a new server
+	s, _ = testServerWithAOF(t, aofPath)
+	conn = testConn(t, s)
+
+	if rsp, want := req("get visits"), "100"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("lrange list 0 -1"), "one two three"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp := req("ttl key"); rsp == "-1" || rsp == "-2" {
+		t.Fatalf("expecting key to have a TTL, got %q", rsp)
+	}
+
+	req("select 1")
+	if rsp, want := req("get other-db"), "value"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("get after"), "rewrite"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestHandler_BGRewriteAOF_Preamble(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+
+	s, appendOnlyFile, err := startServerWithAOF(t, aofPath, "aof-use-rdb-preamble yes")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	req("set key value")
+	req("rpush list one two three")
+	req("expire key 3600")
+	req("select 1")
+	req("set other-db value")
+
+	if rsp, want := req("bgrewriteaof"), "Background append only file rewriting started"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	for appendOnlyFile.RewriteInProgress() {
+		time.Sleep(time.Millisecond)
+	}
+
+	req("set after rewrite")
+
+	files, err := aof.Files(aofPath, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	base, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if !strings.HasPrefix(string(base), rdb.Magic) {
+		t.Fatalf("the base file does not start with a snapshot: %q", base)
+	}
+
+	_ = conn.Close()
+	if err := s.Stop(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// The snapshot is loaded even if the preamble is not enabled anymore
+	s, _ = testServerWithAOF(t, aofPath)
+	conn = testConn(t, s)
+
+	if rsp, want := req("get key"), "value"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("lrange list 0 -1"), "one two three"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp := req("ttl key"); rsp == "-1" || rsp == "-2" {
+		t.Fatalf("expecting key to have a TTL, got %q", rsp)
+	}
+
+	req("select 1")
+	if rsp, want := req("get other-db"), "value"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("get after"), "rewrite"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestHandler_BGRewriteAOF_Disabled(t *testing.T) {
+	req := makeReq(t)
+
+	want := "ERR Background append only file rewriting is not supported: appendonly is disabled"
+	if rsp := req("bgrewriteaof"); rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+// failingDisk fails all the writes and syncs while fail is true
+type failingDisk struct {
+	mux  sync.Mutex
+	fail bool
+}
+
+func (d *failingDisk) Write(p []byte) (int, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.fail {
+		return 0, errors.New("no space left on device")
+	}
+	return len(p), nil
+}
+
+func (d *failingDisk) Sync() error {
+	return nil
+}
+
+func (d *failingDisk) Close() error {
+	return nil
+}
+
+func (d *failingDisk) setFail(fail bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.fail = fail
+}
+
+func TestHandler_PersistenceFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	disk := &failingDisk{}
+	handlers := server.NewHandlers(log.ServerLogger(), aof.NewAppendOnlyFile(ctx, disk, aof.AlwaysSync))
+
+	s, err := server.New(handlers, serverOptions()...)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Stop() })
+
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	req("set key value")
+	disk.setFail(true)
+
+	// The write is done in memory, and queued to be written into the AOF once the disk recovers
+	want := "MISCONF Errors writing to the AOF file: the AOF is failing, the write has been queued: " +
+		"no space left on device"
+	if rsp := req("set key other-value"); rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	// Write commands are refused, read commands are served
+	want = "MISCONF Errors writing to the AOF file: no space left on device"
+	if rsp := req("set key another-value"); rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("get key"), "other-value"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp := req("info persistence"); !strings.Contains(rsp, "aof_last_write_status:err\r\n") {
+		t.Fatalf("invalid response: %q", rsp)
+	}
+
+	disk.setFail(false)
+
+	// The AOF retries in the background, and the server accepts writes again once the disk recovers
+	deadline := time.Now().Add(5 * time.Second)
+	for req("set key value") != "OK" {
+		if time.Now().After(deadline) {
+			t.Fatalf("the server did not recover")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if rsp := req("info"); !strings.Contains(rsp, "aof_last_write_status:ok\r\n") {
+		t.Fatalf("invalid response: %q", rsp)
+	}
+}
+
+func TestHandler_Info(t *testing.T) {
+	req := makeReq(t)
+
+	rsp := req("info")
+	wants := []string{"# Persistence\r\n", "loading:0\r\n", "aof_enabled:0\r\n", "aof_last_write_status:ok\r\n"}
+	for _, want := range wants {
+		if !strings.Contains(rsp, want) {
+			t.Fatalf("invalid response: %q, want %q", rsp, want)
+		}
+	}
+
+	if rsp, want := req("info keyspace"), ""; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestHandler_Memory(t *testing.T) {
+	req := makeReq(t)
+
+	_ = req("set key value")
+	_ = req("rpush list a b c")
+
+	usage, err := strconv.Atoi(req("memory usage key"))
+	if err != nil || usage <= len("key")+len("value") {
+		t.Fatalf("invalid memory usage: %d (%v)", usage, err)
+	}
+
+	_ = req("select 1")
+	_ = req("set other value")
+
+	if rsp, want := req("memory usage other samples 0"), strconv.Itoa(usage+2); rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("memory usage non-existing"), "null"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	stats := strings.Fields(req("memory stats"))
+	values := map[string]string{}
+	for i := 0; i+1 < len(stats); i += 2 {
+		values[stats[i]] = stats[i+1]
+	}
+
+	for name, want := range map[string]string{
+		"keys.count": "3", "db.0.keys": "2", "db.0.string.keys": "1", "db.0.list.keys": "1", "db.1.keys": "1",
+		"db.1.string.bytes": strconv.Itoa(usage + 2),
+	} {
+		if values[name] != want {
+			t.Fatalf("invalid %s: %q want %q, stats: %v", name, values[name], want, stats)
+		}
+	}
+}
+
+func TestHandler_Schedule(t *testing.T) {
+	req := makeReq(t)
+
+	if rsp, want := req("schedule in 20 set key value"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	at := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+	req("select 1")
+	if rsp, want := req("schedule at "+at+" incr counter"), "2"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("schedule id 2 in 10 incr counter"), "ERR schedule 2 already exists"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("schedule in 10 get key"), "ERR command 'get' cannot be scheduled"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("schedule soon 10 incr counter"), "ERR syntax error"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	// The command runs on the database selected when it was scheduled
+	req("select 0")
+	for start := time.Now(); req("get key") != "value"; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the scheduled command has not run")
+		}
+	}
+
+	if rsp, want := req("schedule list"), "2 "+at+" 1 incr counter"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("schedule cancel 2"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("schedule cancel 2"), "0"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("schedule list"), ""; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestHandler_Schedule_AOF(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+
+	s, appendOnlyFile := testServerWithAOF(t, aofPath)
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	req("schedule in 10 set done yes")
+	for start := time.Now(); req("get done") != "yes"; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the scheduled command has not run")
+		}
+	}
+
+	req("select 1")
+	req("schedule in 3600000 set later yes")
+	req("schedule in 3600000 set cancelled yes")
+	req("schedule cancel 3")
+
+	if rsp, want := req("bgrewriteaof"), "Background append only file rewriting started"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+	for appendOnlyFile.RewriteInProgress() {
+		time.Sleep(time.Millisecond)
+	}
+
+	req("schedule in 200 set soon yes")
+
+	_ = conn.Close()
+	if err := s.Stop(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// The pending schedules are restored, the ones that have run or have been cancelled are not
+	s, _ = testServerWithAOF(t, aofPath)
+	conn = testConn(t, s)
+
+	list := strings.Fields(req("schedule list"))
+	if len(list) != 12 || list[0] != "4" || list[6] != "2" || list[10] != "later" {
+		t.Fatalf("invalid schedules: %v", list)
+	}
+
+	if rsp, want := req("schedule in 10 set new yes"), "5"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	req("select 1")
+	for start := time.Now(); req("get soon") != "yes"; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the scheduled command has not run after the restart")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"strings"
+	syncatomic "sync/atomic"
+	"time"
+)
+
+// loading tracks the progress of the AOF being restored on startup. The server accepts connections meanwhile, but
+// the clients can only run the commands that do not access the dataset (see checkLoading).
+type loading struct {
+	inProgress syncatomic.Bool
+	// startedAt is the unix timestamp when the restore started
+	startedAt syncatomic.Int64
+	// total is the size of the files of the AOF, and loaded how many bytes have been read
+	total, loaded syncatomic.Int64
+}
+
+// start marks the restore as in progress, with total bytes to be loaded
+func (l *loading) start(total int64) {
+	l.startedAt.Store(time.Now().Unix())
+	l.total.Store(total)
+	l.loaded.Store(0)
+	l.inProgress.Store(true)
+}
+
+// finish marks the restore as finished. From then on, all the commands are served.
+func (l *loading) finish() {
+	l.inProgress.Store(false)
+}
+
+// progress returns the percentage of bytes loaded, and the estimated number of seconds left
+func (l *loading) progress() (percentage float64, eta int64) {
+	total, loaded := l.total.Load(), l.loaded.Load()
+	if total == 0 || loaded == 0 {
+		return 0, 1
+	}
+
+	elapsed := time.Now().Unix() - l.startedAt.Load()
+	return float64(loaded) * 100 / float64(total), elapsed * (total - loaded) / loaded
+}
+
+// allowedWhileLoading are the commands that can be run while the AOF is being restored
+var allowedWhileLoading = map[string]bool{Auth: true, Ping: true, Quit: true, Info: true, Config: true}
+
+// checkLoading returns ErrLoading if the AOF is being restored, unless c is the one restoring it (or the one
+// applying the AOF followed, see follow-appenddirname) or the command does not access the dataset
+func (h *Handlers) checkLoading(c *client) error {
+	if c.replaying || c.master || !h.loading.inProgress.Load() || allowedWhileLoading[strings.ToUpper(c.command())] {
+		return nil
+	}
+
+	return ErrLoading
+}
@@ -0,0 +1,101 @@
+//go:build unix
+
+package server_test
+
+import (
+	"context"
+	"ddia/src/server"
+	"ddia/testing/log"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServer_Loading(t *testing.T) {
+	// The AOF is a named pipe, so the restore does not finish until the test writes into it
+	aofPath := path.Join(t.TempDir(), "appendonly.aof")
+	if err := syscall.Mkfifo(aofPath, 0600); err != nil {
+		t.Fatalf("unable to create the named pipe: %v", err)
+	}
+
+	configPath := path.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(configPath, []byte("appenddirname "+aofPath+"\n"), 0600); err != nil {
+		t.Fatalf("unable to write configuration file: %v", err)
+	}
+
+	port := freePort(t)
+	options := append(serverOptions(), server.WithConfigurationFile(configPath), server.WithPort(port))
+	s, err := server.New(server.NewHandlers(log.ServerLogger(), io.Discard), options...)
+	if err != nil {
+		t.Fatalf("expecting server to be able to start without problems: %v", err)
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- s.Start(context.Background()) }()
+
+	conn := dialUntilListening(t, fmt.Sprintf("localhost:%d", port))
+	defer func() { _ = conn.Close() }() // Closed before stopping the server, that waits for the clients
+
+	rsp, want := parse(t, req(t, conn, []string{"GET", "key"})), "LOADING Redis is loading the dataset in memory"
+	if rsp != want {
+		t.Fatalf("invalid response: %q, want %q", rsp, want)
+	}
+
+	if rsp, want := parse(t, req(t, conn, []string{"PING"})), "PONG"; rsp != want {
+		t.Fatalf("invalid response: %q, want %q", rsp, want)
+	}
+
+	rsp = parse(t, req(t, conn, []string{"INFO"}))
+	for _, want := range []string{"loading:1\r\n", "loading_loaded_perc:0.00\r\n"} {
+		if !strings.Contains(rsp, want) {
+			t.Fatalf("invalid response: %q, want %q", rsp, want)
+		}
+	}
+
+	if err := os.WriteFile(aofPath, []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"), 0600); err != nil {
+		t.Fatalf("unable to write into the named pipe: %v", err)
+	}
+
+	if err := <-started; err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Stop() })
+
+	if rsp, want := parse(t, req(t, conn, []string{"GET", "key"})), "value"; rsp != want {
+		t.Fatalf("invalid response: %q, want %q", rsp, want)
+	}
+
+	if rsp := parse(t, req(t, conn, []string{"INFO"})); !strings.Contains(rsp, "loading:0\r\n") {
+		t.Fatalf("invalid response: %q", rsp)
+	}
+}
+
+// freePort returns a port that is not in use
+func freePort(t testing.TB) int {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// dialUntilListening connects to addr, waiting for the server to be listening
+func dialUntilListening(t testing.TB, addr string) net.Conn {
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		} else if i == 100 {
+			t.Fatalf("the server is not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
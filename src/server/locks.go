@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+)
+
+// dbLocks acquires the locks of several databases at once. The locks are always acquired in ascending order of
+// database, whatever the order they are asked for, so two clients locking the same databases cannot deadlock:
+//
+//	Process 1: locked DB 2, trying to acquire lock of DB 3
+//	Process 2: locked DB 3, trying to acquire lock of DB 2 <--- Not possible, DB 2 is always locked first
+//
+// A command holding the lock of a single database is safe too: it never waits for another one while holding it.
+type dbLocks struct {
+	dbs []Storage
+}
+
+func newDBLocks(dbs []Storage) *dbLocks {
+	return &dbLocks{dbs: dbs}
+}
+
+// lock acquires the locks of the databases given, which can be repeated. Returns the function that releases them.
+func (l *dbLocks) lock(indexes ...int) (unlock func()) {
+	sorted := make([]int, 0, len(indexes))
+	for _, idx := range indexes {
+		if idx < 0 || idx >= len(l.dbs) {
+			panic(fmt.Errorf("%w: %d", ErrDBIndexOutOfRange, idx))
+		}
+		sorted = append(sorted, idx)
+	}
+	sort.Ints(sorted)
+
+	locked := make([]int, 0, len(sorted))
+	for i, idx := range sorted {
+		if i > 0 && idx == sorted[i-1] {
+			continue
+		}
+		l.dbs[idx].Lock()
+		locked = append(locked, idx)
+	}
+
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			l.dbs[locked[i]].Unlock()
+		}
+	}
+}
+
+// lockAll acquires the locks of all the databases. Returns the function that releases them.
+func (l *dbLocks) lockAll() (unlock func()) {
+	indexes := make([]int, len(l.dbs))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	return l.lock(indexes...)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"ddia/src/expire"
+	"ddia/src/resp"
+	"ddia/src/storage/rdb"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrate transfers keys to another server: they are restored there (see RESTORE), and deleted from this one.
+//
+//	MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [KEYS key [key ...]]
+//
+// With KEYS, key must be empty, and all the keys given are transferred. timeout bounds each step of the transfer,
+// in milliseconds. The database is locked meanwhile, so no client sees a key on both servers, or on none. With
+// COPY the keys are not deleted, and with REPLACE the keys already in the destination are replaced. It returns
+// OK, or NOKEY if none of the keys exists.
+//
+// More: https://redis.io/commands/migrate/
+func (h *Handlers) Migrate(c *client, expire expire.Tracker) error {
+	if len(c.args) < 6 {
+		return ErrWrongNumberArguments
+	}
+
+	addr := net.JoinHostPort(c.args[1], c.args[2])
+	keys := []string{c.args[3]}
+
+	db, err := strconv.Atoi(c.args[4])
+	if err != nil {
+		return ErrValueNotInt
+	}
+
+	timeout, err := strconv.ParseInt(c.args[5], 10, 64)
+	if err != nil || timeout < 0 {
+		return ErrValueNotInt
+	} else if timeout == 0 {
+		timeout = 1000 // As in Redis
+	}
+
+	cp, replace, password := false, false, ""
+	for i := 6; i < len(c.args); i++ {
+		switch strings.ToUpper(c.args[i]) {
+		case "COPY":
+			cp = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(c.args) {
+				return c.writeResponse(resp.NewError("ERR syntax error"))
+			}
+			password = c.args[i+1]
+			i++
+		case "KEYS":
+			if c.args[3] != "" {
+				return c.writeResponse(resp.NewError(
+					"ERR When using MIGRATE KEYS option, the key argument must be set to the empty string"))
+			}
+			keys = c.args[i+1:]
+			i = len(c.args)
+		default:
+			return c.writeResponse(resp.NewError("ERR syntax error"))
+		}
+	}
+
+	target := migrationTarget{addr: addr, timeout: time.Duration(timeout) * time.Millisecond, password: password, db: db}
+
+	migrated := false
+	var migrateErr error
+	if err := h.atomic(c, func() error {
+		var records []rdb.Record
+		for _, key := range keys {
+			if r, ok := dumpKey(c.db, c.dbIdx, key); ok {
+				records = append(records, r)
+			}
+		}
+
+		if len(records) == 0 {
+			c.discardCommand()
+			return nil
+		}
+
+		if migrateErr = target.restore(records, replace); migrateErr != nil {
+			c.discardCommand()
+			return nil
+		}
+		migrated = true
+
+		if cp {
+			c.discardCommand()
+			return nil
+		}
+
+		// Recorded as DEL: replaying the AOF must not transfer the keys again
+		del := []string{"DEL"}
+		for _, r := range records {
+			c.db.Del(r.Key)
+			expire.Remove(c.dbIdx, r.Key)
+			del = append(del, r.Key)
+		}
+		c.rewriteCommand(del...)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var replied targetError
+	if errors.As(migrateErr, &replied) {
+		return c.writeResponse(resp.NewError("ERR Target instance replied with error: " + string(replied)))
+	} else if migrateErr != nil {
+		return c.writeResponse(resp.NewError(fmt.Sprintf("IOERR error or timeout migrating to %s: %v", addr, migrateErr)))
+	}
+
+	if !migrated {
+		return c.writeResponse(resp.NewSimpleString("NOKEY"))
+	}
+
+	return c.writeResponse(resp.NewSimpleString("OK"))
+}
+
+// migrationTarget is the server where MIGRATE transfers the keys
+type migrationTarget struct {
+	addr     string
+	timeout  time.Duration
+	password string
+	db       int
+}
+
+// restore connects to the target, and restores records on its database. Each record is sent with its
+// expiration inside the serialized value.
+func (t migrationTarget) restore(records []rdb.Record, replace bool) error {
+	conn, err := net.DialTimeout(serverNetwork, t.addr, t.timeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	r := bufio.NewReader(conn)
+	send := func(args ...string) error {
+		if err := conn.SetDeadline(time.Now().Add(t.timeout)); err != nil {
+			return err
+		}
+		if _, err := resp.NewArray(args).WriteTo(conn); err != nil {
+			return err
+		}
+		return readStatusReply(r)
+	}
+
+	if t.password != "" {
+		if err := send("AUTH", t.password); err != nil {
+			return err
+		}
+	}
+
+	if err := send("SELECT", strconv.Itoa(t.db)); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		payload, err := rdb.Dump(record)
+		if err != nil {
+			return err
+		}
+
+		// The timeout inside the payload is not used by RESTORE: it's sent as a TTL, as Redis does
+		ttl := int64(0)
+		if record.ExpiresAt != 0 {
+			ttl = record.ExpiresAt - time.Now().UnixMilli()
+			if ttl < 1 {
+				ttl = 1
+			}
+		}
+
+		args := []string{"RESTORE", record.Key, strconv.FormatInt(ttl, 10), string(payload)}
+		if replace {
+			args = append(args, "REPLACE")
+		}
+		if err := send(args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// targetError is an error replied by the target of MIGRATE
+type targetError string
+
+func (e targetError) Error() string {
+	return string(e)
+}
+
+// readStatusReply reads a reply of a single line (eg: "+OK"). If it's an error, it's returned as targetError.
+func readStatusReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return targetError(line[1:])
+	}
+
+	return nil
+}
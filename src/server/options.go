@@ -11,6 +11,28 @@ type options struct {
 	port              int
 	password          string
 	configurationFile string
+
+	// autoAOFRewritePercentage and autoAOFRewriteMinSize define when the AOF is automatically rewritten
+	autoAOFRewritePercentage int
+	autoAOFRewriteMinSize    int64
+	// aofUseRDBPreamble writes a snapshot of the dataset at the beginning of the AOF when it's rewritten
+	aofUseRDBPreamble bool
+	// maxMemory evicts keys when the memory used reaches a limit
+	maxMemory maxMemory
+	// expireTracker is the structure that keeps track of the keys to expire (see expire-tracker)
+	expireTracker string
+	// replicaOf is the host and the port of the master, if the server starts as a replica (see replicaof)
+	replicaOf []string
+	// masterAuth is the password sent to the master (see masterauth)
+	masterAuth string
+	// replBacklogSize is the size of the replication backlog (see repl-backlog-size)
+	replBacklogSize int64
+	// replicaReadOnly refuses the writes of the clients while being a replica (see replica-read-only)
+	replicaReadOnly bool
+	// followAOFDir and followAOFFilename are the AOF followed, if the server starts as a log-shipping replica (see
+	// follow-appenddirname)
+	followAOFDir      string
+	followAOFFilename string
 }
 
 // Option defines an interface that all options must match
@@ -0,0 +1,676 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"ddia/src/resp"
+	"ddia/src/server/config"
+	"ddia/src/storage/aof"
+	"ddia/src/storage/rdb"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// replicaRetryPeriod is how long a replica waits to connect again to its master, after losing the link
+	replicaRetryPeriod = time.Second
+	// replicaAckPeriod is how often a replica acknowledges to its master the offset it has applied
+	replicaAckPeriod = time.Second
+	// replicaTimeout bounds connecting to the master, and each step of the handshake
+	replicaTimeout = 10 * time.Second
+)
+
+// The states of the link with the master
+const (
+	linkConnect   = "connect"
+	linkSync      = "sync"
+	linkConnected = "connected"
+)
+
+// masterLink is the link of a replica with its master
+type masterLink struct {
+	host string
+	port string
+	// dir and filename are the AOF followed by a log-shipping replica, instead of a master (see
+	// follow-appenddirname)
+	dir      string
+	filename string
+	// status is linkConnect while connecting, linkSync while receiving the snapshot, and linkConnected while
+	// applying the stream
+	status string
+	// cancel stops the replication, and done is closed once it has stopped
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (l *masterLink) String() string {
+	if l.dir != "" {
+		return l.dir
+	}
+	return net.JoinHostPort(l.host, l.port)
+}
+
+// readReplication reads the replication directives from the configuration into opts
+func readReplication(c config.Config, opts *options) (err error) {
+	if replicaOf, ok := c.Get("replicaof"); ok {
+		opts.replicaOf = strings.Fields(replicaOf)
+		if len(opts.replicaOf) != 2 {
+			return fmt.Errorf("%w: replicaof must be followed by the host and the port of the master", config.ErrInvalidType)
+		}
+	}
+
+	opts.masterAuth = c.GetD("masterauth", opts.masterAuth)
+
+	if opts.replBacklogSize, err = c.Bytes("repl-backlog-size", opts.replBacklogSize); err != nil {
+		return err
+	} else if opts.replBacklogSize <= 0 {
+		return fmt.Errorf("%w: repl-backlog-size must be positive", config.ErrInvalidType)
+	}
+
+	opts.replicaReadOnly = c.GetD("replica-read-only", "yes") == "yes"
+
+	opts.followAOFDir = c.GetD("follow-appenddirname", "")
+	opts.followAOFFilename = c.GetD("follow-appendfilename", aof.DefaultFilename)
+	if opts.followAOFDir == "" {
+		return nil
+	} else if opts.replicaOf != nil {
+		return fmt.Errorf("%w: replicaof and follow-appenddirname cannot be used together", config.ErrInvalidType)
+	}
+
+	// Both servers would write the same files
+	if c.GetD("appendonly", "no") == "yes" {
+		followed, err := filepath.Abs(opts.followAOFDir)
+		if err != nil {
+			return err
+		}
+
+		own, err := filepath.Abs(c.GetD("appenddirname", aof.DefaultDir))
+		if err != nil {
+			return err
+		}
+
+		if followed == own {
+			return fmt.Errorf("%w: follow-appenddirname cannot be the appenddirname of this server", config.ErrInvalidType)
+		}
+	}
+
+	return nil
+}
+
+// replicator makes the server a replica of a master, or promotes it as master (see Server)
+type replicator interface {
+	// follow makes the server a replica of the master at host:port. Returns false if it already is.
+	follow(host, port string) bool
+	promote()
+}
+
+// ReplicaOf makes the server a replica of another server, or promotes it as master. The replica synchronizes with
+// its master in the background, and then applies the commands the master writes, until it's promoted. It's
+// read-only by default (see replica-read-only). Once promoted, it keeps its dataset.
+//
+//	REPLICAOF host port | NO ONE
+//
+// More: https://redis.io/commands/replicaof/
+func (h *Handlers) ReplicaOf(c *client, r replicator) error {
+	if err := c.requiredArgs(2); err != nil {
+		return err
+	}
+
+	if strings.EqualFold(c.args[1], "NO") && strings.EqualFold(c.args[2], "ONE") {
+		r.promote()
+		return c.writeResponse(resp.NewSimpleString("OK"))
+	}
+
+	if _, err := strconv.Atoi(c.args[2]); err != nil {
+		return ErrValueNotInt
+	}
+
+	if !r.follow(c.args[1], c.args[2]) {
+		return c.writeResponse(resp.NewSimpleString("OK Already connected to specified master"))
+	}
+
+	return c.writeResponse(resp.NewSimpleString("OK"))
+}
+
+// SlaveOf is the old name of REPLICAOF
+//
+//	SLAVEOF host port | NO ONE
+//
+// More: https://redis.io/commands/slaveof/
+func (h *Handlers) SlaveOf(c *client, r replicator) error {
+	return h.ReplicaOf(c, r)
+}
+
+// checkReadOnly returns ErrReadOnly if c runs a write command on a read-only replica, unless c is the one
+// applying the stream of the master
+func (h *Handlers) checkReadOnly(c *client) error {
+	if c.master || c.replaying || !h.replication.isReadOnlyReplica() {
+		return nil
+	}
+
+	name := strings.ToUpper(c.command())
+	if name == Schedule && len(c.args) == 2 && strings.EqualFold(c.args[1], "LIST") {
+		return nil // The only subcommand of SCHEDULE that does not write
+	}
+
+	cmd, ok := getCommand(name)
+	if ok && cmd.Operation == "write" && !allowedOnReadOnlyReplica[name] {
+		return ErrReadOnly
+	}
+
+	return nil
+}
+
+// allowedOnReadOnlyReplica are the write commands that do not modify the dataset
+var allowedOnReadOnlyReplica = map[string]bool{Config: true}
+
+// isReplica returns true while the server is a replica. It's called for every command, so it does not lock.
+func (r *replication) isReplica() bool {
+	return r.replica.Load()
+}
+
+// isReadOnlyReplica returns true while the server is a replica that refuses the writes of the clients
+func (r *replication) isReadOnlyReplica() bool {
+	return r.replica.Load() && r.readOnly
+}
+
+// follow sets link as the link with the master. The replicas of this server are disconnected: chained
+// replication is not supported. Returns the previous link, if any.
+func (r *replication) follow(link *masterLink) *masterLink {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for len(r.replicas) > 0 {
+		r.removeReplicaLocked(r.replicas[0])
+	}
+
+	prev := r.master
+	r.master = link
+	r.replica.Store(true)
+	return prev
+}
+
+// promote makes the server a master, if it's a replica. It starts a new stream, so its replicas synchronize fully
+// with it. Returns the previous link with the master, if any.
+func (r *replication) promote() *masterLink {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	prev := r.master
+	if prev == nil {
+		return nil
+	}
+
+	r.master = nil
+	r.replica.Store(false)
+	r.id = newReplicationID()
+	r.masterID, r.masterOffset = "", -1
+	return prev
+}
+
+// currentMaster returns the link with the master, or nil if the server is not a replica
+func (r *replication) currentMaster() *masterLink {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.master
+}
+
+// setStatus sets the status of the link with the master
+func (r *replication) setStatus(link *masterLink, status string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	link.status = status
+}
+
+// synced records that the stream id of the master has been applied up to offset
+func (r *replication) synced(id string, offset int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.masterID, r.masterOffset = id, offset
+}
+
+// applied records that n more bytes of the stream of the master have been applied. aofOffset is the offset of
+// the last one written into the AOF of this server.
+func (r *replication) applied(n int64, aofOffset uint64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.masterOffset += n
+	r.masterAOFOffset = aofOffset
+}
+
+// appliedOffsets returns the offset applied from the stream of the master, and the offset where the last write
+// applied has been written into the AOF of this server
+func (r *replication) appliedOffsets() (int64, uint64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.masterOffset, r.masterAOFOffset
+}
+
+// requestAck makes the replica acknowledge its offset to the master right away (see REPLCONF GETACK)
+func (r *replication) requestAck() {
+	select {
+	case r.ackNow <- struct{}{}:
+	default: // Already requested
+	}
+}
+
+// cachedMaster returns the stream of the master, and the offset applied, to resynchronize partially with it
+func (r *replication) cachedMaster() (string, int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.masterID, r.masterOffset
+}
+
+// follow makes the server a replica of the master at host:port, replacing the previous master, if any. Returns
+// false if it's already its master.
+func (s *Server) follow(host, port string) bool {
+	s.followMux.Lock()
+	defer s.followMux.Unlock()
+
+	if prev := s.handlers.replication.currentMaster(); prev != nil && prev.host == host && prev.port == port {
+		return false
+	}
+
+	s.startLink(&masterLink{host: host, port: port}, s.replicate)
+	return true
+}
+
+// startLink sets link as the link with the master, replacing the previous one, and runs replicate in the
+// background until it's stopped. The caller must hold followMux.
+func (s *Server) startLink(link *masterLink, replicate func(context.Context, *masterLink)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	link.status, link.cancel, link.done = linkConnect, cancel, make(chan struct{})
+	s.handlers.replication.follow(link).stop()
+
+	s.logger.Printf("Replicating master %s", link)
+	go func() {
+		defer close(link.done)
+		replicate(ctx, link)
+	}()
+}
+
+// promote makes the server a master, stopping the replication if it's a replica
+func (s *Server) promote() {
+	s.followMux.Lock()
+	defer s.followMux.Unlock()
+
+	if prev := s.handlers.replication.promote(); prev != nil {
+		prev.stop()
+		s.logger.Printf("Promoted as master, stopped replicating %s", prev)
+	}
+}
+
+// stopReplication stops replicating the master, if any, and streaming to the replicas
+func (s *Server) stopReplication() {
+	s.followMux.Lock()
+	defer s.followMux.Unlock()
+
+	s.handlers.replication.currentMaster().stop()
+	s.handlers.replication.stop()
+}
+
+// stop stops the replication through l, and waits until it has stopped. l can be nil.
+func (l *masterLink) stop() {
+	if l == nil {
+		return
+	}
+
+	l.cancel()
+	<-l.done
+}
+
+// replicate to be called as goroutine. It synchronizes with the master of link and applies its stream, connecting
+// again whenever the link is lost. To stop it, close the context.
+func (s *Server) replicate(ctx context.Context, link *masterLink) {
+	for {
+		err := s.syncWithMaster(ctx, link)
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.logger.Printf("[ERROR] replicating master %s: %v", link, err)
+		s.handlers.replication.setStatus(link, linkConnect)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicaRetryPeriod):
+		}
+	}
+}
+
+// syncWithMaster connects to the master of link, synchronizes with it, and applies its stream until the
+// connection is lost, or the context is closed
+func (s *Server) syncWithMaster(ctx context.Context, link *masterLink) error {
+	dialer := &net.Dialer{Timeout: replicaTimeout}
+	conn, err := dialer.DialContext(ctx, serverNetwork, link.String())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close() // Unblocks reading the stream
+		case <-done:
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	send := func(args ...string) error {
+		if _, err := resp.NewArray(args).WriteTo(conn); err != nil {
+			return err
+		}
+		return readStatusReply(r)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(replicaTimeout)); err != nil {
+		return err
+	}
+
+	if s.options.masterAuth != "" {
+		if err := send("AUTH", s.options.masterAuth); err != nil {
+			return err
+		}
+	}
+
+	_, port, _ := net.SplitHostPort(s.addr)
+	if err := send("REPLCONF", "listening-port", port); err != nil {
+		return err
+	}
+
+	if err := s.psync(ctx, conn, r, link); err != nil {
+		return err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	s.handlers.replication.setStatus(link, linkConnected)
+	s.logger.Printf("Synchronized with master %s", link)
+
+	go s.ackMaster(conn, done)
+
+	return s.applyStream(r)
+}
+
+// psync asks the master for the stream from the offset applied, and loads the snapshot of its dataset if the
+// master cannot continue from there
+func (s *Server) psync(ctx context.Context, conn net.Conn, r *bufio.Reader, link *masterLink) error {
+	id, offset := s.handlers.replication.cachedMaster()
+	if id == "" {
+		id, offset = "?", -1
+	}
+
+	if _, err := resp.NewArray([]string{"PSYNC", id, strconv.FormatInt(offset, 10)}).WriteTo(conn); err != nil {
+		return err
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+
+	switch {
+	case len(fields) == 2 && fields[0] == "+CONTINUE":
+		s.handlers.replication.synced(fields[1], offset)
+		return nil
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid offset on %q: %w", line, err)
+		}
+
+		s.handlers.replication.setStatus(link, linkSync)
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			return err // The snapshot can take longer than replicaTimeout
+		}
+
+		snapshot, err := readSnapshot(r)
+		if err != nil {
+			return err
+		}
+
+		if err := s.loadSnapshot(ctx, snapshot); err != nil {
+			return err
+		}
+
+		s.handlers.replication.synced(fields[1], offset)
+		return nil
+	case strings.HasPrefix(line, "-"):
+		return targetError(strings.TrimRight(line[1:], "\r\n"))
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC: %q", line)
+	}
+}
+
+// readSnapshot reads the snapshot sent by the master after +FULLRESYNC: a bulk string without the final CRLF
+func readSnapshot(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "$") {
+		return nil, fmt.Errorf("unexpected snapshot header: %q", line)
+	}
+
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("unexpected snapshot header: %q", line)
+	}
+
+	snapshot := make([]byte, length)
+	if _, err := io.ReadFull(r, snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// loadSnapshot replaces the dataset by the snapshot received from the master: the keys, followed by the pending
+// schedules as commands. The databases are locked while the keys are replaced, so no client sees the dataset
+// half loaded. The AOF is rewritten afterwards, as it holds the old dataset.
+//
+// If it fails, the stream cannot be applied on top of the dataset: the next synchronization is a full one.
+func (s *Server) loadSnapshot(ctx context.Context, snapshot []byte) (err error) {
+	r, err := rdb.NewReader(bytes.NewReader(snapshot))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			s.handlers.replication.synced("", 0)
+		}
+	}()
+
+	s.schedules.mux.Lock()
+	unlock := s.locks.lockAll()
+	err = s.replaceDataset(r)
+	unlock()
+	s.schedules.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c := newClient(&masterConn{Reader: bytes.NewReader(snapshot[r.Offset():])}, s.options.dbs[0])
+	c.authenticated = true
+	c.replaying = true // The schedules are written into the AOF when it's rewritten
+	if err := s.handleRequest(ctx, c); err != nil {
+		return err
+	}
+
+	// Until the rewrite is committed, the AOF holds the old dataset: a restart would restore it
+	err = s.handlers.rewriteAOFNow(s.options.dbs, s.locks, s.schedules, s.options.aofUseRDBPreamble)
+	if err != nil && !errors.Is(err, aof.ErrRewriteNotSupported) {
+		return fmt.Errorf("unable to rewrite the AOF after synchronizing with the master: %w", err)
+	}
+
+	return nil
+}
+
+// replaceDataset empties the databases and the schedules, and stores the keys read from r. The caller must hold
+// the locks of the scheduler, and of all the databases.
+func (s *Server) replaceDataset(r *rdb.Reader) error {
+	if err := s.clearDataset(); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	for {
+		record, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if record.DB < 0 || record.DB >= len(s.options.dbs) {
+			return fmt.Errorf("%w: %d", ErrDBIndexOutOfRange, record.DB)
+		}
+
+		if record.ExpiresAt != 0 && record.ExpiresAt <= now {
+			continue
+		}
+
+		if err := restoreKey(s.options.dbs[record.DB], record); err != nil {
+			return err
+		}
+
+		if record.ExpiresAt != 0 {
+			s.expire.AddUpdate(record.DB, record.Key, record.ExpiresAt)
+		}
+	}
+}
+
+// clearDataset empties the databases and the schedules. The caller must hold the locks of the scheduler, and of
+// all the databases.
+func (s *Server) clearDataset() error {
+	for _, db := range s.options.dbs {
+		if err := db.FlushDB(); err != nil {
+			return err
+		}
+	}
+
+	for _, sch := range s.schedules.list() {
+		s.schedules.cancel(sch.id)
+	}
+
+	return nil
+}
+
+// applyStream runs the commands of the stream of the master, as they arrive. They are written into the AOF of
+// this server, as the ones of any client.
+//
+// If a command fails, the dataset has diverged from the one of the master: the link is dropped without counting
+// the command as applied, and the next synchronization is a full one.
+func (s *Server) applyStream(r io.Reader) error {
+	conn := &masterConn{Reader: r}
+	c := newClient(conn, s.options.dbs[0])
+	c.authenticated = true
+	c.master = true
+
+	for {
+		if err := c.readCommand(); err != nil {
+			return err
+		}
+
+		if err := s.processMasterCommand(c); err != nil {
+			return err
+		}
+
+		if err := conn.failure(); err != nil {
+			s.handlers.replication.synced("", 0)
+			return fmt.Errorf("unable to apply %q from the master: %w", c.command(), err)
+		}
+
+		// The stream is written by resp.Array, so its length is the one of the command written again
+		n, _ := resp.NewArray(c.args).WriteTo(io.Discard)
+		s.handlers.replication.applied(n, c.aofOffset)
+	}
+}
+
+// processMasterCommand runs a command of the master, or of the AOF followed by a log-shipping replica. The keys
+// whose timeout has passed are still visible to it (see Handlers.expired).
+func (s *Server) processMasterCommand(c *client) error {
+	s.handlers.replication.keepExpired.Add(1)
+	defer s.handlers.replication.keepExpired.Add(-1)
+
+	return s.processCommand(c)
+}
+
+// ackMaster to be called as goroutine. It acknowledges to the master the offset applied, and the offset synced
+// into the AOF (FACK), right away, every replicaAckPeriod, and whenever the master asks for it, until done is
+// closed.
+func (s *Server) ackMaster(conn net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(replicaAckPeriod)
+	defer ticker.Stop()
+
+	for {
+		offset, aofOffset := s.handlers.replication.appliedOffsets()
+		args := []string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}
+
+		// Until a rewrite is committed, the dataset loaded from the master might not be in the AOF
+		if synced, err := s.handlers.syncAOF(aofOffset); synced && err == nil && !s.handlers.rewritingAOF() {
+			args = append(args, "FACK", strconv.FormatInt(offset, 10))
+		}
+
+		if _, err := resp.NewArray(args).WriteTo(conn); err != nil {
+			return
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-s.handlers.replication.ackNow:
+		}
+	}
+}
+
+// masterConn is the connection of the clients that apply what the master sends. Their replies are discarded, but
+// the first error replied is kept (see failure).
+type masterConn struct {
+	io.Reader
+	failed error
+}
+
+func (m *masterConn) Write(p []byte) (int, error) {
+	// MISCONF is replied once the write is done in memory, when it cannot be written into the AOF: it's applied
+	if m.failed == nil && bytes.HasPrefix(p, []byte("-")) && !bytes.HasPrefix(p, []byte("-MISCONF")) {
+		m.failed = errors.New(strings.TrimRight(string(p[1:]), "\r\n"))
+	}
+
+	return len(p), nil
+}
+
+// failure returns the error replied to the commands run since the last call, if any: they have not been applied
+func (m *masterConn) failure() error {
+	err := m.failed
+	m.failed = nil
+	return err
+}
+
+func (*masterConn) Close() error {
+	return nil
+}
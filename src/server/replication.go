@@ -0,0 +1,515 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"ddia/src/resp"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	syncatomic "sync/atomic"
+	"time"
+)
+
+// defaultBacklogSize is the size of the replication backlog, as in Redis (see repl-backlog-size)
+const defaultBacklogSize = 1 << 20 // 1mb
+
+// The master writes into a stream the same commands it writes into the AOF (see propagate), and sends it to its
+// replicas, which apply it. The stream is identified by a replication ID, and the position on it is its offset.
+// The last bytes of the stream are kept in the backlog, so a replica that reconnects asks for the stream from
+// the offset it has applied, and only receives what it has missed: a partial resynchronization. If they are not
+// in the backlog anymore, or the replica has never synchronized with this master, it receives a snapshot of the
+// dataset first: a full resynchronization.
+
+// errReplicationStopped is returned to the replicas being streamed when the server stops
+var errReplicationStopped = errors.New("replication stopped")
+
+// errReplicaDisconnected is returned when the replica being streamed has closed the connection
+var errReplicaDisconnected = errors.New("replica disconnected")
+
+// errBacklogOverrun is returned when a replica is so far behind that the stream from its offset is not in the
+// backlog anymore. It's disconnected, and resynchronizes fully when it connects again.
+var errBacklogOverrun = errors.New("the stream from the offset of the replica is not in the backlog anymore")
+
+// replication is the state of the replication of a server, both as master, and as replica
+type replication struct {
+	mux sync.Mutex
+	// cond is signaled when the stream grows, a replica disconnects, or the replication stops
+	cond *sync.Cond
+
+	// id identifies the stream of this server, and offset is the number of bytes written into it
+	id     string
+	offset int64
+	// backlog keeps the last histlen bytes of the stream, as a ring buffer. It's allocated when the first replica
+	// connects: until then, nothing is written into the stream (see streaming).
+	backlog     []byte
+	backlogSize int64
+	histlen     int64
+	streaming   syncatomic.Bool
+
+	// replicas are the replicas being streamed
+	replicas []*replicaLink
+	stopped  bool
+
+	// master is the link with the master, while this server is a replica. replica tells if it's set, without
+	// locking.
+	master  *masterLink
+	replica syncatomic.Bool
+	// masterID and masterOffset are the stream of the master, and the offset applied from it. They are used to
+	// resynchronize partially with it. masterID is empty if this server has not synchronized with any master.
+	masterID     string
+	masterOffset int64
+	// masterAOFOffset is the offset in the AOF of this server of the last write applied from the master
+	masterAOFOffset uint64
+	// ackNow asks the replica to acknowledge its offset to the master right away (see REPLCONF GETACK)
+	ackNow chan struct{}
+	// keepExpired is positive while the keys whose timeout has passed are still visible on a replica: while the
+	// commands of the master are applied, or the dataset is copied to rewrite the AOF (see Handlers.expired)
+	keepExpired syncatomic.Int32
+	// readOnly refuses the write commands of the clients while this server is a replica (see replica-read-only).
+	// It's not modified once the server has started.
+	readOnly bool
+
+	// syncFull, syncPartialOK and syncPartialErr are the number of resynchronizations served, as master
+	syncFull, syncPartialOK, syncPartialErr int64
+}
+
+// replicaLink is a replica connected to this server, as seen by the master
+type replicaLink struct {
+	ip   string
+	port string
+	// ack is the offset the replica has acknowledged, at ackAt, and fack the one it has synced into its AOF, or
+	// -1 if its AOF is disabled (see REPLCONF ACK)
+	ack    int64
+	fack   int64
+	ackAt  time.Time
+	closed bool
+}
+
+func (l *replicaLink) String() string {
+	return net.JoinHostPort(l.ip, l.port)
+}
+
+func newReplication(backlogSize int64) *replication {
+	r := &replication{
+		id:           newReplicationID(),
+		backlogSize:  backlogSize,
+		readOnly:     true,
+		masterOffset: -1,
+		ackNow:       make(chan struct{}, 1),
+	}
+	r.cond = sync.NewCond(&r.mux)
+	return r
+}
+
+// newReplicationID returns a random ID of 40 characters, as in Redis
+func newReplicationID() string {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Errorf("unable to generate a replication ID: %w", err)) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(id)
+}
+
+// configure sets the size of the backlog (see repl-backlog-size), and if the replica is read-only (see
+// replica-read-only). It must be called before any replica connects.
+func (r *replication) configure(backlogSize int64, readOnly bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.backlogSize, r.readOnly = backlogSize, readOnly
+}
+
+// feed writes p into the stream, if any replica has ever connected
+func (r *replication) feed(p []byte) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.backlog == nil {
+		return
+	}
+
+	size := int64(len(r.backlog))
+	r.histlen += int64(len(p))
+	if r.histlen > size {
+		r.histlen = size
+	}
+
+	for len(p) > 0 {
+		n := copy(r.backlog[r.offset%size:], p)
+		p = p[n:]
+		r.offset += int64(n)
+	}
+
+	r.cond.Broadcast()
+}
+
+// startFullSync returns the stream, and its offset, a replica synchronizing with a snapshot of the dataset
+// receives from then on. The caller must hold the locks of all the databases while taking the snapshot, so no
+// command is missing in the snapshot and the stream, or is in both.
+func (r *replication) startFullSync() (id string, offset int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.backlog == nil {
+		r.backlog = make([]byte, r.backlogSize)
+		r.streaming.Store(true)
+	}
+	r.syncFull++
+
+	return r.id, r.offset
+}
+
+// continueFrom returns true if the stream id, from offset, is still in the backlog: the replica that asks for it
+// can resynchronize partially
+func (r *replication) continueFrom(id string, offset int64) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if id == "?" {
+		return false // The replica has never synchronized
+	}
+
+	if r.backlog == nil || id != r.id || offset < r.offset-r.histlen || offset > r.offset {
+		r.syncPartialErr++
+		return false
+	}
+
+	r.syncPartialOK++
+	return true
+}
+
+// addReplica registers a replica being streamed from offset
+func (r *replication) addReplica(ip, port string, offset int64) *replicaLink {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	link := &replicaLink{ip: ip, port: port, ack: offset, fack: -1, ackAt: time.Now()}
+	r.replicas = append(r.replicas, link)
+	return link
+}
+
+// removeReplica unregisters link, which stops being streamed. It can be called more than once.
+func (r *replication) removeReplica(link *replicaLink) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.removeReplicaLocked(link)
+}
+
+func (r *replication) removeReplicaLocked(link *replicaLink) {
+	link.closed = true
+	for i, l := range r.replicas {
+		if l == link {
+			r.replicas = append(r.replicas[:i], r.replicas[i+1:]...)
+			break
+		}
+	}
+	r.cond.Broadcast()
+}
+
+// next blocks until the stream grows past offset, and returns the bytes written from offset on
+func (r *replication) next(link *replicaLink, offset int64) ([]byte, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for r.offset == offset && !r.stopped && !link.closed {
+		r.cond.Wait()
+	}
+
+	if r.stopped {
+		return nil, errReplicationStopped
+	} else if link.closed {
+		return nil, errReplicaDisconnected
+	} else if offset < r.offset-r.histlen {
+		return nil, errBacklogOverrun
+	}
+
+	size := int64(len(r.backlog))
+	data := make([]byte, 0, r.offset-offset)
+	for offset < r.offset {
+		start := offset % size
+		end := start + r.offset - offset
+		if end > size {
+			end = size // The rest is at the beginning of the ring
+		}
+		data = append(data, r.backlog[start:end]...)
+		offset += end - start
+	}
+
+	return data, nil
+}
+
+// ack records the offsets acknowledged by the replica of link: the one applied, and the one synced into its AOF
+func (r *replication) ack(link *replicaLink, offset, fsynced int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	link.ack, link.fack, link.ackAt = offset, fsynced, time.Now()
+	r.cond.Broadcast()
+}
+
+// streamOffset returns the offset of the stream
+func (r *replication) streamOffset() int64 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.offset
+}
+
+// stop stops streaming to the replicas
+func (r *replication) stop() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.stopped = true
+	r.cond.Broadcast()
+}
+
+// PSync is sent by a replica to synchronize with this server. The replica asks for the stream id from offset: if
+// it's still in the backlog, the reply is +CONTINUE id, followed by the stream. Otherwise, the reply is
+// +FULLRESYNC id offset, followed by a snapshot of the dataset as a bulk string without the final CRLF, and the
+// stream from offset. The snapshot holds the keys, followed by the pending schedules (see SCHEDULE) as commands.
+//
+//	PSYNC id|? offset
+//
+// The connection is taken over by the stream, until the replica disconnects. Meanwhile, the replica acknowledges
+// the offset it has applied with REPLCONF ACK offset. Unlike Redis, the offsets are the ones of the next byte
+// to be sent.
+//
+// More: https://redis.io/commands/psync/
+func (h *Handlers) PSync(c *client, dbs []Storage, locks *dbLocks, sched *scheduler) error {
+	if err := c.requiredArgs(2); err != nil {
+		return err
+	}
+
+	offset, err := strconv.ParseInt(c.args[2], 10, 64)
+	if err != nil {
+		return ErrValueNotInt
+	}
+
+	if h.replication.isReplica() {
+		return c.writeResponse(resp.NewError("ERR chained replication is not supported: this server is a replica"))
+	}
+
+	id := c.args[1]
+	if h.replication.continueFrom(id, offset) {
+		if err := c.writeResponse(resp.NewSimpleString("CONTINUE " + id)); err != nil {
+			return err
+		}
+	} else {
+		var snapshot []byte
+		if id, offset, snapshot, err = h.fullSync(dbs, locks, sched); err != nil {
+			return err
+		}
+
+		buf := &bytes.Buffer{}
+		fmt.Fprintf(buf, "+FULLRESYNC %s %d\r\n$%d\r\n", id, offset, len(snapshot))
+		buf.Write(snapshot)
+		if _, err := c.conn.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("unable to writeResponse to the client: %w", err)
+		}
+	}
+
+	return h.streamToReplica(c, offset)
+}
+
+// fullSync takes a snapshot of the dataset, and the pending schedules, and returns the stream that follows it
+func (h *Handlers) fullSync(dbs []Storage, locks *dbLocks, sched *scheduler) (string, int64, []byte, error) {
+	sched.mux.Lock()
+	unlock := locks.lockAll()
+	records := h.snapshot(dbs)
+	schedules := sched.list()
+	id, offset := h.replication.startFullSync()
+	unlock()
+	sched.mux.Unlock()
+
+	buf := &bytes.Buffer{}
+	if err := writePreamble(buf, records); err != nil {
+		return "", 0, nil, err
+	}
+	if err := writeSchedules(buf, schedules); err != nil {
+		return "", 0, nil, err
+	}
+
+	return id, offset, buf.Bytes(), nil
+}
+
+// streamToReplica sends the stream from offset to the replica c, until it disconnects. The acknowledgements of the
+// replica are read meanwhile. It always returns an error: the connection cannot be used anymore.
+func (h *Handlers) streamToReplica(c *client, offset int64) error {
+	ip := ""
+	if conn, ok := c.conn.(net.Conn); ok {
+		ip, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+
+	link := h.replication.addReplica(ip, c.listeningPort, offset)
+	defer h.replication.removeReplica(link)
+	h.logger.Printf("Replica %s synchronized, streaming from offset %d", link, offset)
+
+	// The connection is closed when returning, which stops this goroutine
+	go h.readAcks(c, link)
+
+	for {
+		data, err := h.replication.next(link, offset)
+		if err != nil {
+			return fmt.Errorf("replica %s: %w", link, err)
+		}
+
+		if _, err := c.conn.Write(data); err != nil {
+			return fmt.Errorf("replica %s: %w", link, err)
+		}
+		offset += int64(len(data))
+	}
+}
+
+// readAcks reads the acknowledgements sent by the replica of link, until it disconnects
+func (h *Handlers) readAcks(c *client, link *replicaLink) {
+	defer h.replication.removeReplica(link)
+
+	for {
+		if err := c.readCommand(); err != nil {
+			return
+		}
+
+		// REPLCONF ACK offset [FACK offset]
+		if len(c.args) < 3 || !strings.EqualFold(c.args[0], ReplConf) || !strings.EqualFold(c.args[1], "ACK") {
+			continue
+		}
+
+		offset, err := strconv.ParseInt(c.args[2], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		fsynced := int64(-1)
+		if len(c.args) == 5 && strings.EqualFold(c.args[3], "FACK") {
+			if fsynced, err = strconv.ParseInt(c.args[4], 10, 64); err != nil {
+				fsynced = -1
+			}
+		}
+
+		h.replication.ack(link, offset, fsynced)
+	}
+}
+
+// ReplConf configures the connection of a replica, before it sends PSYNC. Only listening-port, the port where the
+// replica is listening, is used. ACK is only read while streaming (see PSYNC), and ignored otherwise. GETACK is
+// sent by the master through the stream, to ask the replica for an ACK right away (see WAIT).
+//
+//	REPLCONF option value [option value ...]
+//
+// More: https://redis.io/commands/replconf/
+func (h *Handlers) ReplConf(c *client) error {
+	if len(c.args) < 3 || len(c.args)%2 == 0 {
+		return ErrWrongNumberArguments
+	}
+
+	for i := 1; i < len(c.args); i += 2 {
+		switch strings.ToLower(c.args[i]) {
+		case "listening-port":
+			c.listeningPort = c.args[i+1]
+		case "ack":
+			return nil // Never replied
+		case "getack":
+			if c.master {
+				h.replication.requestAck()
+			}
+			return nil // Never replied
+		case "capa":
+		default:
+			return c.writeResponse(resp.NewError("ERR Unrecognized REPLCONF option: " + c.args[i]))
+		}
+	}
+
+	return c.writeResponse(resp.NewSimpleString("OK"))
+}
+
+// Role returns the role of the server. Unlike Redis, the reply is a flat array of strings. For a master:
+// "master", its offset, and the address and the offset acknowledged of each replica. For a replica: "slave", the
+// address of its master, the state of the link (connect, sync or connected), and the offset applied. A
+// log-shipping replica (see follow-appenddirname) replies the directory of the AOF it follows, and an empty port.
+//
+//	ROLE
+//
+// More: https://redis.io/commands/role/
+func (h *Handlers) Role(c *client) error {
+	if err := c.requiredArgs(0); err != nil {
+		return err
+	}
+
+	return c.writeResponse(resp.NewArray(h.replication.role()))
+}
+
+func (r *replication) role() []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.master != nil && r.master.dir != "" {
+		return []string{"slave", r.master.dir, "", r.master.status, strconv.FormatInt(r.masterOffset, 10)}
+	} else if r.master != nil {
+		return []string{"slave", r.master.host, r.master.port, r.master.status, strconv.FormatInt(r.masterOffset, 10)}
+	}
+
+	role := []string{"master", strconv.FormatInt(r.offset, 10)}
+	for _, link := range r.replicas {
+		role = append(role, link.ip, link.port, strconv.FormatInt(link.ack, 10))
+	}
+	return role
+}
+
+// info writes the "replication" section of INFO
+func (r *replication) info(w io.Writer) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	fmt.Fprintf(w, "# Replication\r\n")
+	id, offset := r.id, r.offset
+	if r.master != nil {
+		fmt.Fprintf(w, "role:slave\r\n")
+		if r.master.dir != "" {
+			fmt.Fprintf(w, "master_aof_dir:%s\r\n", r.master.dir)
+		} else {
+			fmt.Fprintf(w, "master_host:%s\r\n", r.master.host)
+			fmt.Fprintf(w, "master_port:%s\r\n", r.master.port)
+		}
+		status := "down"
+		if r.master.status == linkConnected {
+			status = "up"
+		}
+		fmt.Fprintf(w, "master_link_status:%s\r\n", status)
+		fmt.Fprintf(w, "master_sync_in_progress:%d\r\n", boolToInt(r.master.status == linkSync))
+		fmt.Fprintf(w, "slave_repl_offset:%d\r\n", r.masterOffset)
+		fmt.Fprintf(w, "slave_read_only:%d\r\n", boolToInt(r.readOnly))
+		id, offset = r.masterID, r.masterOffset
+	} else {
+		fmt.Fprintf(w, "role:master\r\n")
+	}
+
+	fmt.Fprintf(w, "connected_slaves:%d\r\n", len(r.replicas))
+	for i, link := range r.replicas {
+		lag := int64(time.Since(link.ackAt) / time.Second)
+		fmt.Fprintf(w, "slave%d:ip=%s,port=%s,state=online,offset=%d,lag=%d\r\n", i, link.ip, link.port, link.ack, lag)
+	}
+	fmt.Fprintf(w, "master_replid:%s\r\n", id)
+	fmt.Fprintf(w, "master_repl_offset:%d\r\n", offset)
+	fmt.Fprintf(w, "repl_backlog_active:%d\r\n", boolToInt(r.backlog != nil))
+	fmt.Fprintf(w, "repl_backlog_size:%d\r\n", r.backlogSize)
+	fmt.Fprintf(w, "repl_backlog_first_byte_offset:%d\r\n", r.offset-r.histlen)
+	fmt.Fprintf(w, "repl_backlog_histlen:%d\r\n", r.histlen)
+}
+
+// stats writes the resynchronizations served into the "stats" section of INFO
+func (r *replication) stats(w io.Writer) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	fmt.Fprintf(w, "sync_full:%d\r\n", r.syncFull)
+	fmt.Fprintf(w, "sync_partial_ok:%d\r\n", r.syncPartialOK)
+	fmt.Fprintf(w, "sync_partial_err:%d\r\n", r.syncPartialErr)
+}
@@ -0,0 +1,571 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"ddia/src/resp"
+	"ddia/src/server"
+	"ddia/src/storage/aof"
+	"ddia/testing/log"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	connect := func(t *testing.T, conn net.Conn) func(string) string {
+		return func(args string) string {
+			return parse(t, req(t, conn, strings.Split(args, " ")))
+		}
+	}
+
+	master := testServer(t)
+	masterReq := connect(t, testConn(t, master))
+	replica := testServer(t)
+	replicaReq := connect(t, testConn(t, replica))
+
+	waitFor := func(args, want string) {
+		t.Helper()
+		for start := time.Now(); replicaReq(args) != want; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("the replica has not replied %q to %q: %q", want, args, replicaReq(args))
+			}
+		}
+	}
+
+	// Written before the replica connects: received with the snapshot
+	masterReq("set before value")
+	masterReq("rpush list a b c")
+	masterReq("select 3")
+	masterReq("set volatile value")
+	masterReq("expire volatile 1000")
+	masterReq("schedule in 100000 set scheduled value")
+
+	host, port, _ := net.SplitHostPort(master.Addr())
+	if rsp, want := replicaReq("replicaof "+host+" "+port), "OK"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := replicaReq("replicaof "+host+" "+port), "OK Already connected to specified master"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	waitFor("get before", "value")
+	if rsp, want := replicaReq("lrange list 0 -1"), "a b c"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	replicaReq("select 3")
+	if rsp := replicaReq("ttl volatile"); rsp == "-1" || rsp == "-2" {
+		t.Fatalf("the timeout of the key has not been replicated: %q", rsp)
+	}
+
+	if rsp, want := replicaReq("schedule list"), "1"; !strings.HasPrefix(rsp, want+" ") {
+		t.Fatalf("the schedule has not been replicated: %q", rsp)
+	}
+
+	// Written after the replica has synchronized: received with the stream
+	masterReq("incr counter")
+	masterReq("incr counter")
+	masterReq("del volatile")
+	waitFor("get counter", "2")
+	waitFor("exists volatile", "0")
+
+	// FLUSHALL is replicated, for all the databases
+	masterReq("flushall")
+	waitFor("exists counter", "0")
+	replicaReq("select 0")
+	waitFor("exists before", "0")
+	replicaReq("select 3")
+	masterReq("set counter 2")
+	waitFor("get counter", "2")
+
+	if rsp, want := replicaReq("set key value"), "READONLY You can't write against a read only replica."; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := replicaReq("role"), "slave "+host+" "+port+" connected"; !strings.HasPrefix(rsp, want) {
+		t.Fatalf("invalid response: %q want prefix %q", rsp, want)
+	}
+
+	if rsp, want := masterReq("info replication"), "connected_slaves:1"; !strings.Contains(rsp, want) {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := replicaReq("info replication"), "master_link_status:up"; !strings.Contains(rsp, want) {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	// The replica acknowledges the offset it has applied
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		role := strings.Fields(masterReq("role"))
+		if len(role) == 5 && role[1] == role[4] {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatalf("the replica has not acknowledged the offset of the master: %q", role)
+		}
+	}
+
+	// Once promoted, it keeps the dataset, and accepts writes
+	if rsp, want := replicaReq("replicaof no one"), "OK"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := replicaReq("incr counter"), "3"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := replicaReq("role"), "master"; !strings.HasPrefix(rsp, want) {
+		t.Fatalf("invalid response: %q want prefix %q", rsp, want)
+	}
+
+	masterReq("incr counter")
+	time.Sleep(50 * time.Millisecond)
+	if rsp, want := replicaReq("get counter"), "3"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+// The stream of the master is applied while the AOF of the replica is failing: it's not refused with MISCONF
+func TestReplication_PersistenceFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	master := testServer(t)
+	masterConn := testConn(t, master)
+	masterReq := func(args string) string {
+		return parse(t, req(t, masterConn, strings.Split(args, " ")))
+	}
+
+	disk := &failingDisk{}
+	handlers := server.NewHandlers(log.ServerLogger(), aof.NewAppendOnlyFile(ctx, disk, aof.AlwaysSync))
+	replica, err := server.New(handlers, serverOptions()...)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	if err := replica.Start(ctx); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = replica.Stop() })
+	replicaConn := testConn(t, replica)
+	replicaReq := func(args string) string {
+		return parse(t, req(t, replicaConn, strings.Split(args, " ")))
+	}
+
+	waitFor := func(args, want string) {
+		t.Helper()
+		for start := time.Now(); replicaReq(args) != want; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("the replica has not replied %q to %q: %q", want, args, replicaReq(args))
+			}
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(master.Addr())
+	replicaReq("replicaof " + host + " " + port)
+	masterReq("set key value")
+	waitFor("get key", "value")
+
+	disk.setFail(true)
+	for i := 1; i <= 3; i++ {
+		masterReq("incr counter")
+	}
+	waitFor("get counter", "3")
+
+	if rsp, want := replicaReq("info replication"), "master_link_status:up"; !strings.Contains(rsp, want) {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+// A command of the stream that fails on the replica drops the link, and the replica synchronizes fully again
+func TestReplication_Diverged(t *testing.T) {
+	master := testServer(t)
+	masterConn := testConn(t, master)
+	masterReq := func(args string) string {
+		return parse(t, req(t, masterConn, strings.Split(args, " ")))
+	}
+
+	replica, _, err := startServerWithAOF(t, t.TempDir(), "replica-read-only no\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	replicaConn := testConn(t, replica)
+	replicaReq := func(args string) string {
+		return parse(t, req(t, replicaConn, strings.Split(args, " ")))
+	}
+
+	waitFor := func(args, want string) {
+		t.Helper()
+		for start := time.Now(); replicaReq(args) != want; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("the replica has not replied %q to %q: %q", want, args, replicaReq(args))
+			}
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(master.Addr())
+	replicaReq("replicaof " + host + " " + port)
+	masterReq("set key value")
+	waitFor("get key", "value")
+
+	// The replica writes a list where the master has nothing: INCR fails on the replica
+	replicaReq("rpush counter a")
+	masterReq("incr counter")
+	waitFor("get counter", "1")
+}
+
+func TestReplication_PSync(t *testing.T) {
+	s, _, err := startServerWithAOF(t, t.TempDir(), "repl-backlog-size 256\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	conn := testConn(t, s)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	// psync connects as a replica, and returns the first line of the reply
+	psync := func(id, offset string) (net.Conn, *bufio.Reader, []string) {
+		replica := testConn(t, s)
+		r := bufio.NewReader(replica)
+		if _, err := resp.NewArray([]string{"PSYNC", id, offset}).WriteTo(replica); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		return replica, r, strings.Fields(strings.TrimSpace(line))
+	}
+
+	req("set key value")
+
+	replica, r, reply := psync("?", "-1")
+	if len(reply) != 3 || reply[0] != "+FULLRESYNC" {
+		t.Fatalf("invalid response: %q", reply)
+	}
+	id, offset := reply[1], reply[2]
+
+	// The snapshot has the keys written before
+	header, _ := r.ReadString('\n')
+	length, _ := strconv.Atoi(strings.TrimSpace(header)[1:])
+	if _, err := io.ReadFull(r, make([]byte, length)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	req("set key other")
+	want := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nother\r\n"
+	stream := make([]byte, len(want))
+	if _, err := io.ReadFull(r, stream); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	} else if string(stream) != want {
+		t.Fatalf("invalid stream: %q want %q", stream, want)
+	}
+	_ = replica.Close()
+
+	// Reconnecting from the offset applied, only the commands missed are received
+	req("del key")
+	from, _ := strconv.Atoi(offset)
+	_, r, reply = psync(id, strconv.Itoa(from+len(want)))
+	if len(reply) != 2 || reply[0] != "+CONTINUE" || reply[1] != id {
+		t.Fatalf("invalid response: %q", reply)
+	}
+
+	want = "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*2\r\n$3\r\ndel\r\n$3\r\nkey\r\n"
+	stream = make([]byte, len(want))
+	if _, err := io.ReadFull(r, stream); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	} else if string(stream) != want {
+		t.Fatalf("invalid stream: %q want %q", stream, want)
+	}
+
+	// Another stream, or an offset that is not in the backlog anymore, needs a full resynchronization
+	if _, _, reply := psync("unknown", offset); reply[0] != "+FULLRESYNC" {
+		t.Fatalf("invalid response: %q", reply)
+	}
+
+	req("set key " + strings.Repeat("x", 256))
+	if _, _, reply := psync(id, offset); reply[0] != "+FULLRESYNC" {
+		t.Fatalf("invalid response: %q", reply)
+	}
+
+	info := req("info stats")
+	for _, want := range []string{"sync_full:3", "sync_partial_ok:1", "sync_partial_err:2"} {
+		if !strings.Contains(info, want) {
+			t.Fatalf("invalid response: %q want %q", info, want)
+		}
+	}
+}
+
+func TestHandler_Wait(t *testing.T) {
+	master := testServer(t)
+	masterConn := testConn(t, master)
+	masterReq := func(args string) string {
+		return parse(t, req(t, masterConn, strings.Split(args, " ")))
+	}
+	replica := testServer(t)
+	replicaConn := testConn(t, replica)
+	replicaReq := func(args string) string {
+		return parse(t, req(t, replicaConn, strings.Split(args, " ")))
+	}
+
+	host, port, _ := net.SplitHostPort(master.Addr())
+	replicaReq("replicaof " + host + " " + port)
+	for start := time.Now(); len(strings.Fields(masterReq("role"))) != 5; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the replica has not connected")
+		}
+	}
+
+	masterReq("set key value")
+
+	// The replica is asked to acknowledge right away: no need to wait for its periodic acknowledgement
+	start := time.Now()
+	if rsp, want := masterReq("wait 1 5000"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	} else if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("WAIT has taken too long: %s", elapsed)
+	}
+
+	if rsp, want := masterReq("wait 2 100"), "1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := masterReq("wait 1 -1"), "ERR timeout is negative"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := replicaReq("wait 1 100"), "ERR WAIT cannot be used with replica instances"; !strings.HasPrefix(rsp, want) {
+		t.Fatalf("invalid response: %q want prefix %q", rsp, want)
+	}
+
+	// Neither of them has an AOF
+	want := "ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled."
+	if rsp := masterReq("waitaof 1 0 100"); rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := masterReq("waitaof 0 1 100"), "0 0"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestHandler_WaitAOF(t *testing.T) {
+	master, _, err := startServerWithAOF(t, t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	conn := testConn(t, master)
+	req := func(args string) string {
+		return parse(t, req(t, conn, strings.Split(args, " ")))
+	}
+
+	host, port, _ := net.SplitHostPort(master.Addr())
+	if _, _, err := startServerWithAOF(t, t.TempDir(), "replicaof "+host+" "+port+"\n"); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	for start := time.Now(); len(strings.Fields(req("role"))) != 5; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the replica has not connected")
+		}
+	}
+
+	req("set key value")
+	if rsp, want := req("waitaof 1 1 5000"), "1 1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := req("waitaof 1 2 100"), "1 1"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+func TestReplication_FollowAOF(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+	primary, _, err := startServerWithAOF(t, dir, "")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	primaryConn := testConn(t, primary)
+	primaryReq := func(args string) string {
+		return parse(t, req(t, primaryConn, strings.Split(args, " ")))
+	}
+
+	// Written before the standby starts: loaded from the files of the AOF
+	primaryReq("set before value")
+	primaryReq("rpush list a b c")
+
+	standby, _, err := startServerWithAOF(t, t.TempDir(), "follow-appenddirname "+dir+"\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	standbyConn := testConn(t, standby)
+	standbyReq := func(args string) string {
+		return parse(t, req(t, standbyConn, strings.Split(args, " ")))
+	}
+
+	waitFor := func(args, want string) {
+		t.Helper()
+		for start := time.Now(); standbyReq(args) != want; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("the standby has not replied %q to %q: %q", want, args, standbyReq(args))
+			}
+		}
+	}
+
+	waitFor("get before", "value")
+	if rsp, want := standbyReq("lrange list 0 -1"), "a b c"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	// Written once it's following the AOF, before and after the primary opens a new incremental file
+	primaryReq("incr counter")
+	waitFor("get counter", "1")
+
+	if rsp, want := primaryReq("bgrewriteaof"), "Background append only file rewriting started"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+	primaryReq("incr counter")
+	primaryReq("del before")
+	waitFor("get counter", "2")
+	waitFor("exists before", "0")
+
+	// FLUSHALL is applied by the standby
+	primaryReq("flushall")
+	waitFor("exists list", "0")
+	primaryReq("set counter 2")
+	waitFor("get counter", "2")
+
+	if rsp, want := standbyReq("set key value"), "READONLY You can't write against a read only replica."; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := standbyReq("role"), "slave "+dir+"  connected"; !strings.HasPrefix(rsp, want) {
+		t.Fatalf("invalid response: %q want prefix %q", rsp, want)
+	}
+
+	if rsp, want := standbyReq("info replication"), "master_aof_dir:"+dir; !strings.Contains(rsp, want) {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	// Once promoted, it keeps the dataset, accepts writes, and stops following the AOF
+	if rsp, want := standbyReq("replicaof no one"), "OK"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	if rsp, want := standbyReq("incr counter"), "3"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+
+	primaryReq("incr counter")
+	time.Sleep(200 * time.Millisecond)
+	if rsp, want := standbyReq("get counter"), "3"; rsp != want {
+		t.Fatalf("invalid response: %q want %q", rsp, want)
+	}
+}
+
+// A command of the AOF followed that fails on the standby makes it load the whole AOF again
+func TestReplication_FollowAOF_Diverged(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+	primary, _, err := startServerWithAOF(t, dir, "")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	primaryConn := testConn(t, primary)
+	primaryReq := func(args string) string {
+		return parse(t, req(t, primaryConn, strings.Split(args, " ")))
+	}
+
+	standby, _, err := startServerWithAOF(t, t.TempDir(), "follow-appenddirname "+dir+"\nreplica-read-only no\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	standbyConn := testConn(t, standby)
+	standbyReq := func(args string) string {
+		return parse(t, req(t, standbyConn, strings.Split(args, " ")))
+	}
+
+	waitFor := func(args, want string) {
+		t.Helper()
+		for start := time.Now(); standbyReq(args) != want; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("the standby has not replied %q to %q: %q", want, args, standbyReq(args))
+			}
+		}
+	}
+
+	primaryReq("set key value")
+	waitFor("get key", "value")
+
+	// The standby writes a list where the primary has nothing: INCR fails on the standby
+	standbyReq("rpush counter a")
+	primaryReq("incr counter")
+	waitFor("get counter", "1")
+}
+
+// A replica does not delete the keys whose timeout has passed: it hides them until the master sends the DEL, and
+// the commands of the master still see them
+func TestReplication_ExpiredKeys(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+	primary, err := aof.Open(context.Background(), dir, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = primary.Close() })
+
+	write := func(args string) {
+		if _, err := resp.NewArray(strings.Split(args, " ")).WriteTo(primary); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+
+	expiresAt := strconv.FormatInt(time.Now().Add(200*time.Millisecond).UnixMilli(), 10)
+	write("SELECT 0")
+	write("SET deleted value")
+	write("PEXPIREAT deleted " + expiresAt)
+	write("SET persisted value")
+	write("PEXPIREAT persisted " + expiresAt)
+
+	standbyAOF := t.TempDir()
+	standby, _, err := startServerWithAOF(t, standbyAOF, "follow-appenddirname "+dir+"\n")
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	standbyConn := testConn(t, standby)
+	standbyReq := func(args string) string {
+		return parse(t, req(t, standbyConn, strings.Split(args, " ")))
+	}
+
+	waitFor := func(args, want string) {
+		t.Helper()
+		for start := time.Now(); standbyReq(args) != want; time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("the standby has not replied %q to %q: %q", want, args, standbyReq(args))
+			}
+		}
+	}
+
+	// The timeouts pass before the primary has expired the keys
+	waitFor("exists deleted", "0")
+	waitFor("exists persisted", "0")
+	if rsp, want := standbyReq("dbsize"), "2"; rsp != want {
+		t.Fatalf("the expired keys have been deleted by the standby: %q want %q", rsp, want)
+	}
+
+	if content := readAOF(t, standbyAOF); strings.Contains(content, "DEL") {
+		t.Fatalf("the standby has written a DEL into its AOF: %q", content)
+	}
+
+	// The commands of the primary are applied to the keys as they are on the primary
+	write("DEL deleted")
+	write("PERSIST persisted")
+	waitFor("dbsize", "1")
+	waitFor("get persisted", "value")
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"ddia/src/expire"
+	"ddia/src/resp"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scheduleResolution is how often the server looks for scheduled commands to run
+const scheduleResolution = 10 * time.Millisecond
+
+// scheduler keeps the commands scheduled to run at a future time (see SCHEDULE). Their deadlines are tracked by
+// an expire tracker, as the timeouts of the keys, keyed by the ID of the schedule.
+//
+// The lock of the scheduler is always acquired before the locks of the databases.
+type scheduler struct {
+	mux     sync.Mutex
+	nextID  int64
+	pending map[int64]scheduled
+	tracker expire.Tracker
+}
+
+// scheduled is a command scheduled to run at a future time
+type scheduled struct {
+	id       int64
+	database int
+	// at is the unix timestamp in milliseconds when the command runs
+	at   int64
+	args []string
+}
+
+func newScheduler(tracker expire.Tracker) *scheduler {
+	return &scheduler{nextID: 1, pending: make(map[int64]scheduled), tracker: tracker}
+}
+
+// add schedules sch. If sch.id is 0, a new ID is assigned. Returns false if the ID is already pending. The caller
+// must hold the lock.
+func (s *scheduler) add(sch scheduled) (scheduled, bool) {
+	if sch.id == 0 {
+		sch.id = s.nextID
+	}
+	if _, ok := s.pending[sch.id]; ok {
+		return sch, false
+	}
+	if sch.id >= s.nextID {
+		s.nextID = sch.id + 1
+	}
+
+	s.pending[sch.id] = sch
+	s.tracker.AddUpdate(sch.database, strconv.FormatInt(sch.id, 10), sch.at)
+	return sch, true
+}
+
+// cancel removes the schedule with the ID given. Returns false if it's not pending. The caller must hold the lock.
+func (s *scheduler) cancel(id int64) bool {
+	sch, ok := s.pending[id]
+	if !ok {
+		return false
+	}
+
+	delete(s.pending, id)
+	s.tracker.Remove(sch.database, strconv.FormatInt(id, 10))
+	return true
+}
+
+// due removes and returns a schedule whose time has come. The caller must hold the lock.
+func (s *scheduler) due(now int64) (scheduled, bool) {
+	for {
+		_, key, ok := s.tracker.GetExpired(now)
+		if !ok {
+			return scheduled{}, false
+		}
+
+		id, _ := strconv.ParseInt(key, 10, 64)
+		if sch, ok := s.pending[id]; ok {
+			delete(s.pending, id)
+			return sch, true
+		}
+	}
+}
+
+// list returns the pending schedules, the soonest first. The caller must hold the lock.
+func (s *scheduler) list() []scheduled {
+	schedules := make([]scheduled, 0, len(s.pending))
+	for _, sch := range s.pending {
+		schedules = append(schedules, sch)
+	}
+
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].at != schedules[j].at {
+			return schedules[i].at < schedules[j].at
+		}
+		return schedules[i].id < schedules[j].id
+	})
+
+	return schedules
+}
+
+// command returns the SCHEDULE command that recreates sch
+func (sch scheduled) command() []string {
+	args := []string{"SCHEDULE", "ID", strconv.FormatInt(sch.id, 10), "AT", strconv.FormatInt(sch.at, 10)}
+	return append(args, sch.args...)
+}
+
+// Schedule runs a command at a future time, on the database selected by the client. The command runs once,
+// inside the server, as if it was sent by an authenticated client. Only write commands can be scheduled.
+//
+//	SCHEDULE [ID id] AT unix-time-milliseconds|IN milliseconds command [arg ...]: replies the ID of the schedule.
+//	SCHEDULE LIST: replies the ID, time, database and command of each pending schedule, the soonest first.
+//	SCHEDULE CANCEL id: replies 1 if the schedule has been cancelled, 0 if it's not pending.
+//
+// The schedules are recorded on the AOF with an absolute time, so they survive a restart. The ones whose time
+// has passed while the server was stopped run as soon as it has been restored.
+func (h *Handlers) Schedule(c *client, sched *scheduler) error {
+	if len(c.args) < 2 {
+		return ErrWrongNumberArguments
+	}
+
+	switch strings.ToUpper(c.args[1]) {
+	case "LIST":
+		return h.scheduleList(c, sched)
+	case "CANCEL":
+		return h.scheduleCancel(c, sched)
+	default:
+		return h.scheduleAdd(c, sched)
+	}
+}
+
+func (h *Handlers) scheduleAdd(c *client, sched *scheduler) error {
+	sch := scheduled{database: c.dbIdx}
+
+	args := c.args[1:]
+	if len(args) >= 2 && strings.ToUpper(args[0]) == "ID" {
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || id <= 0 {
+			return ErrValueNotInt
+		}
+		sch.id, args = id, args[2:]
+	}
+
+	if len(args) < 3 {
+		return ErrWrongNumberArguments
+	}
+
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return ErrValueNotInt
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "AT":
+		sch.at = n
+	case "IN":
+		sch.at = time.Now().UnixMilli() + n
+	default:
+		return c.writeResponse(resp.NewError("ERR syntax error"))
+	}
+
+	sch.args = args[2:]
+	if cmd, ok := getCommand(sch.args[0]); !ok || cmd.Operation != "write" || strings.EqualFold(cmd.Name, Schedule) {
+		return c.writeResponse(resp.NewError(fmt.Sprintf("ERR command '%s' cannot be scheduled", sch.args[0])))
+	}
+
+	added := false
+	if err := h.atomicScheduler(c, sched, func() error {
+		sch, added = sched.add(sch)
+		if !added {
+			c.discardCommand()
+			return nil
+		}
+
+		// Recorded with the ID and an absolute time, so replaying the AOF recreates the same schedule
+		c.rewriteCommand(sch.command()...)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if !added {
+		return c.writeResponse(resp.NewError(fmt.Sprintf("ERR schedule %d already exists", sch.id)))
+	}
+
+	return c.writeResponse(resp.NewInteger(int(sch.id)))
+}
+
+func (h *Handlers) scheduleList(c *client, sched *scheduler) error {
+	if err := c.requiredArgs(1); err != nil {
+		return err
+	}
+
+	sched.mux.Lock()
+	schedules := sched.list()
+	sched.mux.Unlock()
+
+	rsp := make([]string, 0, 4*len(schedules))
+	for _, sch := range schedules {
+		rsp = append(rsp,
+			strconv.FormatInt(sch.id, 10),
+			strconv.FormatInt(sch.at, 10),
+			strconv.Itoa(sch.database),
+			strings.Join(sch.args, " "),
+		)
+	}
+
+	c.discardCommand()
+	return c.writeResponse(resp.NewArray(rsp))
+}
+
+func (h *Handlers) scheduleCancel(c *client, sched *scheduler) error {
+	if err := c.requiredArgs(2); err != nil {
+		return err
+	}
+
+	id, err := strconv.ParseInt(c.args[2], 10, 64)
+	if err != nil {
+		return ErrValueNotInt
+	}
+
+	result := 0
+	if err := h.atomicScheduler(c, sched, func() error {
+		if !sched.cancel(id) {
+			c.discardCommand()
+			return nil
+		}
+
+		result = 1
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return c.writeResponse(resp.NewInteger(result))
+}
+
+// atomicScheduler is atomic, holding the lock of the scheduler too: the changes to the schedules are written on
+// the AOF in the same order they are done.
+func (h *Handlers) atomicScheduler(c *client, sched *scheduler, fnx func() error) error {
+	sched.mux.Lock()
+	offset, err := h.atomicLocked(c, fnx)
+	sched.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := h.waitAOF(offset); err != nil {
+		return fmt.Errorf("%w: %v", ErrPersistenceFailed, err)
+	}
+
+	return nil
+}
+
+// runSchedules to be called as goroutine. It runs the scheduled commands whose time has come, every
+// scheduleResolution. To stop it, close the context.
+func (s *Server) runSchedules(ctx context.Context) {
+	ticker := time.NewTicker(scheduleResolution)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if s.handlers.replication.isReplica() {
+			continue // The master runs the scheduled commands, and sends them
+		}
+
+		for {
+			sch, ok := s.takeDueSchedule(time.Now().UnixMilli())
+			if !ok {
+				break
+			}
+			s.runScheduled(sch)
+		}
+	}
+}
+
+// takeDueSchedule removes a schedule whose time has come, and records it on the AOF as cancelled before its
+// command runs. If the server stops in between, the command is not run again after a restart: the scheduled
+// commands run at most once.
+//
+// The lock of the database of the schedule is held while it's recorded, as required by propagate, so the record
+// does not interleave with the writes to that database.
+func (s *Server) takeDueSchedule(now int64) (scheduled, bool) {
+	sch, offset, ok := func() (scheduled, uint64, bool) {
+		s.schedules.mux.Lock()
+		defer s.schedules.mux.Unlock()
+
+		sch, ok := s.schedules.due(now)
+		if !ok {
+			return sch, 0, false
+		}
+
+		unlock := s.locks.lock(sch.database)
+		defer unlock()
+
+		cancel := resp.NewArray([]string{"SCHEDULE", "CANCEL", strconv.FormatInt(sch.id, 10)})
+		offset, err := s.handlers.propagate(sch.database, cancel)
+		if err != nil {
+			s.logger.Printf("[ERROR] unable to record the schedule %d as done: %v", sch.id, err)
+		}
+
+		return sch, offset, true
+	}()
+	if !ok {
+		return sch, false
+	}
+
+	if err := s.handlers.waitAOF(offset); err != nil {
+		s.logger.Printf("[ERROR] unable to record the schedule %d as done: %v", sch.id, err)
+	}
+
+	return sch, true
+}
+
+// runScheduled runs the command of sch as an authenticated client connected to its database. The command is
+// written on the AOF as any other, and its reply is discarded, unless it's an error.
+func (s *Server) runScheduled(sch scheduled) {
+	conn := &scheduledConn{}
+	c := newClient(conn, s.options.dbs[sch.database])
+	c.dbIdx = sch.database
+	c.authenticated = true
+	c.args = sch.args
+	c.argsWriter = resp.NewArray(sch.args)
+
+	if err := s.processCommand(c); err != nil {
+		s.logger.Printf("[ERROR] schedule %d: %v", sch.id, err)
+		return
+	}
+
+	if rsp := conn.String(); strings.HasPrefix(rsp, "-") {
+		s.logger.Printf("[WARN] schedule %d: %s", sch.id, strings.TrimSpace(rsp[1:]))
+	}
+}
+
+// scheduledConn is the connection of the client that runs the scheduled commands. It keeps the replies.
+type scheduledConn struct {
+	bytes.Buffer
+}
+
+func (*scheduledConn) Close() error {
+	return nil
+}
+
+// writeSchedules writes the commands needed to recreate schedules into w, in RESP format
+func writeSchedules(w io.Writer, schedules []scheduled) error {
+	buf := &bytes.Buffer{}
+	for _, sch := range schedules {
+		buf.Reset()
+		_, _ = resp.NewArray([]string{"SELECT", strconv.Itoa(sch.database)}).WriteTo(buf)
+		_, _ = resp.NewArray(sch.command()).WriteTo(buf)
+
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -33,24 +33,31 @@ type Server struct {
 	handlers *Handlers
 	config   config.Config
 
-	// multiDBMux prevents deadlocks when trying to acquire locks for more than 1 DB
-	//   Process 1: locked DB 2, trying to acquire lock of DB 3
-	//   Process 2: locked DB 3, trying to acquire lock of DB 2
-	// If Process 1 and 2 need to fight for the same lock (multiDBMutex) then
-	// this race condition disappear
-	multiDBMux sync.Mutex
+	// locks acquires the locks of several databases without deadlocks, for the commands that need more than one
+	locks *dbLocks
 
 	// Expire is the object that keeps track of keys that expire at some point in the future
-	expire *expire.Expire
+	expire expire.Tracker
+	// schedules are the commands scheduled to run at some point in the future (see SCHEDULE)
+	schedules *scheduler
+
+	// followMux serializes the changes of master (see REPLICAOF)
+	followMux sync.Mutex
 }
 
 // New returns a new Redis Server configured with the Options provided
 func New(handlers *Handlers, opts ...Option) (*Server, error) {
 	// Default options
 	options := &options{
-		logger: logger.NewDiscard(),
-		host:   "localhost",
-		port:   6379,
+		logger:                   logger.NewDiscard(),
+		host:                     "localhost",
+		port:                     6379,
+		autoAOFRewritePercentage: 100,
+		autoAOFRewriteMinSize:    64 << 20, // 64mb
+		maxMemory:                maxMemory{policy: noEviction, samples: 5},
+		expireTracker:            heapTracker,
+		replBacklogSize:          defaultBacklogSize,
+		replicaReadOnly:          true,
 	}
 	for _, o := range opts {
 		o.apply(options)
@@ -65,26 +72,64 @@ func New(handlers *Handlers, opts ...Option) (*Server, error) {
 		}
 
 		options.password = c.GetD("requirepass", "")
+
+		options.autoAOFRewritePercentage, err = c.Integer("auto-aof-rewrite-percentage", options.autoAOFRewritePercentage)
+		if err != nil {
+			return nil, err
+		}
+
+		options.autoAOFRewriteMinSize, err = c.Bytes("auto-aof-rewrite-min-size", options.autoAOFRewriteMinSize)
+		if err != nil {
+			return nil, err
+		}
+
+		options.aofUseRDBPreamble = c.GetD("aof-use-rdb-preamble", "no") == "yes"
+
+		if options.maxMemory, err = readMaxMemory(c, options.maxMemory); err != nil {
+			return nil, err
+		}
+
+		options.expireTracker = c.GetD("expire-tracker", options.expireTracker)
+
+		if err := readReplication(c, options); err != nil {
+			return nil, err
+		}
+	}
+
+	tracker, err := newExpireTracker(options.expireTracker)
+	if err != nil {
+		return nil, err
+	}
+
+	schedulesTracker, err := newExpireTracker(options.expireTracker)
+	if err != nil {
+		return nil, err
+	}
+
+	handlers.replication.configure(options.replBacklogSize, options.replicaReadOnly)
+
+	// Keys deleted on access because they have expired must be recorded, as the ones deleted in the background
+	for idx, db := range options.dbs {
+		idx := idx
+		db.OnExpire(func(key string) ExpireMode { return handlers.expired(idx, key) })
 	}
 
 	return &Server{
-		logger:   options.logger,
-		options:  *options,
-		quit:     make(chan interface{}),
-		handlers: handlers,
-		expire:   expire.NewExpire(),
-		config:   c,
+		logger:    options.logger,
+		options:   *options,
+		quit:      make(chan interface{}),
+		handlers:  handlers,
+		locks:     newDBLocks(options.dbs),
+		expire:    tracker,
+		schedules: newScheduler(schedulesTracker),
+		config:    c,
 	}, nil
 }
 
-// Start starts the redis server
+// Start starts the redis server. It returns once the AOF has been restored. Meanwhile, the server is already
+// listening: the clients are answered with a LOADING error, except for the commands that do not access the
+// dataset (eg: PING, INFO).
 func (s *Server) Start(ctx context.Context) (err error) {
-	go s.lookForKeysToExpire(ctx)
-
-	if err := s.restoreAOF(ctx); err != nil {
-		return err
-	}
-
 	s.listener, err = net.Listen(serverNetwork, fmt.Sprintf("%s:%d", s.options.host, s.options.port))
 	if err != nil {
 		return fmt.Errorf("net.Listen: %w", err)
@@ -93,9 +138,30 @@ func (s *Server) Start(ctx context.Context) (err error) {
 	s.addr = s.listener.Addr().String()
 	s.logger.Printf("Listening at %q", s.addr)
 
+	// Mark the server as loading before accepting connections, so no client sees the dataset half restored
+	s.handlers.loading.start(0)
+
 	s.wg.Add(1)
 	go s.serve(ctx)
 
+	if err := s.restoreAOF(ctx); err != nil {
+		_ = s.Stop()
+		return err
+	}
+	s.handlers.loading.finish()
+
+	go s.lookForKeysToExpire(ctx)
+
+	go s.runSchedules(ctx)
+
+	go s.rewriteAOFWhenNeeded(ctx)
+
+	if s.options.replicaOf != nil {
+		s.follow(s.options.replicaOf[0], s.options.replicaOf[1])
+	} else if s.options.followAOFDir != "" {
+		s.followAOF(s.options.followAOFDir, s.options.followAOFFilename)
+	}
+
 	return nil
 }
 
@@ -105,6 +171,7 @@ func (s *Server) Stop() error {
 		close(s.quit)
 	})
 	err := s.listener.Close() // Close listener, thus new connections
+	s.stopReplication()       // Stop replicating the master, and streaming to the replicas
 	s.wg.Wait()               // Waiting for clients to finish
 	return err
 }
@@ -191,6 +258,22 @@ func (s *Server) processCommand(c *client) (err error) {
 		return err
 	}
 
+	if err := s.handlers.checkLoading(c); err != nil {
+		return err
+	}
+
+	if err := s.handlers.checkReadOnly(c); err != nil {
+		return err
+	}
+
+	if err := s.handlers.checkPersistence(c); err != nil {
+		return err
+	}
+
+	if err := s.handlers.checkMemory(c, s.options.dbs, s.expire, s.options.maxMemory); err != nil {
+		return err
+	}
+
 	switch strings.ToUpper(c.command()) {
 	case "":
 		return errors.New("invalid command: length 0")
@@ -216,6 +299,12 @@ func (s *Server) processCommand(c *client) (err error) {
 		return s.handlers.DBSize(c)
 	case Del:
 		return s.handlers.Del(c)
+	case Unlink:
+		return s.handlers.Unlink(c)
+	case Touch:
+		return s.handlers.Touch(c)
+	case Type:
+		return s.handlers.Type(c)
 	case Incr:
 		return s.handlers.Incr(c)
 	case IncrBy:
@@ -228,8 +317,10 @@ func (s *Server) processCommand(c *client) (err error) {
 		return s.handlers.Auth(c, s.options.password)
 	case FlushDB:
 		return s.handlers.FlushDB(c)
+	case SwapDB:
+		return s.handlers.SwapDB(c, s.options.dbs, s.locks, s.expire)
 	case FlushAll:
-		return s.handlers.FlushAll(c, s.options.dbs)
+		return s.handlers.FlushAll(c, s.options.dbs, s.locks)
 	case Exists:
 		return s.handlers.Exists(c)
 	case Config:
@@ -237,7 +328,9 @@ func (s *Server) processCommand(c *client) (err error) {
 	case RandomKey:
 		return s.handlers.RandomKey(c)
 	case Rename:
-		return s.handlers.Rename(c)
+		return s.handlers.Rename(c, s.expire)
+	case RenameNX:
+		return s.handlers.RenameNX(c, s.expire)
 	case LPush:
 		return s.handlers.LPush(c)
 	case RPush:
@@ -259,11 +352,57 @@ func (s *Server) processCommand(c *client) (err error) {
 	case LTrim:
 		return s.handlers.LTrim(c)
 	case Move:
-		return s.handlers.Move(c, s.options.dbs, &s.multiDBMux)
+		return s.handlers.Move(c, s.options.dbs, s.locks, s.expire)
+	case Copy:
+		return s.handlers.Copy(c, s.options.dbs, s.locks, s.expire)
+	case Dump:
+		return s.handlers.Dump(c)
+	case Restore:
+		return s.handlers.Restore(c, s.expire)
+	case Migrate:
+		return s.handlers.Migrate(c, s.expire)
+	case Wait:
+		return s.handlers.Wait(c)
+	case WaitAOF:
+		return s.handlers.WaitAOF(c)
 	case Expire:
 		return s.handlers.Expire(c, s.expire)
 	case TTL:
-		return s.handlers.TTL(c, s.expire)
+		return s.handlers.TTL(c)
+	case PExpire:
+		return s.handlers.PExpire(c, s.expire)
+	case PTTL:
+		return s.handlers.PTTL(c)
+	case ExpireAt:
+		return s.handlers.ExpireAt(c, s.expire)
+	case PExpireAt:
+		return s.handlers.PExpireAt(c, s.expire)
+	case Persist:
+		return s.handlers.Persist(c, s.expire)
+	case ExpireTime:
+		return s.handlers.ExpireTime(c)
+	case PExpireTime:
+		return s.handlers.PExpireTime(c)
+	case BGRewriteAOF:
+		return s.handlers.BGRewriteAOF(c, s.options.dbs, s.locks, s.schedules, s.options.aofUseRDBPreamble)
+	case Info:
+		return s.handlers.Info(c, s.options.dbs, s.options.maxMemory)
+	case Memory:
+		return s.handlers.Memory(c, s.options.dbs)
+	case Object:
+		return s.handlers.Object(c)
+	case Schedule:
+		return s.handlers.Schedule(c, s.schedules)
+	case ReplicaOf:
+		return s.handlers.ReplicaOf(c, s)
+	case SlaveOf:
+		return s.handlers.SlaveOf(c, s)
+	case PSync:
+		return s.handlers.PSync(c, s.options.dbs, s.locks, s.schedules)
+	case ReplConf:
+		return s.handlers.ReplConf(c)
+	case Role:
+		return s.handlers.Role(c)
 	default:
 		if err := s.handlers.UnknownCommand(c); err != nil {
 			return fmt.Errorf("handlers.UnknownCommand: %w", err)
@@ -315,6 +454,15 @@ func handleWellKnownErrors(c *client, err error) error {
 		rsp = resp.NewError("NOAUTH Authentication required")
 	} else if errors.Is(err, ErrIndexOurOfRange) {
 		rsp = resp.NewError("ERR index out of range")
+	} else if errors.Is(err, ErrOutOfMemory) {
+		rsp = resp.NewError("OOM command not allowed when used memory > 'maxmemory'.")
+	} else if errors.Is(err, ErrReadOnly) {
+		rsp = resp.NewError("READONLY You can't write against a read only replica.")
+	} else if errors.Is(err, ErrLoading) {
+		rsp = resp.NewError("LOADING Redis is loading the dataset in memory")
+	} else if errors.Is(err, ErrPersistenceFailed) {
+		reason := strings.TrimPrefix(err.Error(), ErrPersistenceFailed.Error()+": ")
+		rsp = resp.NewError("MISCONF Errors writing to the AOF file: " + reason)
 	}
 
 	if rsp != nil {
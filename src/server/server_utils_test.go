@@ -6,10 +6,13 @@ import (
 	"ddia/src/resp"
 	"ddia/src/server"
 	"ddia/src/storage"
+	"ddia/src/storage/aof"
 	"ddia/testing/log"
 	"errors"
 	"io"
 	"net"
+	"os"
+	"path"
 	"strings"
 	"testing"
 )
@@ -100,3 +103,69 @@ func serverOptions() []server.Option {
 		server.WithDBs(dbs),
 	}
 }
+
+// testServerWithAOF starts a server that writes its AOF into aofPath, and restores it on startup
+func testServerWithAOF(t testing.TB, aofPath string) (*server.Server, *aof.AppendOnlyFile) {
+	t.Helper()
+
+	s, appendOnlyFile, err := startServerWithAOF(t, aofPath, "")
+	if err != nil {
+		t.Fatalf("expecting no error: %q", err.Error())
+	}
+
+	return s, appendOnlyFile
+}
+
+// startServerWithAOF starts a server that writes its AOF into aofPath, and restores it on startup. Extra
+// configuration directives can be passed on config.
+func startServerWithAOF(t testing.TB, aofPath, config string) (*server.Server, *aof.AppendOnlyFile, error) {
+	t.Helper()
+
+	configPath := path.Join(t.TempDir(), "redis.conf")
+	config = "appenddirname " + aofPath + "\n" + config
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatalf("unable to write configuration file: %v", err)
+	}
+
+	appendOnlyFile, err := aof.Open(context.Background(), aofPath, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = appendOnlyFile.Close() })
+
+	handlers := server.NewHandlers(log.ServerLogger(), appendOnlyFile)
+
+	options := append(serverOptions(), server.WithConfigurationFile(configPath))
+	s, err := server.New(handlers, options...)
+	if err != nil {
+		t.Fatalf("expecting server to be able to start without problems: %v", err)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		return nil, nil, err
+	}
+	t.Cleanup(func() { _ = s.Stop() })
+
+	return s, appendOnlyFile, nil
+}
+
+// readAOF returns the content of all the files of the AOF stored at dir
+func readAOF(t testing.TB, dir string) string {
+	t.Helper()
+
+	files, err := aof.Files(dir, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	var content []byte
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+		content = append(content, data...)
+	}
+
+	return string(content)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"ddia/src/resp"
+	"ddia/src/storage/aof"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// standbyPollPeriod is how often a log-shipping replica checks if the AOF it follows has grown
+const standbyPollPeriod = 100 * time.Millisecond
+
+// followAOF makes the server a log-shipping replica of the AOF stored at dir: a warm standby that applies the
+// commands another server writes into its AOF, as they are written, reading its files (see follow-appenddirname).
+// Like any replica, it's read-only by default, and it's promoted with REPLICAOF NO ONE.
+func (s *Server) followAOF(dir, filename string) {
+	s.followMux.Lock()
+	defer s.followMux.Unlock()
+
+	s.startLink(&masterLink{dir: dir, filename: filename}, s.shipLogs)
+}
+
+// shipLogs to be called as goroutine. It loads the AOF followed through link, and applies the commands written
+// into it from then on, loading it again whenever it cannot be followed anymore (eg: the other server has
+// truncated it after a crash). To stop it, close the context.
+func (s *Server) shipLogs(ctx context.Context, link *masterLink) {
+	for {
+		err := s.tailAOF(ctx, link)
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.logger.Printf("[ERROR] following the AOF %s: %v", link, err)
+		s.handlers.replication.setStatus(link, linkConnect)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicaRetryPeriod):
+		}
+	}
+}
+
+// tailAOF replaces the dataset by the one of the AOF followed through link, and then applies the commands written
+// into it, moving from one incremental file to the next when the other server opens a new one. It returns when
+// the context is closed, or the AOF cannot be followed anymore.
+//
+// The clients get a LOADING error until it has caught up with the end of the AOF, and the AOF of this server has
+// been rewritten, as it holds the old dataset.
+func (s *Server) tailAOF(ctx context.Context, link *masterLink) error {
+	key, err := s.aofKey()
+	if err != nil {
+		return err
+	}
+
+	files, err := aof.ListFiles(link.dir, link.filename)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, f := range files {
+		if stat, err := os.Stat(f.Path); err == nil {
+			total += stat.Size()
+		}
+	}
+
+	s.handlers.replication.setStatus(link, linkSync)
+	s.handlers.loading.start(total)
+	defer s.handlers.loading.finish()
+
+	s.schedules.mux.Lock()
+	unlock := s.locks.lockAll()
+	err = s.clearDataset()
+	unlock()
+	s.schedules.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	s.handlers.replication.synced("", 0)
+
+	// The files before the last one are not written anymore
+	current := files[len(files)-1]
+	for _, f := range files[:len(files)-1] {
+		if err := s.applyAOF(ctx, f.Path, key, nil); err != nil {
+			return err
+		}
+	}
+
+	caughtUp := false
+	for {
+		sealed := func() (bool, error) {
+			files, err := aof.ListFiles(link.dir, link.filename)
+			if err != nil {
+				return false, err
+			}
+
+			// The end of the file being written has been reached for the first time
+			if !caughtUp {
+				if err := s.caughtUp(link); err != nil {
+					return false, err
+				}
+				caughtUp = true
+			}
+
+			return files[len(files)-1].Seq != current.Seq, nil
+		}
+
+		if err := s.applyAOF(ctx, current.Path, key, sealed); err != nil {
+			return err
+		}
+
+		// Once the file has been sealed, the other server writes into the incremental file that follows it. The
+		// ones before might have been replaced by a rewrite, with the dataset already applied.
+		next, err := nextIncrFile(link.dir, link.filename, current.Seq)
+		if err != nil {
+			return err
+		}
+		current = next
+	}
+}
+
+// caughtUp records that the dataset of the AOF followed through link has been loaded, once the AOF of this server
+// has been rewritten with it. If the rewrite fails, the AOF holds the old dataset: the error is returned, and the
+// AOF followed is loaded again.
+func (s *Server) caughtUp(link *masterLink) error {
+	err := s.handlers.rewriteAOFNow(s.options.dbs, s.locks, s.schedules, s.options.aofUseRDBPreamble)
+	if err != nil && !errors.Is(err, aof.ErrRewriteNotSupported) {
+		return fmt.Errorf("unable to rewrite the AOF after loading the AOF %s: %w", link, err)
+	}
+
+	s.handlers.replication.setStatus(link, linkConnected)
+	s.handlers.loading.finish()
+	s.logger.Printf("Caught up with the AOF %s", link)
+	return nil
+}
+
+// nextIncrFile returns the first incremental file of the AOF stored at dir after the one numbered seq
+func nextIncrFile(dir, filename string, seq int) (aof.File, error) {
+	files, err := aof.ListFiles(dir, filename)
+	if err != nil {
+		return aof.File{}, err
+	}
+
+	for _, f := range files {
+		if !f.Base && f.Seq > seq {
+			return f, nil
+		}
+	}
+
+	return aof.File{}, fmt.Errorf("no incremental file found after the number %d", seq)
+}
+
+// applyAOF runs the commands stored on the file of the AOF found at path. They are written into the AOF of this
+// server, as the ones of any client. If sealed is not nil, the file is being written, and it's followed until
+// sealed returns true (see aof.WithTail).
+func (s *Server) applyAOF(ctx context.Context, path string, key []byte, sealed func() (bool, error)) error {
+	opts := []aof.ImportOption{aof.WithPreambleLoader(s.loadRecord), aof.WithDecryption(key),
+		aof.WithProgress(func(n int) { s.handlers.loading.loaded.Add(int64(n)) })}
+	if sealed != nil {
+		opts = append(opts, aof.WithTail(standbyPollPeriod, sealed))
+	}
+
+	importAOF, err := aof.NewImportAppendOnlyFile(ctx, path, opts...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = importAOF.Close() }()
+
+	// As for the stream of a master, a command that fails is not counted as applied (see applyStream)
+	conn := &masterConn{Reader: importAOF}
+	c := newClient(conn, s.options.dbs[0])
+	c.authenticated = true
+	c.master = true
+
+	for {
+		err := c.readCommand()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.processMasterCommand(c); err != nil {
+			return err
+		}
+
+		if err := conn.failure(); err != nil {
+			return fmt.Errorf("unable to apply %q from %s: %w", c.command(), path, err)
+		}
+
+		n, _ := resp.NewArray(c.args).WriteTo(io.Discard)
+		s.handlers.replication.applied(n, c.aofOffset)
+	}
+}
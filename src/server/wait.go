@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"ddia/src/resp"
+	"strconv"
+	"time"
+)
+
+// Wait blocks until the writes done by the client have been applied by numreplicas replicas, or timeout
+// milliseconds have passed (0 waits forever). It returns the number of replicas that have applied them. The
+// replicas are asked to acknowledge their offset right away.
+//
+//	WAIT numreplicas timeout
+//
+// More: https://redis.io/commands/wait/
+func (h *Handlers) Wait(c *client) error {
+	if err := c.requiredArgs(2); err != nil {
+		return err
+	}
+
+	numReplicas, err := strconv.Atoi(c.args[1])
+	if err != nil {
+		return ErrValueNotInt
+	}
+
+	timeout, ok, err := waitTimeout(c, c.args[2])
+	if !ok {
+		return err
+	}
+
+	if h.replication.isReplica() {
+		return c.writeResponse(resp.NewError("ERR WAIT cannot be used with replica instances. Please also note " +
+			"that writes to replicas are just local and are not propagated."))
+	}
+
+	h.replication.requestAcks()
+	n := h.replication.waitAcks(c.replOffset, numReplicas, false, timeout)
+
+	return c.writeResponse(resp.NewInteger(n))
+}
+
+// WaitAOF blocks until the writes done by the client have been synced into the AOF of this server, if numlocal is
+// 1, and into the AOFs of numreplicas replicas, or timeout milliseconds have passed (0 waits forever). The AOF of
+// this server is synced right away, whatever the appendfsync option. It returns two numbers: 1 if they are in the
+// AOF of this server, 0 otherwise, and the number of replicas that have them in their AOFs. The replicas without
+// AOF are never counted.
+//
+//	WAITAOF numlocal numreplicas timeout
+//
+// More: https://redis.io/commands/waitaof/
+func (h *Handlers) WaitAOF(c *client) error {
+	if err := c.requiredArgs(3); err != nil {
+		return err
+	}
+
+	numLocal, err := strconv.Atoi(c.args[1])
+	if err != nil {
+		return ErrValueNotInt
+	}
+
+	numReplicas, err := strconv.Atoi(c.args[2])
+	if err != nil {
+		return ErrValueNotInt
+	}
+
+	timeout, ok, err := waitTimeout(c, c.args[3])
+	if !ok {
+		return err
+	}
+
+	if h.replication.isReplica() {
+		return c.writeResponse(resp.NewError("ERR WAITAOF cannot be used with replica instances. Please also " +
+			"note that writes to replicas are just local and are not propagated."))
+	}
+
+	local := 0
+	synced, err := h.syncAOF(c.aofOffset)
+	if !synced && numLocal > 0 {
+		return c.writeResponse(resp.NewError(
+			"ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled."))
+	} else if synced && err == nil {
+		local = 1
+	} else if synced {
+		h.logger.Printf("[ERROR] WAITAOF: unable to sync the AOF: %v", err)
+	}
+
+	h.replication.requestAcks()
+	n := h.replication.waitAcks(c.replOffset, numReplicas, true, timeout)
+
+	return c.writeResponse(resp.NewArray([]string{strconv.Itoa(local), strconv.Itoa(n)}))
+}
+
+// waitTimeout parses the timeout of WAIT and WAITAOF, in milliseconds. If it's not valid, the error is replied
+// to c, and false is returned.
+func waitTimeout(c *client, arg string) (time.Duration, bool, error) {
+	timeout, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, false, ErrValueNotInt
+	} else if timeout < 0 {
+		return 0, false, c.writeResponse(resp.NewError("ERR timeout is negative"))
+	}
+
+	return time.Duration(timeout) * time.Millisecond, true, nil
+}
+
+// requestAcks asks the replicas to acknowledge their offset right away, writing REPLCONF GETACK into the stream.
+// It's not written into the AOF.
+func (r *replication) requestAcks() {
+	buf := &bytes.Buffer{}
+	_, _ = resp.NewArray([]string{"REPLCONF", "GETACK", "*"}).WriteTo(buf) // Writing into a bytes.Buffer never fails
+	r.feed(buf.Bytes())
+}
+
+// waitAcks blocks until numReplicas replicas have acknowledged offset, or timeout has passed (0 waits forever).
+// With fsynced, the offset synced into their AOF is the one taken into account. Returns the number of replicas
+// that have acknowledged it.
+func (r *replication) waitAcks(offset int64, numReplicas int, fsynced bool, timeout time.Duration) int {
+	timedOut := false
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			r.mux.Lock()
+			defer r.mux.Unlock()
+
+			timedOut = true
+			r.cond.Broadcast()
+		})
+		defer timer.Stop()
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for {
+		acked := 0
+		for _, link := range r.replicas {
+			ack := link.ack
+			if fsynced {
+				ack = link.fack
+			}
+			if ack >= offset {
+				acked++
+			}
+		}
+
+		if acked >= numReplicas || timedOut || r.stopped {
+			return acked
+		}
+
+		r.cond.Wait()
+	}
+}
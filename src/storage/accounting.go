@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"ddia/src/server"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// The memory used by the records is estimated from the size of the structures that hold them, on 64 bits:
+//
+//	string header: pointer and length, 16 bytes
+//	atom: kind, value (interface, 16 bytes), size, accessedAt and frequency, 48 bytes
+//	list.List: root element and length, 48 bytes
+//	list.Element: next, prev, list and Value (interface, 16 bytes), 40 bytes
+const (
+	// recordOverhead is the memory used by each key besides the key and its value: the header of the key, and the
+	// atom
+	recordOverhead = 16 + 48
+	// stringOverhead is the memory used by a string value besides its content: its header
+	stringOverhead = 16
+	// listOverhead is the memory used by a list value besides its elements
+	listOverhead = 48
+	// listElementOverhead is the memory used by each element of a list besides its content: the node of the list,
+	// and the header of the string
+	listElementOverhead = 40 + 16
+)
+
+const (
+	// lfuInitValue is the frequency of new keys, so they are not evicted before they have a chance to be accessed
+	lfuInitValue = 5
+	// lfuLogFactor defines how many accesses are needed to saturate the frequency counter: with 10, about a million
+	lfuLogFactor = 10
+	// lfuDecayTime is the time without accesses needed to decrement the frequency counter by one
+	lfuDecayTime = time.Minute
+)
+
+// recordSize returns the approximated number of bytes used by the record key with value a
+func recordSize(key string, a atom) int64 {
+	return recordOverhead + int64(len(key)) + a.size
+}
+
+// stringSize returns the approximated number of bytes used by a string value v
+func stringSize(v string) int64 {
+	return stringOverhead + int64(len(v))
+}
+
+// listElementSize returns the approximated number of bytes used by an element of a list with value v
+func listElementSize(v string) int64 {
+	return listElementOverhead + int64(len(v))
+}
+
+// touch records an access to a at now: it updates the LRU clock, and increments the LFU counter. The counter is
+// incremented with a probability that decreases as the counter grows, so it fits in a byte.
+func (a *atom) touch(now time.Time) {
+	a.frequency = a.decayedFrequency(now)
+	a.accessedAt = now.UnixMilli()
+
+	if a.frequency == 255 {
+		return
+	}
+
+	base := float64(a.frequency) - lfuInitValue
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		a.frequency++
+	}
+}
+
+// decayedFrequency returns the frequency of a at now: it's decremented once per lfuDecayTime without accesses
+func (a atom) decayedFrequency(now time.Time) uint8 {
+	periods := now.Sub(time.UnixMilli(a.accessedAt)) / lfuDecayTime
+	if periods >= time.Duration(a.frequency) {
+		return 0
+	}
+
+	return a.frequency - uint8(periods)
+}
+
+// stats returns the statistics of the record key with value a
+func (a atom) stats(key string, now time.Time) server.KeyStats {
+	return server.KeyStats{
+		Key:       key,
+		Type:      a.kind.String(),
+		Encoding:  a.encoding(),
+		Size:      recordSize(key, a),
+		Idle:      now.UnixMilli() - a.accessedAt,
+		Frequency: a.decayedFrequency(now),
+	}
+}
+
+// encoding returns how the value is stored, named after the encodings of Redis: strings that are integers are
+// "int", short strings "embstr" and long strings "raw". Lists are "linkedlist".
+func (a atom) encoding() string {
+	switch a.kind {
+	case stringKind:
+		v, _ := a.value.(string)
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil && len(v) <= 20 {
+			return "int"
+		} else if len(v) <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case listKind:
+		return "linkedlist"
+	default:
+		return "unknown"
+	}
+}
+
+// account adds (sign 1) or subtracts (sign -1) the record key with value a from the memory used by the database
+func (m *InMemory) account(key string, a atom, sign int64) {
+	size := sign * recordSize(key, a)
+	m.used.Add(size)
+	m.byKind[a.kind].Keys += int(sign)
+	m.byKind[a.kind].Bytes += size
+}
+
+// MemoryUsage returns the approximated number of bytes used by the database. It can be called without holding
+// the lock.
+func (m *InMemory) MemoryUsage() int64 {
+	return m.used.Load()
+}
+
+// MemoryStats returns the number of keys, and the approximated number of bytes they use, by type
+func (m *InMemory) MemoryStats() map[string]server.MemoryStats {
+	stats := make(map[string]server.MemoryStats)
+	for k, s := range m.byKind {
+		if k != int(undefinedKind) {
+			stats[kind(k).String()] = s
+		}
+	}
+
+	return stats
+}
+
+// Sample returns up to n keys chosen randomly, with their statistics. The same key might be returned more than once.
+func (m *InMemory) Sample(n int) []server.KeyStats {
+	now := time.Now()
+
+	samples := make([]server.KeyStats, 0, n)
+	for i := 0; i < n && i < len(m.records); i++ {
+		for key, a := range m.records { // The iteration of a map starts at a random element
+			samples = append(samples, m.stats(key, a, now))
+			break
+		}
+	}
+
+	return samples
+}
+
+// SampleVolatile returns up to n keys with a timeout chosen randomly, with their statistics. The same key might be
+// returned more than once.
+func (m *InMemory) SampleVolatile(n int) []server.KeyStats {
+	now := time.Now()
+
+	samples := make([]server.KeyStats, 0, n)
+	for i := 0; i < n && i < len(m.expires); i++ {
+		for key := range m.expires { // The iteration of a map starts at a random element
+			samples = append(samples, m.stats(key, m.records[key], now))
+			break
+		}
+	}
+
+	return samples
+}
+
+// KeyStats returns the statistics of key. Returns false if the key does not exist.
+func (m *InMemory) KeyStats(key string) (server.KeyStats, bool) {
+	a, ok := m.lookup(key)
+	if !ok {
+		return server.KeyStats{}, false
+	}
+
+	return m.stats(key, a, time.Now()), true
+}
+
+// SetAccessStats sets the access statistics of key, as they were on another server (see RESTORE): idle is the
+// number of milliseconds since its last access, and frequency its LFU counter. Returns false if the key does not
+// exist.
+func (m *InMemory) SetAccessStats(key string, idle int64, frequency uint8) bool {
+	a, ok := m.lookup(key)
+	if !ok {
+		return false
+	}
+
+	a.accessedAt = time.Now().UnixMilli() - idle
+	a.frequency = frequency
+	m.records[key] = a
+	return true
+}
+
+// stats returns the statistics of the record key with value a, including its timeout
+func (m *InMemory) stats(key string, a atom, now time.Time) server.KeyStats {
+	s := a.stats(key, now)
+	s.ExpiresAt = m.expires[key]
+	return s
+}
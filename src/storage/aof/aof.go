@@ -3,10 +3,33 @@ package aof
 
 import (
 	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
+// ErrRewriteInProgress is returned when a rewrite is requested while another one is still running
+var ErrRewriteInProgress = errors.New("rewrite already in progress")
+
+// ErrRewriteNotSupported is returned when the AOF does not know the directory where its files are stored, thus
+// it's not able to replace it with a compacted version
+var ErrRewriteNotSupported = errors.New("rewrite not supported")
+
+// ErrQueued is returned by Append and Write while the AOF is failing: the data has not reached the file, but it
+// has been queued, and it's written once the disk recovers. It must not be written again.
+var ErrQueued = errors.New("the AOF is failing, the write has been queued")
+
+// ErrDiscarded is returned by Append and Write once too much data has been queued while the AOF is failing (see
+// WithMaxPending). The queue is discarded, and so are the writes, until a rewrite replaces the files that miss
+// them.
+var ErrDiscarded = errors.New("the AOF is failing and too much data is queued, the writes are discarded until " +
+	"the AOF is rewritten")
+
 type writeSyncer interface {
 	io.WriteCloser
 	Sync() error
@@ -29,69 +52,575 @@ const (
 // AppendOnlyFile stores the commands being executed in the Redis server into a
 // file. It allows various disk synchronization mechanisms
 type AppendOnlyFile struct {
-	file      writeSyncer
+	// mux protects file, manifest, sizes and rewrite. The file can be swapped by a rewrite at any time.
+	mux  sync.Mutex
+	file writeSyncer
+	// dir is the directory where the files of the AOF are stored, and manifest lists them. Only known when the AOF
+	// has been created using Open. Needed to rewrite the AOF.
+	dir       string
+	filename  string
+	manifest  manifest
 	options   options
 	lastWrite time.Time // Only updated when option EverySecondSync is used
+
+	// size is the current size of the AOF (all its files), and baseSize the size it had after the last rewrite
+	// (or at startup)
+	size, baseSize int64
+	// rewrite is not nil while a rewrite is in progress
+	rewrite *Rewrite
+
+	// framed is true if each write is wrapped in a frame with a checksum (see frameMarker)
+	framed bool
+	// seq is the sequence number of the last frame written (or queued, see pending). Each file has its own
+	// sequence of frames.
+	seq uint64
+	// buf is reused to build the frames and annotations
+	buf []byte
+
+	// aead encrypts the writes, nil if encryption is disabled (see WithEncryption). sealed is reused to build the
+	// chunks.
+	key    []byte
+	aead   cipher.AEAD
+	sealed []byte
+
+	// timestamps is true if the writes are annotated with the time they were done (see annotationMarker), and
+	// lastTimestamp is the last timestamp written into the current file
+	timestamps    bool
+	lastTimestamp int64
+
+	// written is the number of bytes written since the AOF has been opened (it's not reset on rewrites), and
+	// synced how many of them are known to be on disk.
+	written, synced uint64
+	// syncMux makes sure only one Sync is in progress. Writers waiting for it are synced on the next batch.
+	syncMux sync.Mutex
+
+	// err is the last error writing or syncing the file. While it's set, the writes are queued into pending, and
+	// retried in the background until the disk recovers.
+	err     error
+	pending []byte
+	// maxPending is the maximum size of pending. Once exceeded, pending is discarded, and discarded is set until
+	// a rewrite starts: the current file misses writes, it cannot be recovered.
+	maxPending int
+	discarded  bool
+}
+
+// defaultMaxPending is the maximum size of the writes queued while the AOF is failing (see WithMaxPending)
+const defaultMaxPending = 64 << 20 // 64mb
+
+// retryInterval is how often a failed AOF tries to write its pending data, and how often the data is synced
+// with EverySecondSync
+const retryInterval = time.Second
+
+// Stats describes the state of the AOF
+type Stats struct {
+	// Size is the current size of the file, and BaseSize the size it had after the last rewrite (or at startup)
+	Size, BaseSize int64
+	// RewriteInProgress is true if a rewrite has been started and not committed or aborted yet
+	RewriteInProgress bool
+	// Err is the last error writing or syncing the file. nil if the AOF is healthy.
+	Err error
+}
+
+// Option configures an AppendOnlyFile
+type Option interface {
+	apply(*AppendOnlyFile)
+}
+
+type framing bool
+
+func (f framing) apply(a *AppendOnlyFile) {
+	a.framed = bool(f)
+}
+
+// WithFraming wraps each write into a frame with a length, a sequence number and a CRC32C checksum, so that
+// corruption can be detected when reading the AOF. Files with and without frames can be read by the Scanner,
+// thus framing can be enabled on an existing AOF. It's the equivalent of the "aof-framing" directive.
+func WithFraming(enabled bool) Option {
+	return framing(enabled)
+}
+
+type timestamps bool
+
+func (t timestamps) apply(a *AppendOnlyFile) {
+	a.timestamps = bool(t)
+}
+
+// WithTimestamps annotates the writes with the wall-clock time they were done, at most once per second, so the
+// AOF can be restored up to a point in time (see Restore). The Scanner ignores the annotations. It's the
+// equivalent of the "aof-timestamp-enabled" directive, disabled by default.
+//
+// The annotations are a format break: the versions before them refuse to load an AOF that contains them.
+func WithTimestamps(enabled bool) Option {
+	return timestamps(enabled)
+}
+
+type encryption []byte
+
+func (e encryption) apply(a *AppendOnlyFile) {
+	a.key = e
+}
+
+// WithEncryption encrypts the files of the AOF with AES-GCM, using key (see ReadKeyFile). Each write is encrypted
+// as a chunk, so a file that ends with an incomplete chunk can be truncated like any other AOF. If the last file
+// of the AOF is not encrypted (or the other way around), a new incremental file is started. It's only used by
+// Open. It's the equivalent of the "aof-encryption-key-file" directive.
+func WithEncryption(key []byte) Option {
+	return encryption(key)
+}
+
+type filename string
+
+func (f filename) apply(a *AppendOnlyFile) {
+	a.filename = string(f)
+}
+
+// WithFilename sets the prefix used to name the files of the AOF (DefaultFilename by default). It's only used
+// by Open. It's the equivalent of the "appendfilename" directive.
+func WithFilename(name string) Option {
+	return filename(name)
+}
+
+type maxPending int
+
+func (m maxPending) apply(a *AppendOnlyFile) {
+	a.maxPending = int(m)
+}
+
+// WithMaxPending sets the maximum number of bytes queued while the AOF is failing (64mb by default). Once
+// exceeded, the writes are discarded, and the AOF keeps failing with ErrDiscarded until it's rewritten (see
+// StartRewrite): the memory used does not grow while the disk does not recover.
+func WithMaxPending(size int) Option {
+	return maxPending(size)
 }
 
 // NewAppendOnlyFile creates an AppendOnlyFile. You can pass io.Discard to the writeSyncer if you're not interested
 // into saving any data.
-func NewAppendOnlyFile(ctx context.Context, f writeSyncer, o options) *AppendOnlyFile {
-	aof := &AppendOnlyFile{file: f, options: o}
-
-	if o == EverySecondSync {
-		go aof.startTicker(ctx)
+func NewAppendOnlyFile(ctx context.Context, f writeSyncer, o options, opts ...Option) *AppendOnlyFile {
+	aof := &AppendOnlyFile{file: f, options: o, maxPending: defaultMaxPending}
+	for _, opt := range opts {
+		opt.apply(aof)
 	}
 
+	go aof.startTicker(ctx)
+
 	return aof
 }
 
+// Open opens (or creates) the AOF stored at the directory dir. Unlike NewAppendOnlyFile, an AOF created with
+// Open can be rewritten (see StartRewrite).
+//
+// The AOF is made of multiple files, listed in a manifest (see Files): a base file, created by the last
+// rewrite, and incremental files with the commands executed afterwards. New commands are appended to the last
+// incremental file. If dir is a regular file, it's an AOF created before the AOF was split into multiple files:
+// it's moved into a new directory at the same path.
+//
+// If framing is enabled, the last incremental file is read to find the last sequence number used.
+func Open(ctx context.Context, dir string, o options, opts ...Option) (*AppendOnlyFile, error) {
+	a := &AppendOnlyFile{dir: dir, filename: DefaultFilename, options: o, maxPending: defaultMaxPending}
+	for _, opt := range opts {
+		opt.apply(a)
+	}
+
+	if a.key != nil {
+		var err error
+		if a.aead, err = newAEAD(a.key); err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+	}
+
+	if err := a.openDir(); err != nil {
+		return nil, err
+	}
+
+	go a.startTicker(ctx)
+
+	return a, nil
+}
+
+// openDir reads (or creates) the manifest, and opens the last incremental file
+func (a *AppendOnlyFile) openDir() error {
+	stat, err := os.Stat(a.dir)
+	_, upgradeErr := os.Stat(a.dir + ".upgrade")
+	if (err == nil && !stat.IsDir()) || (errors.Is(err, os.ErrNotExist) && upgradeErr == nil) {
+		if err := upgrade(a.dir, a.filename); err != nil {
+			return fmt.Errorf("unable to move the AOF %s into a directory: %w", a.dir, err)
+		}
+	}
+
+	if err := os.MkdirAll(a.dir, 0700); err != nil {
+		return err
+	}
+
+	m, err := readManifest(a.dir, a.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		m = m.with(m.next(incrFile))
+		err = m.write(a.dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Files left behind by a rewrite that crashed, or could not be removed after a rewrite
+	if err := m.removeUnused(a.dir); err != nil {
+		return err
+	}
+
+	incr, _ := m.last(incrFile)
+	path := filepath.Join(a.dir, incr.name)
+
+	// Encrypted chunks cannot be appended to a plain file, nor the other way around
+	if changed, err := a.encryptionChanged(path); err != nil {
+		return err
+	} else if changed {
+		incr = m.next(incrFile)
+		path = filepath.Join(a.dir, incr.name)
+		m = m.with(incr)
+		if err := m.write(a.dir); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := a.writeHeader(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if a.size, err = m.size(a.dir); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if a.framed {
+		if a.seq, err = lastSequence(f.Name(), a.key); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	a.file, a.manifest, a.baseSize = f, m, a.size
+
+	return nil
+}
+
+// encryptionChanged returns true if the file at path is not empty, and it's encrypted while the encryption is
+// disabled, or the other way around
+func (a *AppendOnlyFile) encryptionChanged(path string) (bool, error) {
+	stat, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && stat.Size() == 0) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	encrypted, err := isEncrypted(path)
+	if err != nil {
+		return false, err
+	}
+
+	return encrypted != (a.aead != nil), nil
+}
+
+// writeHeader writes the header of an encrypted file into f, if encryption is enabled and f is empty
+func (a *AppendOnlyFile) writeHeader(f *os.File) error {
+	if a.aead == nil {
+		return nil
+	}
+
+	stat, err := f.Stat()
+	if err != nil || stat.Size() != 0 {
+		return err
+	}
+
+	_, err = f.Write([]byte(encryptionMagic))
+	return err
+}
+
+// lastSequence returns the sequence number of the last valid frame of the file
+func lastSequence(path string, key []byte) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	r, err := NewFileReader(f, key)
+	if err != nil {
+		return 0, err
+	}
+
+	s := NewScanner(r)
+	for s.Scan() {
+	}
+
+	// Errors are ignored: they will be reported when importing the file. New frames continue the sequence of
+	// the last valid one.
+	return s.lastSeq, nil
+}
+
+// startTicker syncs the file every second with EverySecondSync, and retries the failed writes
 func (a *AppendOnlyFile) startTicker(ctx context.Context) {
 	var lastSync time.Time
-	ticker := time.Tick(time.Second) // nolint: staticcheck
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker:
-			if !lastSync.Equal(a.lastWrite) {
+		case <-ticker.C:
+			a.mux.Lock()
+			if a.err != nil {
+				a.retryLocked()
+			} else if a.options == EverySecondSync && !lastSync.Equal(a.lastWrite) {
 				if err := a.file.Sync(); err != nil {
-					panic(err)
+					a.err = err
+				} else {
+					lastSync = a.lastWrite
+					a.synced = a.written
 				}
-				lastSync = a.lastWrite
 			}
+			a.mux.Unlock()
 		case <-ctx.Done():
 			return // stop goroutine
 		}
 	}
 }
 
+// queueLocked queues data to be written once the disk recovers, after a.err has been set. If the queue exceeds
+// a.maxPending, it's discarded instead. The caller must hold a.mux.
+func (a *AppendOnlyFile) queueLocked(data []byte) error {
+	if len(a.pending)+len(data) > a.maxPending {
+		a.pending, a.discarded = nil, true
+		a.err = fmt.Errorf("%w (more than %d bytes): %v", ErrDiscarded, a.maxPending, a.err)
+		return a.err
+	}
+
+	a.pending = append(a.pending, data...)
+	return fmt.Errorf("%w: %v", ErrQueued, a.err)
+}
+
+// retryLocked writes the pending data, and syncs the file. If everything goes well, the AOF is healthy again.
+// The caller must hold a.mux.
+func (a *AppendOnlyFile) retryLocked() {
+	if a.discarded {
+		return // Only a rewrite can recover the AOF
+	}
+
+	if len(a.pending) != 0 {
+		n, err := a.file.Write(a.pending)
+		a.size += int64(n)
+		a.written += uint64(n)
+		a.pending = a.pending[n:]
+		if err != nil {
+			a.err = err
+			return
+		}
+	}
+
+	if a.options != NeverSync {
+		if err := a.file.Sync(); err != nil {
+			a.err = err
+			return
+		}
+		a.synced = a.written
+	}
+
+	a.pending, a.err = nil, nil
+}
+
 // Write data into the AOF file. Write needs to be called once per atomic operations. Eg: "select 1; set hello world" must
 // be performed in a single Write call, not in two. Otherwise, the order of the commands in the AOL might be incorrect.
 //
 // Thus, it cannot be AppendOnlyFile cannot be wrapped with bufio.NewWriter because multiple calls might be made
 // to write. Use bytes.Buffer instead
+//
+// With AlwaysSync, Write returns once the data is on disk. It's the same as calling Append followed by WaitSync.
+// While the AOF is failing, it returns len(data) and an error wrapping ErrQueued: the data will be written once the
+// disk recovers.
 func (a *AppendOnlyFile) Write(data []byte) (int, error) {
-	// file.Write call already implements a mutex, so it's thread-safe.
-	n, err := a.file.Write(data)
-	if err != nil {
-		return n, err
+	offset, err := a.Append(data)
+	if errors.Is(err, ErrQueued) {
+		return len(data), err
+	} else if err != nil {
+		return 0, err
 	}
 
-	if a.options == AlwaysSync {
-		if err := a.file.Sync(); err != nil {
-			return n, err
+	if err := a.WaitSync(offset); err != nil {
+		return len(data), err
+	}
+
+	return len(data), nil
+}
+
+// Append writes data into the AOF like Write, but without waiting for it to be synced to disk. It returns the
+// offset that must be passed to WaitSync to make sure the data is durable.
+//
+// It allows group commits: the caller appends while holding the locks that guarantee the order of the commands,
+// releases them, and then waits. Concurrent writers waiting at the same time are synced with a single fsync.
+//
+// If the data cannot be written, it's queued, and an error wrapping ErrQueued is returned: it must not be appended
+// again. If too much data is queued, an error wrapping ErrDiscarded is returned instead.
+func (a *AppendOnlyFile) Append(data []byte) (uint64, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.discarded {
+		return 0, a.err
+	}
+
+	a.buf = a.buf[:0]
+	if a.timestamps {
+		if now := time.Now().Unix(); now != a.lastTimestamp {
+			a.buf = appendTimestamp(a.buf, now)
+			a.lastTimestamp = now
 		}
-	} else if a.options == EverySecondSync {
+	}
+
+	toWrite := data
+	if a.framed {
+		a.seq++
+		a.buf = appendFrame(a.buf, a.seq, data)
+		toWrite = a.buf
+	} else if len(a.buf) != 0 {
+		a.buf = append(a.buf, data...)
+		toWrite = a.buf
+	}
+
+	if a.aead != nil {
+		a.sealed = appendChunk(a.sealed[:0], a.aead, toWrite)
+		toWrite = a.sealed
+	}
+
+	if a.err != nil {
+		// The previous writes have not reached the file yet. Keep the order, this one will be retried after them.
+		return 0, a.queueLocked(toWrite)
+	}
+
+	n, err := a.file.Write(toWrite)
+	a.size += int64(n)
+	a.written += uint64(n)
+	if err != nil {
+		// The data might have been written partially. The rest is retried later on, so the file is not corrupted
+		// once the disk recovers.
+		a.err = err
+		return 0, a.queueLocked(toWrite[n:])
+	}
+
+	if a.options == EverySecondSync {
 		a.lastWrite = time.Now()
 	}
 
-	return n, nil
+	return a.written, nil
+}
+
+// WaitSync blocks until the data appended up to offset (as returned by Append) is on disk. If a Sync is already
+// in progress, it waits for it to finish, and then syncs all the writes appended meanwhile at once.
+//
+// It only blocks with AlwaysSync. Otherwise, the data is synced in the background.
+func (a *AppendOnlyFile) WaitSync(offset uint64) error {
+	if a.options != AlwaysSync {
+		return nil
+	}
+
+	return a.SyncUpTo(offset)
+}
+
+// SyncUpTo blocks until the data appended up to offset (as returned by Append) is on disk, like WaitSync, but
+// whatever the sync option: the file is synced now if needed (see WAITAOF).
+func (a *AppendOnlyFile) SyncUpTo(offset uint64) error {
+	a.syncMux.Lock()
+	defer a.syncMux.Unlock()
+
+	a.mux.Lock()
+	if a.synced >= offset {
+		a.mux.Unlock()
+		return nil // Synced by another writer
+	}
+	file, target := a.file, a.written
+	a.mux.Unlock()
+
+	// The lock is not held while syncing, so other writers can keep appending to the file
+	err := file.Sync()
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.synced >= target {
+		// A rewrite has replaced (and closed) the file while syncing, but the new file is already on disk
+		return nil
+	}
+
+	if err != nil {
+		a.err = err // The sync is retried in the background
+		return err
+	}
+
+	a.synced = target
+
+	return nil
+}
+
+// NeedsRewrite returns true if the AOF has grown more than percentage (relative to its size after the last
+// rewrite) and it's bigger than minSize bytes. A percentage of 0 disables the automatic rewrite.
+//
+// It's the equivalent of the "auto-aof-rewrite-percentage" and "auto-aof-rewrite-min-size" directives.
+//
+// It also returns true if the writes have been discarded (see ErrDiscarded), whatever the size of the AOF.
+func (a *AppendOnlyFile) NeedsRewrite(percentage int, minSize int64) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.discarded && a.dir != "" && a.rewrite == nil {
+		return true
+	}
+
+	if percentage <= 0 || a.dir == "" || a.rewrite != nil || a.size < minSize {
+		return false
+	}
+
+	base := a.baseSize
+	if base == 0 {
+		base = 1
+	}
+
+	growth := (a.size - base) * 100 / base
+	return growth >= int64(percentage)
+}
+
+// Stats returns the state of the AOF
+func (a *AppendOnlyFile) Stats() Stats {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	return Stats{Size: a.size, BaseSize: a.baseSize, RewriteInProgress: a.rewrite != nil, Err: a.err}
+}
+
+// RewriteInProgress returns true while a rewrite has been started and not committed or aborted yet
+func (a *AppendOnlyFile) RewriteInProgress() bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	return a.rewrite != nil
 }
 
 // Close the AOF
 func (a *AppendOnlyFile) Close() error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.err != nil {
+		a.retryLocked() // Last chance to write the pending data
+	}
+
 	_ = a.file.Sync()
-	return a.file.Close()
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	return a.err
 }
 
 // NoOpAOF no-operation AOF. Everything ends up in /dev/null
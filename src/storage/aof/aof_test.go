@@ -3,9 +3,15 @@ package aof_test
 import (
 	"context"
 	"ddia/src/storage/aof"
+	"errors"
 	"os"
 	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestWrite(t *testing.T) {
@@ -63,3 +69,598 @@ func TestNoOpAOF(t *testing.T) {
 		t.Fatalf("expecting no error: %v", err)
 	}
 }
+
+// readAOF returns the content of all the files of the AOF stored at dir
+func readAOF(t *testing.T, dir string) string {
+	t.Helper()
+
+	files, err := aof.Files(dir, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	var content []byte
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+		content = append(content, data...)
+	}
+
+	return string(content)
+}
+
+func TestRewrite(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	if _, err := a.Write([]byte("old data")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	r, err := a.StartRewrite()
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := a.StartRewrite(); !errors.Is(err, aof.ErrRewriteInProgress) {
+		t.Fatalf("expecting error: %v, want %v", err, aof.ErrRewriteInProgress)
+	}
+
+	// Received while rewriting: must be kept after the new base file
+	if _, err := a.Write([]byte("|during rewrite")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := r.Write([]byte("compacted")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if err := r.Commit(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if a.RewriteInProgress() {
+		t.Fatalf("rewrite is expected to be finished")
+	}
+
+	// Written after the rewrite: must be appended into the new incremental file
+	if _, err := a.Write([]byte("|after rewrite")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if data, want := readAOF(t, dir), "compacted|during rewrite|after rewrite"; data != want {
+		t.Fatalf("information written is not correct: %q. want %q", data, want)
+	}
+
+	files, err := aof.Files(dir, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	want := []string{path.Join(dir, "appendonly.aof.1.base.aof"), path.Join(dir, "appendonly.aof.2.incr.aof")}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("unexpected files: %v, want %v", files, want)
+	}
+
+	// The old incremental file has been removed
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("unexpected number of files: %d, want the manifest, the base and the incremental file", len(entries))
+	}
+}
+
+func TestRewrite_Abort(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	if _, err := a.Write([]byte("before|")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	r, err := a.StartRewrite()
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := a.Write([]byte("during")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if err := r.Abort(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if data, want := readAOF(t, dir), "before|during"; data != want {
+		t.Fatalf("information written is not correct: %q. want %q", data, want)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "temp-") {
+			t.Fatalf("temporary file has not been removed: %s", e.Name())
+		}
+	}
+}
+
+func TestOpen_Upgrade(t *testing.T) {
+	aofPath := path.Join(t.TempDir(), "redis.aof")
+	if err := os.WriteFile(aofPath, []byte("single file|"), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	a, err := aof.Open(context.Background(), aofPath, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	if _, err := a.Write([]byte("new data")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// The file has been moved into a directory, becoming the base file
+	if data, want := readAOF(t, aofPath), "single file|new data"; data != want {
+		t.Fatalf("information written is not correct: %q. want %q", data, want)
+	}
+}
+
+func TestOpen_RemoveUnused(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	_ = a.Close()
+
+	// Left behind by a rewrite that crashed
+	leftovers := []string{"temp-rewriteaof-123.aof", "appendonly.aof.1.base.aof"}
+	for _, name := range leftovers {
+		if err := os.WriteFile(path.Join(dir, name), []byte("garbage"), 0600); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+
+	a, err = aof.Open(context.Background(), dir, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	for _, name := range leftovers {
+		if _, err := os.Stat(path.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("file %s has not been removed: %v", name, err)
+		}
+	}
+
+	if data := readAOF(t, dir); data != "" {
+		t.Fatalf("unexpected content: %q", data)
+	}
+}
+
+func TestNeedsRewrite(t *testing.T) {
+	tmpFile := path.Join(t.TempDir(), "test.aof")
+	if err := os.WriteFile(tmpFile, []byte("0123456789"), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	a, err := aof.Open(context.Background(), tmpFile, aof.NeverSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	if _, err := a.Write([]byte("01234")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// The file has grown 50%
+	if a.NeedsRewrite(100, 0) {
+		t.Fatalf("growth is 50%%, rewrite not expected with percentage 100")
+	}
+
+	if !a.NeedsRewrite(50, 0) {
+		t.Fatalf("growth is 50%%, rewrite expected with percentage 50")
+	}
+
+	if a.NeedsRewrite(50, 1024) {
+		t.Fatalf("file is smaller than min size, rewrite not expected")
+	}
+
+	if a.NeedsRewrite(0, 0) {
+		t.Fatalf("percentage 0 disables the rewrite")
+	}
+}
+
+// slowDisk counts the number of syncs, simulating a disk where each fsync takes some time
+type slowDisk struct {
+	mux     sync.Mutex
+	data    []byte
+	durable int // bytes of data synced
+	syncs   atomic.Int32
+}
+
+func (d *slowDisk) Write(p []byte) (int, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.data = append(d.data, p...)
+	return len(p), nil
+}
+
+func (d *slowDisk) Sync() error {
+	d.mux.Lock()
+	size := len(d.data)
+	d.mux.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+	d.syncs.Add(1)
+
+	d.mux.Lock()
+	d.durable = size
+	d.mux.Unlock()
+
+	return nil
+}
+
+func (d *slowDisk) Close() error {
+	return nil
+}
+
+func TestGroupCommit(t *testing.T) {
+	disk := &slowDisk{}
+	a := aof.NewAppendOnlyFile(context.Background(), disk, aof.AlwaysSync)
+
+	const writers, writesPerWriter = 20, 10
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < writesPerWriter; j++ {
+				offset, err := a.Append([]byte("data"))
+				if err != nil {
+					t.Errorf("expecting no error: %v", err)
+					return
+				}
+
+				if err := a.WaitSync(offset); err != nil {
+					t.Errorf("expecting no error: %v", err)
+					return
+				}
+
+				// WaitSync must not return until the data is on disk
+				disk.mux.Lock()
+				durable := disk.durable
+				disk.mux.Unlock()
+				if durable < int(offset) {
+					t.Errorf("write acknowledged before being synced")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if want := writers * writesPerWriter * len("data"); len(disk.data) != want {
+		t.Fatalf("unexpected number of bytes written: %d, want %d", len(disk.data), want)
+	}
+
+	if disk.durable != len(disk.data) {
+		t.Fatalf("not all the data has been synced: %d, want %d", disk.durable, len(disk.data))
+	}
+
+	// Concurrent writes are synced in batches
+	if syncs := int(disk.syncs.Load()); syncs >= writers*writesPerWriter {
+		t.Fatalf("expecting less syncs than writes: %d syncs for %d writes", syncs, writers*writesPerWriter)
+	}
+}
+
+func TestAppend_WaitSync(t *testing.T) {
+	disk := &slowDisk{}
+	a := aof.NewAppendOnlyFile(context.Background(), disk, aof.AlwaysSync)
+
+	first, err := a.Append([]byte("first"))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	second, err := a.Append([]byte("second"))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if disk.syncs.Load() != 0 {
+		t.Fatalf("Append must not sync")
+	}
+
+	if err := a.WaitSync(second); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// The first write has been synced on the same batch
+	if err := a.WaitSync(first); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if syncs := disk.syncs.Load(); syncs != 1 {
+		t.Fatalf("unexpected number of syncs: %d, want 1", syncs)
+	}
+}
+
+func TestAppend_SyncUpTo(t *testing.T) {
+	disk := &slowDisk{}
+	a := aof.NewAppendOnlyFile(context.Background(), disk, aof.NeverSync)
+
+	offset, err := a.Append([]byte("data"))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if err := a.WaitSync(offset); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	} else if disk.syncs.Load() != 0 {
+		t.Fatalf("WaitSync must not sync with NeverSync")
+	}
+
+	// Synced whatever the option
+	if err := a.SyncUpTo(offset); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	disk.mux.Lock()
+	durable := disk.durable
+	disk.mux.Unlock()
+	if durable != len("data") {
+		t.Fatalf("the data has not been synced: %d bytes durable", durable)
+	}
+
+	// Already on disk
+	if err := a.SyncUpTo(offset); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	} else if syncs := disk.syncs.Load(); syncs != 1 {
+		t.Fatalf("unexpected number of syncs: %d, want 1", syncs)
+	}
+}
+
+// failingDisk fails all the writes and syncs while fail is true. Writes are partially done before failing.
+type failingDisk struct {
+	mux  sync.Mutex
+	data []byte
+	fail bool
+}
+
+func (d *failingDisk) Write(p []byte) (int, error) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.fail {
+		n := len(p) / 2
+		d.data = append(d.data, p[:n]...)
+		return n, errors.New("no space left on device")
+	}
+
+	d.data = append(d.data, p...)
+	return len(p), nil
+}
+
+func (d *failingDisk) Sync() error {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if d.fail {
+		return errors.New("input/output error")
+	}
+	return nil
+}
+
+func (d *failingDisk) Close() error {
+	return nil
+}
+
+func (d *failingDisk) setFail(fail bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.fail = fail
+}
+
+// waitHealthy waits until the AOF recovers from a failure
+func waitHealthy(t *testing.T, a *aof.AppendOnlyFile) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().Err != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("the AOF has not recovered: %v", a.Stats().Err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWrite_Failure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	disk := &failingDisk{}
+	a := aof.NewAppendOnlyFile(ctx, disk, aof.AlwaysSync)
+
+	if _, err := a.Write([]byte("first;")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	disk.setFail(true)
+
+	if _, err := a.Write([]byte("second;")); err == nil {
+		t.Fatalf("expecting an error")
+	}
+
+	if a.Stats().Err == nil {
+		t.Fatalf("expecting the error to be reported")
+	}
+
+	// Queued while the AOF is failing, to be written in the same order: it must not be written again
+	if n, err := a.Write([]byte("third;")); !errors.Is(err, aof.ErrQueued) || n != len("third;") {
+		t.Fatalf("unexpected result: %d, %v, want %d, %v", n, err, len("third;"), aof.ErrQueued)
+	}
+
+	disk.setFail(false)
+	waitHealthy(t, a)
+
+	if _, err := a.Write([]byte("fourth;")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// The second write has been written partially, and completed once the disk recovered
+	if want := "first;second;third;fourth;"; string(disk.data) != want {
+		t.Fatalf("unexpected content: %q, want %q", disk.data, want)
+	}
+}
+
+func TestWrite_SyncFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	disk := &failingDisk{}
+	a := aof.NewAppendOnlyFile(ctx, disk, aof.EverySecondSync)
+
+	if _, err := a.Write([]byte("data")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	disk.setFail(true)
+
+	// The failure is detected by the sync done every second
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Stats().Err == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("expecting the sync error to be reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	disk.setFail(false)
+	waitHealthy(t, a)
+}
+
+func TestWrite_MaxPending(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	disk := &failingDisk{}
+	a := aof.NewAppendOnlyFile(ctx, disk, aof.AlwaysSync, aof.WithMaxPending(12))
+
+	disk.setFail(true)
+
+	// "first;" is written partially, and the rest is queued with "second;"
+	for _, data := range []string{"first;", "second;"} {
+		if _, err := a.Write([]byte(data)); !errors.Is(err, aof.ErrQueued) {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrQueued)
+		}
+	}
+
+	// The queue would exceed the limit: it's discarded, and so are the next writes
+	for _, data := range []string{"third;", "fourth;"} {
+		if n, err := a.Write([]byte(data)); !errors.Is(err, aof.ErrDiscarded) || n != 0 {
+			t.Fatalf("unexpected result: %d, %v, want 0, %v", n, err, aof.ErrDiscarded)
+		}
+	}
+
+	// The file misses writes: it does not recover with the disk
+	disk.setFail(false)
+	time.Sleep(1500 * time.Millisecond)
+
+	if err := a.Stats().Err; !errors.Is(err, aof.ErrDiscarded) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrDiscarded)
+	}
+
+	if want := "fir"; string(disk.data) != want {
+		t.Fatalf("unexpected content: %q, want %q", disk.data, want)
+	}
+
+}
+
+func TestRewrite_RecoverDiscarded(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync, aof.WithMaxPending(16))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	if _, err := a.Write([]byte("old data")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// Closing the file makes the writes fail, as a failing disk would
+	files, err := aof.ListFiles(dir, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	_ = a.Close()
+
+	for _, data := range []string{"lost;", "too much data;"} {
+		_, _ = a.Write([]byte(data))
+	}
+
+	if err := a.Stats().Err; !errors.Is(err, aof.ErrDiscarded) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrDiscarded)
+	}
+
+	// Even if the automatic rewrite is disabled
+	if !a.NeedsRewrite(0, 0) {
+		t.Fatalf("expecting the AOF to need a rewrite")
+	}
+
+	// A rewrite writes the dataset again, and the writes go into a new incremental file
+	r, err := a.StartRewrite()
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if err := a.Stats().Err; err != nil {
+		t.Fatalf("expecting the AOF to be healthy: %v", err)
+	}
+
+	if _, err := a.Write([]byte("|after")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := r.Write([]byte("compacted")); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if err := r.Commit(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if data, want := readAOF(t, dir), "compacted|after"; data != want {
+		t.Fatalf("information written is not correct: %q. want %q", data, want)
+	}
+
+	if _, err := os.Stat(files[0].Path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the file missing writes has not been removed: %v", err)
+	}
+}
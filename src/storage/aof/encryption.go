@@ -0,0 +1,213 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptionMagic is found at the beginning of every encrypted file. It's followed by chunks:
+//
+//	{ciphertext length, 4 bytes big endian}{nonce, 12 bytes}{ciphertext, including the 16 bytes GCM tag}
+//
+// Each chunk is encrypted with AES-GCM using a random nonce, and contains one write into the AOF (complete
+// commands), so a file that ends with an incomplete chunk can be truncated at the end of the previous one. As the
+// nonce is random, a key must not encrypt more than 2^32 chunks: rotate the key before.
+const encryptionMagic = "DDIAAOF\x00ENC1"
+
+const (
+	// chunkHeaderLength is the length of the header of a chunk: ciphertext length and nonce
+	chunkHeaderLength = 4 + 12
+	// maxChunkLength prevents allocating huge amounts of memory when the length of a chunk is corrupted
+	maxChunkLength = maxFrameLength + 1<<20
+)
+
+// ErrEncrypted is returned when reading an encrypted file without a key
+var ErrEncrypted = errors.New("the AOF is encrypted, and no key has been set")
+
+// ReadKeyFile reads an AES key from a file. The key is hex encoded, and it must be 16, 24 or 32 bytes long
+// (AES-128, AES-192 or AES-256). It's the file of the "aof-encryption-key-file" directive.
+func ReadKeyFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file %s: the key must be hex encoded", path)
+	}
+
+	if _, err := newAEAD(key); err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// appendChunk appends into dst the plaintext encrypted as a chunk, see encryptionMagic
+func appendChunk(dst []byte, aead cipher.AEAD, plaintext []byte) []byte {
+	length := len(plaintext) + aead.Overhead()
+	dst = binary.BigEndian.AppendUint32(dst, uint32(length))
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Errorf("unable to generate a nonce: %w", err)) // crypto/rand never fails on supported platforms
+	}
+	dst = append(dst, nonce...)
+
+	return aead.Seal(dst, nonce, plaintext, nil)
+}
+
+// chunkWriter encrypts each call to Write as a chunk. The caller must write the header of the file.
+type chunkWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = appendChunk(c.buf[:0], c.aead, p)
+	if _, err := c.w.Write(c.buf); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// isEncrypted returns true if the file at path is an encrypted file, false if it's empty or not encrypted
+func isEncrypted(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	header := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(f, header); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return string(header) == encryptionMagic, nil
+}
+
+// FileReader reads the content of a file of the AOF, decrypting it if it's encrypted (see WithEncryption).
+type FileReader struct {
+	r    *bufio.Reader
+	aead cipher.AEAD
+	// plaintext contains the decrypted data not read yet
+	plaintext bytes.Reader
+	// n is the offset in the file where the last chunk decrypted ends
+	n         int64
+	truncated bool
+	err       error
+}
+
+// NewFileReader returns a FileReader reading from r. If the file is encrypted, it's decrypted with key. If it's
+// not, key is ignored.
+func NewFileReader(r io.Reader, key []byte) (*FileReader, error) {
+	fr := &FileReader{r: bufio.NewReader(r)}
+
+	header, err := fr.r.Peek(len(encryptionMagic))
+	if err != nil || string(header) != encryptionMagic {
+		return fr, nil // Not encrypted. Short files are validated by the Scanner.
+	}
+
+	if key == nil {
+		return nil, ErrEncrypted
+	}
+
+	if fr.aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+
+	_, _ = fr.r.Discard(len(encryptionMagic))
+	fr.n = int64(len(encryptionMagic))
+
+	return fr, nil
+}
+
+// Encrypted returns true if the file is encrypted
+func (f *FileReader) Encrypted() bool {
+	return f.aead != nil
+}
+
+// Truncated returns true if the encrypted file ends with an incomplete chunk, usually written while the server
+// crashed. The offset is where the last complete chunk ends: the content of the file is valid up to it.
+func (f *FileReader) Truncated() (offset int64, ok bool) {
+	return f.n, f.truncated
+}
+
+// Read reads the decrypted content. It returns io.EOF at the end of the last complete chunk. If a chunk has been
+// tampered with, it returns an error wrapping ErrCorrupted.
+func (f *FileReader) Read(p []byte) (int, error) {
+	if f.aead == nil {
+		return f.r.Read(p)
+	}
+
+	for f.plaintext.Len() == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		f.err = f.next()
+	}
+
+	return f.plaintext.Read(p)
+}
+
+// next decrypts the next chunk
+func (f *FileReader) next() error {
+	header := make([]byte, chunkHeaderLength)
+	if _, err := io.ReadFull(f.r, header); errors.Is(err, io.EOF) {
+		return io.EOF
+	} else if errors.Is(err, io.ErrUnexpectedEOF) {
+		f.truncated = true
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length < uint32(f.aead.Overhead()) || length > maxChunkLength {
+		return fmt.Errorf("%w: at offset %d: invalid chunk length %d", ErrCorrupted, f.n, length)
+	}
+
+	ciphertext := make([]byte, length)
+	if _, err := io.ReadFull(f.r, ciphertext); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		f.truncated = true
+		return io.EOF
+	} else if err != nil {
+		return err
+	}
+
+	plaintext, err := f.aead.Open(ciphertext[:0], header[4:], ciphertext, nil)
+	if err != nil {
+		return fmt.Errorf("%w: at offset %d: unable to decrypt the chunk, wrong key or tampered data",
+			ErrCorrupted, f.n)
+	}
+
+	f.n += int64(chunkHeaderLength) + int64(length)
+	f.plaintext.Reset(plaintext)
+
+	return nil
+}
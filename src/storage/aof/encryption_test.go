@@ -0,0 +1,232 @@
+package aof_test
+
+import (
+	"context"
+	"ddia/src/storage/aof"
+	"ddia/src/storage/rdb"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestReadKeyFile(t *testing.T) {
+	keyFile := path.Join(t.TempDir(), "aof.key")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(testKey)+"\n"), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	key, err := aof.ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if string(key) != string(testKey) {
+		t.Fatalf("unexpected key: %q, want %q", key, testKey)
+	}
+
+	if err := os.WriteFile(keyFile, []byte("abcd"), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := aof.ReadKeyFile(keyFile); err == nil {
+		t.Fatalf("expecting an error: the key is too short")
+	}
+}
+
+// importAll returns the commands of the file, as read by the server
+func importAll(t *testing.T, path string, opts ...aof.ImportOption) (string, error) {
+	t.Helper()
+
+	i, err := aof.NewImportAppendOnlyFile(context.Background(), path, opts...)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = i.Close() }()
+
+	data, err := io.ReadAll(i)
+	return string(data), err
+}
+
+func TestEncryption(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	// Plain commands written before enabling the encryption
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	_ = a.Close()
+
+	a, err = aof.Open(context.Background(), dir, aof.AlwaysSync, aof.WithEncryption(testKey), aof.WithFraming(true))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+
+	files, err := aof.Files(dir, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("unexpected files: %v, want a new incremental file for the encrypted writes", files)
+	}
+
+	content, err := os.ReadFile(files[1])
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if strings.Contains(string(content), "value") {
+		t.Fatalf("the file is not encrypted: %q", content)
+	}
+
+	t.Run("decrypt", func(t *testing.T) {
+		data, err := importAll(t, files[1], aof.WithDecryption(testKey))
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		if want := strings.Repeat(selectCmd+setCmd, 2); data != want {
+			t.Fatalf("unexpected data: %q, want %q", data, want)
+		}
+	})
+
+	t.Run("refuse to import without a key", func(t *testing.T) {
+		if _, err := importAll(t, files[1]); !errors.Is(err, aof.ErrEncrypted) {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrEncrypted)
+		}
+	})
+
+	t.Run("refuse to import with the wrong key", func(t *testing.T) {
+		wrongKey := []byte(strings.ToUpper(string(testKey)))
+		if _, err := importAll(t, files[1], aof.WithDecryption(wrongKey)); !errors.Is(err, aof.ErrCorrupted) {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrCorrupted)
+		}
+	})
+}
+
+func TestEncryption_Truncated(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	a, err := aof.Open(context.Background(), dir, aof.EverySecondSync, aof.WithEncryption(testKey))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+	_ = a.Close()
+
+	files, err := aof.Files(dir, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// The second chunk is cut in half, as if the server had crashed while writing it
+	stat, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	if err := os.Truncate(files[0], stat.Size()-10); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := importAll(t, files[0], aof.WithDecryption(testKey)); !errors.Is(err, aof.ErrTruncated) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrTruncated)
+	}
+
+	data, err := importAll(t, files[0], aof.WithDecryption(testKey), aof.WithLoadTruncated(true))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if want := selectCmd + setCmd; data != want {
+		t.Fatalf("unexpected data: %q, want %q", data, want)
+	}
+
+	// The file is valid again: new chunks can be appended to it
+	data, err = importAll(t, files[0], aof.WithDecryption(testKey))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if want := selectCmd + setCmd; data != want {
+		t.Fatalf("unexpected data: %q, want %q", data, want)
+	}
+}
+
+func TestEncryption_Rewrite(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync, aof.WithEncryption(testKey))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	r, err := a.StartRewrite()
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	w, err := rdb.NewWriter(r.Preamble())
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	if err := w.Write(rdb.Record{Key: "key", Value: "value"}); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := r.Write([]byte(selectCmd + setCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if err := r.Commit(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	files, err := aof.Files(dir, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	var records []rdb.Record
+	data, err := importAll(t, files[0], aof.WithDecryption(testKey),
+		aof.WithPreambleLoader(func(r rdb.Record) error {
+			records = append(records, r)
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if len(records) != 1 || records[0].Key != "key" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+
+	if want := selectCmd + setCmd; data != want {
+		t.Fatalf("unexpected data: %q, want %q", data, want)
+	}
+}
@@ -0,0 +1,94 @@
+package aof
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// frameMarker is the first byte of a frame. It cannot be confused with a RESP command, which always starts with
+// '*', so framed and plain RESP commands can live on the same file.
+//
+// A frame wraps each atomic write (eg: "SELECT 0" + "SET key value") with a header:
+//
+//	@{sequence} {payload length} {CRC32C of the payload, hexadecimal}\r\n{payload}
+//
+// Example:
+//
+//	@1 56 15f0f956\r\n*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n
+//
+// The sequence number starts at 1 and is incremented by one on each frame, so missing or duplicated frames can
+// be detected.
+const frameMarker = '@'
+
+const (
+	// maxFrameHeaderLength prevents reading garbage forever when looking for the end of a corrupted header
+	maxFrameHeaderLength = 64
+	// maxFrameLength prevents allocating huge amounts of memory when the length of a frame is corrupted
+	maxFrameLength = 512 << 20
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// errChecksum is returned when the payload of a frame does not match its checksum
+var errChecksum = errors.New("checksum mismatch")
+
+// appendFrame appends into dst the payload wrapped in a frame with sequence number seq
+func appendFrame(dst []byte, seq uint64, payload []byte) []byte {
+	dst = append(dst, frameMarker)
+	dst = strconv.AppendUint(dst, seq, 10)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(len(payload)), 10)
+	dst = append(dst, ' ')
+	dst = append(dst, fmt.Sprintf("%08x", crc32.Checksum(payload, crc32c))...)
+	dst = append(dst, '\r', '\n')
+	return append(dst, payload...)
+}
+
+// frameHeader is the header of a frame, see frameMarker
+type frameHeader struct {
+	seq      uint64
+	length   int
+	checksum uint32
+}
+
+// readFrameHeader reads the header of a frame from r. The frameMarker must have been consumed already.
+func readFrameHeader(r io.Reader) (frameHeader, error) {
+	line, err := readLine(r, maxFrameHeaderLength)
+	if err != nil {
+		return frameHeader{}, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return frameHeader{}, fmt.Errorf("invalid frame header %q", line)
+	}
+
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return frameHeader{}, fmt.Errorf("invalid frame sequence %q", fields[0])
+	}
+
+	length, err := strconv.Atoi(fields[1])
+	if err != nil || length < 0 || length > maxFrameLength {
+		return frameHeader{}, fmt.Errorf("invalid frame length %q", fields[1])
+	}
+
+	checksum, err := strconv.ParseUint(fields[2], 16, 32)
+	if err != nil {
+		return frameHeader{}, fmt.Errorf("invalid frame checksum %q", fields[2])
+	}
+
+	return frameHeader{seq: seq, length: length, checksum: uint32(checksum)}, nil
+}
+
+// verify returns errChecksum if payload does not match the checksum on the header
+func (h frameHeader) verify(payload []byte) error {
+	if sum := crc32.Checksum(payload, crc32c); sum != h.checksum {
+		return fmt.Errorf("%w: frame %d has checksum %08x, want %08x", errChecksum, h.seq, sum, h.checksum)
+	}
+	return nil
+}
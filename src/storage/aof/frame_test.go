@@ -0,0 +1,174 @@
+package aof_test
+
+import (
+	"bytes"
+	"context"
+	"ddia/src/storage/aof"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFraming(t *testing.T) {
+	tmpFile := path.Join(t.TempDir(), "test.aof")
+
+	// Plain RESP commands written before enabling the framing must still be readable
+	if err := os.WriteFile(tmpFile, []byte(selectCmd+setCmd), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	write := func() {
+		a, err := aof.Open(context.Background(), tmpFile, aof.AlwaysSync, aof.WithFraming(true))
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+		defer func() { _ = a.Close() }()
+
+		if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+
+	// Reopening the file must continue the sequence of frames
+	write()
+	write()
+
+	content := []byte(readAOF(t, tmpFile))
+
+	if !bytes.Contains(content, []byte("@1 ")) || !bytes.Contains(content, []byte("@2 ")) {
+		t.Fatalf("frames not found:\n%q", content)
+	}
+
+	s := aof.NewScanner(bytes.NewReader(content))
+	var commands [][]string
+	for s.Scan() {
+		commands = append(commands, s.Command())
+	}
+
+	if err := s.Err(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	cmd := [][]string{{"SELECT", "0"}, {"SET", "key", "value"}}
+	if want := append(append(cmd, cmd...), cmd...); !reflect.DeepEqual(commands, want) {
+		t.Fatalf("unexpected commands: %v, want %v", commands, want)
+	}
+}
+
+func TestFraming_DetectCorruption(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync, aof.WithFraming(true))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+	_ = a.Close()
+
+	content := []byte(readAOF(t, dir))
+	frameSize := len(content) / 3
+
+	scan := func(content []byte) error {
+		s := aof.NewScanner(bytes.NewReader(content))
+		for s.Scan() {
+		}
+		return s.Err()
+	}
+
+	t.Run("flipped bit", func(t *testing.T) {
+		corrupted := bytes.Replace(content, []byte("value"), []byte("valuf"), 1)
+
+		err := scan(corrupted)
+		if !errors.Is(err, aof.ErrCorrupted) || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrCorrupted)
+		}
+	})
+
+	t.Run("missing frame", func(t *testing.T) {
+		corrupted := append(append([]byte{}, content[:frameSize]...), content[2*frameSize:]...)
+
+		err := scan(corrupted)
+		if !errors.Is(err, aof.ErrCorrupted) || !strings.Contains(err.Error(), "frame 3 found after frame 1") {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrCorrupted)
+		}
+	})
+
+	t.Run("truncated frame", func(t *testing.T) {
+		if err := scan(content[:len(content)-5]); !errors.Is(err, aof.ErrTruncated) {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrTruncated)
+		}
+	})
+}
+
+func TestFraming_Rewrite(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync, aof.WithFraming(true))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	for i := 0; i < 5; i++ {
+		if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+
+	r, err := a.StartRewrite()
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := r.Write([]byte(selectCmd + setCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if err := r.Commit(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	files, err := aof.Files(dir, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// Each file has its own sequence of frames
+	count := 0
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		s := aof.NewScanner(f)
+		for s.Scan() {
+			count++
+		}
+		_ = f.Close()
+
+		if err := s.Err(); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+
+	// rewrite + write during the rewrite + write after the rewrite
+	if want := 3 * 2; count != want {
+		t.Fatalf("unexpected number of commands: %d, want %d", count, want)
+	}
+}
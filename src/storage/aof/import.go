@@ -2,9 +2,13 @@ package aof
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"ddia/src/resp"
+	"ddia/src/storage/rdb"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -12,23 +16,66 @@ import (
 // TCP connection so that the server can read all the commands one after the
 // other. If one command fails to execute in the server, the ImportAppendOnlyFile
 // returns an error afterwards.
+//
+// Each command is validated before being handed to the server, so the server never
+// reads a partial command.
+//
+// If the file starts with a snapshot (see aof-use-rdb-preamble), its records are handed to the loader set with
+// WithPreambleLoader before streaming the commands that follow it.
+//
+// With WithTail, it follows a file while another process writes it, returning the commands as they are written.
 type ImportAppendOnlyFile struct {
-	ctx context.Context
-	f   *os.File
-	b   *bufio.Reader
-	err error
+	ctx  context.Context
+	path string
+	f    *os.File
+	fr   *FileReader
+	r    *bufio.Reader
+	// scanner reads the commands that follow the preamble. nil until the preamble has been loaded.
+	scanner *Scanner
+	// preambleSize is the size of the snapshot found at the beginning of the file, 0 if there is none. The
+	// offsets of the scanner are relative to the end of the preamble.
+	preambleSize int64
+	options      importOptions
+	// pending contains the commands validated by the scanner, not read by the server yet
+	pending bytes.Buffer
+	err     error
+
+	truncatedAt int64
+	truncated   bool
 }
 
 // NewImportAppendOnlyFile returns a ImportAppendOnlyFile
-func NewImportAppendOnlyFile(ctx context.Context, aofPath string) (*ImportAppendOnlyFile, error) {
+func NewImportAppendOnlyFile(ctx context.Context, aofPath string, opts ...ImportOption) (*ImportAppendOnlyFile, error) {
 	f, err := os.OpenFile(aofPath, os.O_RDONLY, 0600)
 	if err != nil {
 		return nil, err
 	}
 
-	b := bufio.NewReaderSize(f, 2<<20) // 1MB
+	i := &ImportAppendOnlyFile{ctx: ctx, path: aofPath, f: f}
+	for _, o := range opts {
+		o.apply(&i.options)
+	}
 
-	return &ImportAppendOnlyFile{ctx: ctx, f: f, b: b}, nil
+	if i.options.tail != nil && i.options.loadTruncated {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: a file being followed cannot be truncated", aofPath)
+	}
+
+	var r io.Reader = f
+	if i.options.tail != nil {
+		r = &tailReader{ctx: ctx, f: f, tail: *i.options.tail}
+	}
+	if i.options.progress != nil {
+		r = progressReader{r: r, progress: i.options.progress}
+	}
+
+	if i.fr, err = NewFileReader(r, i.options.key); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", aofPath, err)
+	}
+	i.r = bufio.NewReader(i.fr)
+
+	return i, nil
 }
 
 // Read is used by the Server to read the operations. It would be the equivalent
@@ -37,10 +84,122 @@ func NewImportAppendOnlyFile(ctx context.Context, aofPath string) (*ImportAppend
 // If a Server response has returned an error code, we return an error here as well.
 func (i *ImportAppendOnlyFile) Read(p []byte) (n int, err error) {
 	if i.err != nil {
-
 		return 0, i.err
 	}
-	return i.b.Read(p)
+
+	if i.pending.Len() == 0 {
+		if err := i.next(); err != nil {
+			i.err = err
+			return 0, err
+		}
+	}
+
+	return i.pending.Read(p)
+}
+
+// next loads the next command into the pending buffer
+func (i *ImportAppendOnlyFile) next() error {
+	if err := i.ctx.Err(); err != nil {
+		return err
+	}
+
+	if i.scanner == nil {
+		if err := i.loadPreamble(); err != nil {
+			return err
+		}
+		i.scanner = NewScanner(i.r)
+	}
+
+	if i.scanner.Scan() {
+		_, err := resp.NewArray(i.scanner.Command()).WriteTo(&i.pending)
+		return err
+	}
+
+	err := i.scanner.Err()
+	if err == nil {
+		return i.truncateChunk()
+	}
+
+	// The offsets of an encrypted file are relative to its decrypted content: it's truncated by chunks
+	if !errors.Is(err, ErrTruncated) || !i.options.loadTruncated || i.fr.Encrypted() {
+		return fmt.Errorf("%s: %w", i.path, err)
+	}
+
+	// The AOF is truncated, but we've been told to load it anyway. The incomplete command is removed from the
+	// file, otherwise new commands would be appended after it and the file would be corrupted in the middle.
+	i.truncated, i.truncatedAt = true, i.preambleSize+i.scanner.Offset()
+	if err := os.Truncate(i.path, i.truncatedAt); err != nil {
+		return fmt.Errorf("unable to truncate %s to offset %d: %w", i.path, i.truncatedAt, err)
+	}
+
+	return io.EOF
+}
+
+// truncateChunk handles an encrypted file that ends with an incomplete chunk. As each chunk contains complete
+// commands, the file is truncated at the end of the last complete chunk.
+func (i *ImportAppendOnlyFile) truncateChunk() error {
+	offset, truncated := i.fr.Truncated()
+	if !truncated {
+		return io.EOF
+	}
+
+	if !i.options.loadTruncated {
+		return fmt.Errorf("%s: %w: incomplete encrypted chunk, last complete chunk ends at offset %d",
+			i.path, ErrTruncated, offset)
+	}
+
+	i.truncated, i.truncatedAt = true, offset
+	if err := os.Truncate(i.path, offset); err != nil {
+		return fmt.Errorf("unable to truncate %s to offset %d: %w", i.path, offset, err)
+	}
+
+	return io.EOF
+}
+
+// loadPreamble loads the snapshot found at the beginning of the file, if any
+func (i *ImportAppendOnlyFile) loadPreamble() error {
+	magic, err := i.r.Peek(len(rdb.Magic))
+	if err != nil || string(magic) != rdb.Magic {
+		return nil // No preamble. Short files are validated by the scanner.
+	}
+
+	if i.options.loadPreamble == nil {
+		return fmt.Errorf("%s: the AOF starts with a snapshot, and no loader has been set", i.path)
+	}
+
+	reader, err := rdb.NewReader(i.r)
+	if err != nil {
+		return fmt.Errorf("%s: %w: invalid preamble: %v", i.path, ErrCorrupted, err)
+	}
+
+	for n := 0; ; n++ {
+		if n%1024 == 0 {
+			if err := i.ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %w: invalid preamble: %v", i.path, ErrCorrupted, err)
+		}
+
+		if err := i.options.loadPreamble(record); err != nil {
+			return fmt.Errorf("%s: stopping import the AOF preamble (key %q): %w", i.path, record.Key, err)
+		}
+	}
+
+	i.preambleSize = reader.Offset()
+
+	return nil
+}
+
+// Truncated returns true if the AOF ended with an incomplete command, that has been discarded. The offset is
+// the new size of the file.
+func (i *ImportAppendOnlyFile) Truncated() (offset int64, ok bool) {
+	return i.truncatedAt, i.truncated
 }
 
 // Write it's a wierd name for what we're doing here. From the point of view of
@@ -51,7 +210,8 @@ func (i *ImportAppendOnlyFile) Read(p []byte) (n int, err error) {
 // calls from then on
 func (i *ImportAppendOnlyFile) Write(p []byte) (n int, err error) {
 	if len(p) != 0 && p[0] == resp.ErrorOp { // Error detected
-		i.err = fmt.Errorf("stopping import the AOF file: %s", p[1:])
+		offset := i.preambleSize + i.scanner.Offset()
+		i.err = fmt.Errorf("stopping import the AOF file (command ending at offset %d): %s", offset, p[1:])
 	}
 
 	return len(p), i.err
@@ -61,3 +221,78 @@ func (i *ImportAppendOnlyFile) Write(p []byte) (n int, err error) {
 func (i *ImportAppendOnlyFile) Close() error {
 	return i.f.Close()
 }
+
+// ImportOption configures how an AOF is imported
+type ImportOption interface {
+	apply(*importOptions)
+}
+
+type importOptions struct {
+	loadTruncated bool
+	loadPreamble  func(rdb.Record) error
+	key           []byte
+	progress      func(n int)
+	tail          *tail
+}
+
+type loadTruncated bool
+
+func (l loadTruncated) apply(opts *importOptions) {
+	opts.loadTruncated = bool(l)
+}
+
+// WithLoadTruncated loads an AOF that ends with an incomplete command (eg: after a crash) up to the last
+// complete command, truncating the file to that point. Otherwise, the import fails with ErrTruncated.
+// It's the equivalent of the "aof-load-truncated" directive.
+func WithLoadTruncated(load bool) ImportOption {
+	return loadTruncated(load)
+}
+
+type preambleLoader func(rdb.Record) error
+
+func (l preambleLoader) apply(opts *importOptions) {
+	opts.loadPreamble = l
+}
+
+// WithPreambleLoader sets the function that stores the keys of the snapshot found at the beginning of the AOF
+// (see aof-use-rdb-preamble). Loading them directly into the storage is much faster than replaying commands.
+// If the AOF starts with a snapshot and no loader has been set, the import fails.
+func WithPreambleLoader(load func(rdb.Record) error) ImportOption {
+	return preambleLoader(load)
+}
+
+type decryption []byte
+
+func (d decryption) apply(opts *importOptions) {
+	opts.key = d
+}
+
+// WithDecryption sets the key used to decrypt the AOF, if it's encrypted (see WithEncryption). Importing an
+// encrypted AOF without a key fails with ErrEncrypted.
+func WithDecryption(key []byte) ImportOption {
+	return decryption(key)
+}
+
+type progress func(n int)
+
+func (p progress) apply(opts *importOptions) {
+	opts.progress = p
+}
+
+// WithProgress calls fn with the number of bytes read from the file each time the file is read, so the caller
+// can track the progress of the import
+func WithProgress(fn func(n int)) ImportOption {
+	return progress(fn)
+}
+
+// progressReader reports the bytes read from r
+type progressReader struct {
+	r        io.Reader
+	progress func(n int)
+}
+
+func (p progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.progress(n)
+	return n, err
+}
@@ -0,0 +1,246 @@
+package aof_test
+
+import (
+	"bytes"
+	"context"
+	"ddia/src/storage/aof"
+	"ddia/src/storage/rdb"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportAppendOnlyFile_LoadTruncated(t *testing.T) {
+	tmpFile := path.Join(t.TempDir(), "test.aof")
+	if err := os.WriteFile(tmpFile, []byte(selectCmd+setCmd[:10]), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	t.Run("refuse to load a truncated file", func(t *testing.T) {
+		i, err := aof.NewImportAppendOnlyFile(context.Background(), tmpFile)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+		defer func() { _ = i.Close() }()
+
+		if _, err := io.ReadAll(i); !errors.Is(err, aof.ErrTruncated) {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrTruncated)
+		}
+	})
+
+	t.Run("load up to the last valid command", func(t *testing.T) {
+		i, err := aof.NewImportAppendOnlyFile(context.Background(), tmpFile, aof.WithLoadTruncated(true))
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+		defer func() { _ = i.Close() }()
+
+		data, err := io.ReadAll(i)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		if want := selectCmd; string(data) != want {
+			t.Fatalf("unexpected data: %q, want %q", data, want)
+		}
+
+		offset, truncated := i.Truncated()
+		if !truncated || offset != int64(len(selectCmd)) {
+			t.Fatalf("unexpected truncation: %v at %d, want true at %d", truncated, offset, len(selectCmd))
+		}
+
+		content, err := os.ReadFile(tmpFile)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		if want := selectCmd; string(content) != want {
+			t.Fatalf("the file has not been truncated: %q, want %q", content, want)
+		}
+	})
+}
+
+func TestImportAppendOnlyFile_Preamble(t *testing.T) {
+	records := []rdb.Record{
+		{DB: 0, Key: "key", Type: rdb.TypeString, Value: "value"},
+		{DB: 1, Key: "list", Type: rdb.TypeList, List: []string{"one", "two"}, ExpiresAt: 1700000000000},
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := rdb.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	for _, r := range records {
+		if err := w.Write(r); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	preamble := buf.String()
+
+	tmpFile := path.Join(t.TempDir(), "test.aof")
+	if err := os.WriteFile(tmpFile, []byte(preamble+selectCmd+setCmd), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	t.Run("load the snapshot and the commands that follow it", func(t *testing.T) {
+		var loaded []rdb.Record
+		i, err := aof.NewImportAppendOnlyFile(context.Background(), tmpFile,
+			aof.WithPreambleLoader(func(r rdb.Record) error {
+				loaded = append(loaded, r)
+				return nil
+			}))
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+		defer func() { _ = i.Close() }()
+
+		data, err := io.ReadAll(i)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		if want := selectCmd + setCmd; string(data) != want {
+			t.Fatalf("unexpected data: %q, want %q", data, want)
+		}
+
+		if len(loaded) != len(records) || loaded[1].Key != "list" || loaded[1].ExpiresAt != records[1].ExpiresAt {
+			t.Fatalf("unexpected records: %+v, want %+v", loaded, records)
+		}
+	})
+
+	t.Run("refuse to load without a loader", func(t *testing.T) {
+		i, err := aof.NewImportAppendOnlyFile(context.Background(), tmpFile)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+		defer func() { _ = i.Close() }()
+
+		if _, err := io.ReadAll(i); err == nil {
+			t.Fatalf("expecting an error")
+		}
+	})
+
+	t.Run("refuse to load a corrupted snapshot", func(t *testing.T) {
+		corrupted := []byte(preamble + selectCmd)
+		corrupted[len(rdb.Magic)+6] ^= 0xFF
+		if err := os.WriteFile(tmpFile, corrupted, 0600); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		i, err := aof.NewImportAppendOnlyFile(context.Background(), tmpFile,
+			aof.WithPreambleLoader(func(rdb.Record) error { return nil }))
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+		defer func() { _ = i.Close() }()
+
+		if _, err := io.ReadAll(i); !errors.Is(err, aof.ErrCorrupted) {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrCorrupted)
+		}
+	})
+}
+
+func TestImportAppendOnlyFile_Tail(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	if _, err := a.Write([]byte(selectCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	files, err := aof.ListFiles(dir, aof.DefaultFilename)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	want := []aof.File{{Path: path.Join(dir, "appendonly.aof.1.incr.aof"), Seq: 1}}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("unexpected files: %v, want %v", files, want)
+	}
+
+	// The file is sealed once it's not the last one anymore
+	sealed := func() (bool, error) {
+		files, err := aof.ListFiles(dir, aof.DefaultFilename)
+		return err == nil && files[len(files)-1].Seq != want[0].Seq, err
+	}
+
+	i, err := aof.NewImportAppendOnlyFile(context.Background(), want[0].Path,
+		aof.WithTail(10*time.Millisecond, sealed))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	defer func() { _ = i.Close() }()
+
+	done := make(chan []byte)
+	go func() {
+		data, err := io.ReadAll(i)
+		if err != nil {
+			t.Errorf("expecting no error: %v", err)
+		}
+		done <- data
+	}()
+
+	// Written while it's being followed, but not in a single write
+	if _, err := a.Write([]byte(setCmd[:10])); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := a.Write([]byte(setCmd[10:])); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	select {
+	case data := <-done:
+		t.Fatalf("the file has been read before it was sealed: %q", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A rewrite opens a new incremental file
+	r, err := a.StartRewrite()
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	defer func() { _ = r.Abort() }()
+
+	select {
+	case data := <-done:
+		if want := selectCmd + setCmd; string(data) != want {
+			t.Fatalf("unexpected data: %q, want %q", data, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the file has not been read up to its end once sealed")
+	}
+}
+
+func TestImportAppendOnlyFile_TailTruncated(t *testing.T) {
+	tmpFile := path.Join(t.TempDir(), "test.aof")
+	if err := os.WriteFile(tmpFile, []byte(selectCmd+setCmd), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	i, err := aof.NewImportAppendOnlyFile(context.Background(), tmpFile,
+		aof.WithTail(10*time.Millisecond, func() (bool, error) {
+			return false, os.Truncate(tmpFile, int64(len(selectCmd)))
+		}))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	defer func() { _ = i.Close() }()
+
+	if _, err := io.ReadAll(i); err == nil || !strings.Contains(err.Error(), "has been truncated") {
+		t.Fatalf("unexpected error: %v, want the truncation to be detected", err)
+	}
+}
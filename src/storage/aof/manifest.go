@@ -0,0 +1,291 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultFilename is the prefix used to name the files of the AOF, the equivalent of the "appendfilename"
+// directive
+const DefaultFilename = "appendonly.aof"
+
+// DefaultDir is the path of the AOF when the "appenddirname" directive is not set. It's the path of the single file
+// written by the versions before the AOF was split into multiple files, so that file is moved into a directory at
+// the same path on Open, instead of being ignored.
+const DefaultDir = "./redis.aof"
+
+// fileType is the type of the files listed in the manifest
+type fileType byte
+
+const (
+	// baseFile contains the dataset at the moment of the last rewrite. There is at most one.
+	baseFile fileType = 'b'
+	// incrFile contains the commands executed after the base file was created. The last one is the file
+	// being written.
+	incrFile fileType = 'i'
+)
+
+// manifestFile is a file of the AOF, as listed in the manifest
+type manifestFile struct {
+	name string
+	seq  int
+	typ  fileType
+}
+
+// manifest lists the files that compose the AOF, in the order they must be replayed: the base file (if any)
+// followed by the incremental files. It's stored on {filename}.manifest, one file per line:
+//
+//	file appendonly.aof.2.base.aof seq 2 type b
+//	file appendonly.aof.5.incr.aof seq 5 type i
+//
+// The manifest is never modified in place: a new one is written and renamed, so it's replaced atomically.
+type manifest struct {
+	filename string
+	files    []manifestFile
+}
+
+func manifestPath(dir, filename string) string {
+	return filepath.Join(dir, filename+".manifest")
+}
+
+// readManifest reads the manifest of the AOF stored at dir. If the manifest does not exist, an error wrapping
+// os.ErrNotExist is returned.
+func readManifest(dir, filename string) (manifest, error) {
+	m := manifest{filename: filename}
+
+	content, err := os.ReadFile(manifestPath(dir, filename))
+	if err != nil {
+		return m, err
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; s.Scan(); line++ {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+
+		f, err := parseManifestLine(s.Text())
+		if err != nil {
+			return m, fmt.Errorf("invalid manifest %s, line %d: %w", manifestPath(dir, filename), line, err)
+		}
+
+		m.files = append(m.files, f)
+	}
+
+	if _, ok := m.last(incrFile); !ok {
+		return m, fmt.Errorf("invalid manifest %s: no incremental file found", manifestPath(dir, filename))
+	}
+
+	return m, nil
+}
+
+func parseManifestLine(line string) (manifestFile, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 || fields[0] != "file" || fields[2] != "seq" || fields[4] != "type" {
+		return manifestFile{}, fmt.Errorf("unexpected format %q", line)
+	}
+
+	seq, err := strconv.Atoi(fields[3])
+	if err != nil || seq <= 0 {
+		return manifestFile{}, fmt.Errorf("invalid sequence %q", fields[3])
+	}
+
+	typ := fileType(fields[5][0])
+	if len(fields[5]) != 1 || (typ != baseFile && typ != incrFile) {
+		return manifestFile{}, fmt.Errorf("invalid type %q", fields[5])
+	}
+
+	// The manifest can only point to files on the same directory
+	if filepath.Base(fields[1]) != fields[1] {
+		return manifestFile{}, fmt.Errorf("invalid file name %q", fields[1])
+	}
+
+	return manifestFile{name: fields[1], seq: seq, typ: typ}, nil
+}
+
+// last returns the last file of type typ
+func (m manifest) last(typ fileType) (manifestFile, bool) {
+	for i := len(m.files) - 1; i >= 0; i-- {
+		if m.files[i].typ == typ {
+			return m.files[i], true
+		}
+	}
+	return manifestFile{}, false
+}
+
+// next returns a new file of type typ, with the sequence number following the last one of that type
+func (m manifest) next(typ fileType) manifestFile {
+	seq := 1
+	if last, ok := m.last(typ); ok {
+		seq = last.seq + 1
+	}
+
+	kind := "incr"
+	if typ == baseFile {
+		kind = "base"
+	}
+
+	return manifestFile{name: fmt.Sprintf("%s.%d.%s.aof", m.filename, seq, kind), seq: seq, typ: typ}
+}
+
+// with returns a copy of the manifest with f appended
+func (m manifest) with(f manifestFile) manifest {
+	files := append(append([]manifestFile(nil), m.files...), f)
+	return manifest{filename: m.filename, files: files}
+}
+
+// contains returns true if the file name is listed
+func (m manifest) contains(name string) bool {
+	for _, f := range m.files {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// paths returns the path of the files, in the order they must be replayed
+func (m manifest) paths(dir string) []string {
+	paths := make([]string, 0, len(m.files))
+	for _, f := range m.files {
+		paths = append(paths, filepath.Join(dir, f.name))
+	}
+	return paths
+}
+
+// size returns the sum of the size of the files
+func (m manifest) size(dir string) (int64, error) {
+	var size int64
+	for _, path := range m.paths(dir) {
+		stat, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // The last incremental file is created when it's opened
+		} else if err != nil {
+			return 0, err
+		}
+		size += stat.Size()
+	}
+	return size, nil
+}
+
+// write replaces atomically the manifest stored at dir
+func (m manifest) write(dir string) error {
+	var buf bytes.Buffer
+	for _, f := range m.files {
+		fmt.Fprintf(&buf, "file %s seq %d type %c\n", f.name, f.seq, f.typ)
+	}
+
+	tmp, err := os.CreateTemp(dir, "temp-manifest-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }() // Nothing to remove if the rename succeeds
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), manifestPath(dir, m.filename)); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// removeUnused removes the files of the AOF that are not listed in the manifest (eg: the files replaced by
+// a rewrite, or temporary files left behind by a crash)
+func (m manifest) removeUnused(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, e := range entries {
+		name := e.Name()
+		ownFile := strings.HasPrefix(name, m.filename+".") && strings.HasSuffix(name, ".aof")
+		tmpFile := strings.HasPrefix(name, "temp-rewriteaof-") || strings.HasPrefix(name, "temp-manifest-")
+		if e.IsDir() || !(ownFile || tmpFile) || m.contains(name) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Files returns the paths of the files that compose the AOF stored at dir, in the order they must be replayed.
+// If dir is a regular file, it's an AOF created before the AOF was split into multiple files, and it's the only
+// file returned.
+//
+// If the AOF does not exist, an error wrapping os.ErrNotExist is returned.
+func Files(dir, filename string) ([]string, error) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !stat.IsDir() {
+		return []string{dir}, nil
+	}
+
+	m, err := readManifest(dir, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.paths(dir), nil
+}
+
+// upgrade moves an AOF created before the AOF was split into multiple files (a single file found at path)
+// into a directory at the same path, where it becomes the first incremental file. The new commands are appended
+// to it, and if it's truncated, it can be loaded with aof-load-truncated as it's the last file.
+//
+// The new directory is prepared aside and then renamed, so a crash leaves either the old file or the new
+// directory. If it crashes between both renames, the upgrade is completed by calling upgrade again.
+func upgrade(path, filename string) error {
+	tmpDir := path + ".upgrade"
+
+	m := manifest{filename: filename}
+	incr := m.next(incrFile)
+	m = m.with(incr)
+
+	if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+		if err := os.MkdirAll(tmpDir, 0700); err != nil {
+			return err
+		}
+
+		if err := os.Rename(path, filepath.Join(tmpDir, incr.name)); err != nil {
+			return err
+		}
+	}
+
+	if err := m.write(tmpDir); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpDir, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
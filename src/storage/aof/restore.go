@@ -0,0 +1,360 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"ddia/src/resp"
+	"ddia/src/storage/rdb"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrRestorePoint is returned when the AOF cannot be restored to the point requested
+var ErrRestorePoint = errors.New("invalid restore point")
+
+// Position is a byte offset on one of the files of an AOF, as reported by aof-check
+type Position struct {
+	// File is the name of the file, without its directory
+	File   string
+	Offset int64
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Offset)
+}
+
+// RestoreStats describes the AOF created by Restore
+type RestoreStats struct {
+	// Keys is the number of keys copied from the snapshot found at the beginning of the AOF, if any
+	Keys int
+	// Commands is the number of commands copied, and Skipped the number of commands left out by RestoreSkip
+	Commands, Skipped int
+	// Timestamp is the unix timestamp of the last command copied. 0 if the AOF has no timestamps.
+	Timestamp int64
+	// Truncated is true if the last file of the AOF ends with an incomplete command, that has been discarded
+	Truncated bool
+}
+
+// Restore copies into w the commands of the AOF stored at dir that recreate the dataset at a previous point:
+// up to a point in time (RestoreUntil), up to a byte offset (RestoreUntilOffset), or leaving out specific
+// commands (RestoreSkip). Without options, the whole AOF is copied into a single file.
+//
+// The result is a single-file AOF, without frames, which can be loaded by the server (see Open) or inspected
+// with aof-check. Timestamps are kept, so it can be restored again. If the AOF starts with a snapshot (see
+// aof-use-rdb-preamble), it's copied at the beginning.
+//
+// If a key is set (RestoreWithKey), the AOF is decrypted with it, and the AOF created is encrypted. Offsets of
+// encrypted files are relative to their decrypted content, as reported by aof-check.
+//
+// The commands are copied one by one, and a SELECT is written whenever the database of the next command copied
+// changes, thus whatever point is chosen, the AOF created is consistent.
+func Restore(ctx context.Context, w io.Writer, dir, filename string, opts ...RestoreOption) (RestoreStats, error) {
+	var o restoreOptions
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+
+	files, err := Files(dir, filename)
+	if err != nil {
+		return RestoreStats{}, err
+	}
+
+	if err := o.validate(files); err != nil {
+		return RestoreStats{}, err
+	}
+
+	r := &restorer{ctx: ctx, w: bufio.NewWriter(w), options: o, db: -1}
+	r.out = r.w
+	if o.key != nil {
+		aead, err := newAEAD(o.key)
+		if err != nil {
+			return RestoreStats{}, fmt.Errorf("invalid encryption key: %w", err)
+		}
+
+		_, _ = r.w.WriteString(encryptionMagic) // Errors are returned when flushing
+		r.out = &chunkWriter{w: r.w, aead: aead}
+	}
+
+	for i, file := range files {
+		stop, err := r.restoreFile(file, i == 0, i == len(files)-1)
+		if err != nil {
+			return r.stats, err
+		}
+		if stop {
+			break
+		}
+	}
+
+	for _, p := range o.skip {
+		if !r.skipped[p] {
+			return r.stats, fmt.Errorf("%w: no command starts at %s", ErrRestorePoint, p)
+		}
+	}
+
+	return r.stats, r.w.Flush()
+}
+
+// restorer keeps the state of a Restore in progress
+type restorer struct {
+	ctx context.Context
+	w   *bufio.Writer
+	// out is where the content is written: w, or a chunkWriter over w if the output is encrypted. Each call to
+	// Write contains complete commands.
+	out     io.Writer
+	buf     bytes.Buffer
+	options restoreOptions
+	stats   RestoreStats
+	// db is the database selected on the output, and selected the one selected on the file being read
+	db, selected int
+	// skipped contains the positions of RestoreSkip that have been found
+	skipped map[Position]bool
+}
+
+// restoreFile copies the commands of the file. It returns true if the restore point has been reached, so the
+// following files must not be copied.
+func (r *restorer) restoreFile(path string, first, last bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	name := filepath.Base(path)
+	fr, err := NewFileReader(f, r.options.key)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	br := bufio.NewReader(fr)
+
+	preambleSize, err := r.copyPreamble(br, first)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Each file starts with its own SELECT
+	r.selected = 0
+
+	s := NewScanner(br)
+	for n := 0; s.Scan(); n++ {
+		if n%1024 == 0 {
+			if err := r.ctx.Err(); err != nil {
+				return false, err
+			}
+		}
+
+		pos := Position{File: name, Offset: preambleSize + s.Start()}
+		if r.reached(pos, s.Timestamp()) {
+			return true, nil
+		}
+
+		if err := r.copy(pos, s.Command(), s.Timestamp()); err != nil {
+			return false, err
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		if errors.Is(err, ErrTruncated) && last {
+			r.stats.Truncated = true
+			return true, nil
+		}
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if _, truncated := fr.Truncated(); truncated {
+		if !last {
+			return false, fmt.Errorf("%s: %w: incomplete encrypted chunk", path, ErrTruncated)
+		}
+		r.stats.Truncated = true
+		return true, nil
+	}
+
+	if p := r.options.untilOffset; p != nil && p.File == name {
+		return true, nil // The offset is beyond the end of the file
+	}
+
+	// The base file ends with the time it was created (see Rewrite.Commit). Older points cannot be restored.
+	if strings.HasSuffix(name, ".base.aof") && !r.options.until.IsZero() && s.Timestamp() > r.options.until.Unix() {
+		return false, fmt.Errorf("%w: the AOF has been rewritten at %s, after %s", ErrRestorePoint,
+			time.Unix(s.Timestamp(), 0).UTC().Format(time.RFC3339), r.options.until.UTC().Format(time.RFC3339))
+	}
+
+	return false, nil
+}
+
+// copyPreamble copies the snapshot found at the beginning of the file, if any, and returns its size. Only the
+// first file of the AOF can start with a snapshot.
+func (r *restorer) copyPreamble(br *bufio.Reader, first bool) (int64, error) {
+	magic, err := br.Peek(len(rdb.Magic))
+	if err != nil || string(magic) != rdb.Magic {
+		return 0, nil
+	}
+
+	if !first {
+		return 0, fmt.Errorf("%w: unexpected preamble, only the first file can start with a snapshot", ErrCorrupted)
+	}
+
+	reader, err := rdb.NewReader(br)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid preamble: %v", ErrCorrupted, err)
+	}
+
+	writer, err := rdb.NewWriter(r.out)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("%w: invalid preamble: %v", ErrCorrupted, err)
+		}
+
+		if err := writer.Write(record); err != nil {
+			return 0, err
+		}
+		r.stats.Keys++
+	}
+
+	return reader.Offset(), writer.Close()
+}
+
+// reached returns true if the command found at pos, executed at timestamp ts, is after the restore point
+func (r *restorer) reached(pos Position, ts int64) bool {
+	if p := r.options.untilOffset; p != nil && p.File == pos.File && pos.Offset >= p.Offset {
+		return true
+	}
+
+	return !r.options.until.IsZero() && ts > r.options.until.Unix()
+}
+
+// copy writes the command into the output, unless it has to be skipped. SELECT is not copied as is: it's written
+// before the next command copied, only if needed.
+func (r *restorer) copy(pos Position, cmd []string, ts int64) error {
+	if strings.EqualFold(cmd[0], "select") && len(cmd) == 2 {
+		db, err := strconv.Atoi(cmd[1])
+		if err != nil {
+			return fmt.Errorf("%w: invalid SELECT at %s", ErrCorrupted, pos)
+		}
+		r.selected = db
+		return nil
+	}
+
+	for _, p := range r.options.skip {
+		if p == pos {
+			if r.skipped == nil {
+				r.skipped = make(map[Position]bool)
+			}
+			r.skipped[p] = true
+			r.stats.Skipped++
+			return nil
+		}
+	}
+
+	r.buf.Reset()
+	if ts != 0 && ts != r.stats.Timestamp {
+		r.buf.Write(appendTimestamp(nil, ts))
+		r.stats.Timestamp = ts
+	}
+
+	// Writing into a bytes.Buffer never fails
+	if r.db != r.selected {
+		_, _ = resp.NewArray([]string{"SELECT", strconv.Itoa(r.selected)}).WriteTo(&r.buf)
+		r.db = r.selected
+	}
+	_, _ = resp.NewArray(cmd).WriteTo(&r.buf)
+
+	if _, err := r.out.Write(r.buf.Bytes()); err != nil {
+		return err
+	}
+	r.stats.Commands++
+
+	return nil
+}
+
+// RestoreOption selects the commands copied by Restore
+type RestoreOption interface {
+	apply(*restoreOptions)
+}
+
+type restoreOptions struct {
+	until       time.Time
+	untilOffset *Position
+	skip        []Position
+	key         []byte
+}
+
+// validate returns an error if the positions do not belong to the files of the AOF
+func (o restoreOptions) validate(files []string) error {
+	names := make(map[string]bool, len(files))
+	for _, f := range files {
+		names[filepath.Base(f)] = true
+	}
+
+	for _, p := range o.skip {
+		if !names[p.File] {
+			return fmt.Errorf("%w: %s is not a file of the AOF", ErrRestorePoint, p.File)
+		}
+	}
+
+	if p := o.untilOffset; p != nil && !names[p.File] {
+		return fmt.Errorf("%w: %s is not a file of the AOF", ErrRestorePoint, p.File)
+	}
+
+	return nil
+}
+
+type restoreUntil time.Time
+
+func (u restoreUntil) apply(o *restoreOptions) {
+	o.until = time.Time(u)
+}
+
+// RestoreUntil copies the commands executed up to t, included. It requires an AOF written with timestamps (see
+// WithTimestamps), which have a precision of one second.
+func RestoreUntil(t time.Time) RestoreOption {
+	return restoreUntil(t)
+}
+
+type restoreUntilOffset Position
+
+func (u restoreUntilOffset) apply(o *restoreOptions) {
+	p := Position(u)
+	o.untilOffset = &p
+}
+
+// RestoreUntilOffset copies the commands that start before p. The following files are not copied.
+func RestoreUntilOffset(p Position) RestoreOption {
+	return restoreUntilOffset(p)
+}
+
+type restoreSkip Position
+
+func (s restoreSkip) apply(o *restoreOptions) {
+	o.skip = append(o.skip, Position(s))
+}
+
+// RestoreSkip leaves out the command that starts at p (eg: a FLUSHDB run by mistake). If p is the beginning of a
+// frame, all its commands are left out. Restore fails if no command starts at p.
+func RestoreSkip(p Position) RestoreOption {
+	return restoreSkip(p)
+}
+
+type restoreKey []byte
+
+func (k restoreKey) apply(o *restoreOptions) {
+	o.key = k
+}
+
+// RestoreWithKey decrypts the AOF with key, if it's encrypted (see WithEncryption), and encrypts the AOF created.
+func RestoreWithKey(key []byte) RestoreOption {
+	return restoreKey(key)
+}
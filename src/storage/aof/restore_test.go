@@ -0,0 +1,178 @@
+package aof_test
+
+import (
+	"bytes"
+	"context"
+	"ddia/src/storage/aof"
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const flushCmd = "*1\r\n$7\r\nFLUSHDB\r\n"
+
+func TestRestore(t *testing.T) {
+	tmpFile := path.Join(t.TempDir(), "test.aof")
+	content := "#TS:100\r\n" + selectCmd + setCmd +
+		"#TS:200\r\n" + selectCmd + flushCmd +
+		"#TS:300\r\n" + selectCmd + setCmd
+	if err := os.WriteFile(tmpFile, []byte(content), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	flushAt := aof.Position{File: "test.aof", Offset: int64(strings.Index(content, flushCmd))}
+
+	tests := []struct {
+		name string
+		opts []aof.RestoreOption
+		want [][]string
+	}{
+		{
+			name: "everything",
+			want: [][]string{{"SELECT", "0"}, {"SET", "key", "value"}, {"FLUSHDB"}, {"SET", "key", "value"}},
+		},
+		{
+			name: "until a point in time",
+			opts: []aof.RestoreOption{aof.RestoreUntil(time.Unix(199, 0))},
+			want: [][]string{{"SELECT", "0"}, {"SET", "key", "value"}},
+		},
+		{
+			name: "until an offset",
+			opts: []aof.RestoreOption{aof.RestoreUntilOffset(flushAt)},
+			want: [][]string{{"SELECT", "0"}, {"SET", "key", "value"}},
+		},
+		{
+			name: "skip a command",
+			opts: []aof.RestoreOption{aof.RestoreSkip(flushAt)},
+			want: [][]string{{"SELECT", "0"}, {"SET", "key", "value"}, {"SET", "key", "value"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if _, err := aof.Restore(context.Background(), buf, tmpFile, aof.DefaultFilename, tt.opts...); err != nil {
+				t.Fatalf("expecting no error: %v", err)
+			}
+
+			s := aof.NewScanner(buf)
+			var commands [][]string
+			for s.Scan() {
+				commands = append(commands, s.Command())
+			}
+
+			if err := s.Err(); err != nil {
+				t.Fatalf("expecting no error: %v", err)
+			}
+
+			if !reflect.DeepEqual(commands, tt.want) {
+				t.Fatalf("unexpected commands: %v, want %v", commands, tt.want)
+			}
+		})
+	}
+
+	t.Run("refuse to skip a command that does not exist", func(t *testing.T) {
+		p := aof.Position{File: "test.aof", Offset: flushAt.Offset + 1}
+		_, err := aof.Restore(context.Background(), &bytes.Buffer{}, tmpFile, aof.DefaultFilename, aof.RestoreSkip(p))
+		if !errors.Is(err, aof.ErrRestorePoint) {
+			t.Fatalf("unexpected error: %v, want %v", err, aof.ErrRestorePoint)
+		}
+	})
+}
+
+func TestRestore_Rewritten(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync, aof.WithTimestamps(true))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+
+	if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if data := readAOF(t, dir); !strings.HasPrefix(data, "#TS:") {
+		t.Fatalf("the write has not been annotated with a timestamp: %q", data)
+	}
+
+	r, err := a.StartRewrite()
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := r.Write([]byte(selectCmd + setCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if err := r.Commit(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if _, err := a.Write([]byte(selectCmd + flushCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	// The dataset before the rewrite is not available anymore
+	_, err = aof.Restore(context.Background(), &bytes.Buffer{}, dir, aof.DefaultFilename,
+		aof.RestoreUntil(time.Now().Add(-time.Hour)))
+	if !errors.Is(err, aof.ErrRestorePoint) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrRestorePoint)
+	}
+
+	stats, err := aof.Restore(context.Background(), &bytes.Buffer{}, dir, aof.DefaultFilename,
+		aof.RestoreUntil(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if want := 2; stats.Commands != want {
+		t.Fatalf("unexpected number of commands: %d, want %d", stats.Commands, want)
+	}
+}
+
+func TestRestore_Encrypted(t *testing.T) {
+	dir := path.Join(t.TempDir(), "appendonlydir")
+
+	a, err := aof.Open(context.Background(), dir, aof.AlwaysSync, aof.WithEncryption(testKey))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	if _, err := a.Write([]byte(selectCmd + setCmd)); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	_ = a.Close()
+
+	buf := &bytes.Buffer{}
+	if _, err := aof.Restore(context.Background(), buf, dir, aof.DefaultFilename); !errors.Is(err, aof.ErrEncrypted) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrEncrypted)
+	}
+
+	_, err = aof.Restore(context.Background(), buf, dir, aof.DefaultFilename, aof.RestoreWithKey(testKey))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "value") {
+		t.Fatalf("the AOF restored is not encrypted: %q", buf)
+	}
+
+	restored := path.Join(t.TempDir(), "restored.aof")
+	if err := os.WriteFile(restored, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	data, err := importAll(t, restored, aof.WithDecryption(testKey))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if want := selectCmd + setCmd; data != want {
+		t.Fatalf("unexpected data: %q, want %q", data, want)
+	}
+}
@@ -0,0 +1,256 @@
+package aof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Rewrite represents an AOF compaction in progress. The caller writes the minimal set of commands that recreate
+// the dataset into the Rewrite, and then calls Commit to make it the new base file of the AOF.
+//
+// When the rewrite starts, the AppendOnlyFile starts writing into a new incremental file. On Commit, the manifest
+// is replaced by one listing the new base file followed by the incremental files created since the rewrite
+// started, and the old files are removed. If the rewrite is aborted, the old files and the new incremental file
+// are kept, so no command is lost either way.
+//
+// Only one Rewrite can be in progress at a time. Either Commit or Abort must be called.
+//
+// As with AppendOnlyFile.Write, each call to Write must contain complete commands: if framing is enabled, each
+// call is wrapped in its own frame.
+type Rewrite struct {
+	aof *AppendOnlyFile
+	tmp *os.File
+	w   *bufio.Writer
+	// incr is the incremental file created when the rewrite started. The new base file is followed by it.
+	incr manifestFile
+	// seq is the sequence number of the last frame written into the new file
+	seq    uint64
+	buf    []byte
+	sealed []byte
+	// startedAt is the time of the dataset written into the new file
+	startedAt time.Time
+	// recovering is true if the writes had been discarded when the rewrite started (see ErrDiscarded). If it's
+	// aborted, they are discarded again, as the files before the new incremental file still miss them.
+	recovering bool
+}
+
+// StartRewrite switches the writes to a new incremental file, and returns a Rewrite where the new base file
+// must be written. The caller must make sure that the dataset being written into the Rewrite represents the
+// state of the server at the moment StartRewrite has been called (eg: by holding the locks of all the databases).
+//
+// It's the only way to recover an AOF whose writes have been discarded (see ErrDiscarded): the writes are accepted
+// again into the new incremental file.
+func (a *AppendOnlyFile) StartRewrite() (*Rewrite, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.dir == "" {
+		return nil, ErrRewriteNotSupported
+	}
+
+	if a.rewrite != nil {
+		return nil, ErrRewriteInProgress
+	}
+
+	if a.err != nil && !a.discarded {
+		// The pending writes belong to the current incremental file, they cannot be moved into a new one
+		return nil, fmt.Errorf("the AOF is failing: %w", a.err)
+	}
+
+	tmp, err := os.CreateTemp(a.dir, "temp-rewriteaof-*.aof")
+	if err != nil {
+		return nil, err
+	}
+
+	incr, err := a.openIncr()
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	a.rewrite = &Rewrite{aof: a, tmp: tmp, w: bufio.NewWriter(tmp), incr: incr, startedAt: time.Now(),
+		recovering: a.discarded}
+	a.err, a.discarded = nil, false // The new incremental file has been created: the disk has recovered
+	if a.aead != nil {
+		_, _ = a.rewrite.w.WriteString(encryptionMagic) // Errors are returned by Commit, when flushing
+	}
+
+	return a.rewrite, nil
+}
+
+// openIncr creates a new incremental file and adds it to the manifest. From then on, the writes go to the new
+// file. The caller must hold a.mux.
+func (a *AppendOnlyFile) openIncr() (manifestFile, error) {
+	incr := a.manifest.next(incrFile)
+	path := filepath.Join(a.dir, incr.name)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return incr, err
+	}
+
+	if err := a.writeHeader(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return incr, err
+	}
+
+	// The current file won't be written anymore, thus it's synced before the new file is listed. Unless it misses
+	// writes (see ErrDiscarded): the rewrite replaces it anyway.
+	if err := a.file.Sync(); err != nil && !a.discarded {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return incr, err
+	}
+
+	m := a.manifest.with(incr)
+	if err := m.write(a.dir); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return incr, err
+	}
+
+	_ = a.file.Close()
+	a.file, a.manifest = f, m
+	a.seq = 0            // The new file has its own sequence of frames
+	a.lastTimestamp = 0  // and starts with a timestamp
+	a.synced = a.written // The previous file has been synced
+
+	return incr, nil
+}
+
+// Write writes into the new base file
+func (r *Rewrite) Write(p []byte) (int, error) {
+	data := p
+	if r.aof.framed {
+		r.seq++
+		r.buf = appendFrame(r.buf[:0], r.seq, p)
+		data = r.buf
+	}
+
+	if err := r.write(data); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// write writes data into the new base file, encrypted as a single chunk if encryption is enabled
+func (r *Rewrite) write(data []byte) error {
+	if r.aof.aead != nil {
+		r.sealed = appendChunk(r.sealed[:0], r.aof.aead, data)
+		data = r.sealed
+	}
+
+	_, err := r.w.Write(data)
+	return err
+}
+
+// Preamble returns the writer where the snapshot of the dataset must be written when it's used as preamble of
+// the new base file (see aof-use-rdb-preamble). It must be written before any call to Write. Unlike Write, the
+// preamble is not framed: it has its own checksum. It's encrypted if encryption is enabled.
+func (r *Rewrite) Preamble() io.Writer {
+	if r.aof.aead != nil {
+		return &chunkWriter{w: r.w, aead: r.aof.aead}
+	}
+	return r.w
+}
+
+// Commit makes the new file the base file of the AOF, replacing atomically the manifest. The files that are
+// not needed anymore (the previous base file, and the incremental files created before the rewrite) are removed.
+//
+// With timestamps enabled (see WithTimestamps), the new base file ends with the time the rewrite started: the
+// AOF cannot be restored to a point in time before it.
+func (r *Rewrite) Commit() error {
+	if r.aof.timestamps {
+		if err := r.write(appendTimestamp(nil, r.startedAt.Unix())); err != nil {
+			return r.abort(err)
+		}
+	}
+
+	if err := r.w.Flush(); err != nil {
+		return r.abort(err)
+	}
+
+	if err := r.tmp.Sync(); err != nil {
+		return r.abort(err)
+	}
+
+	a := r.aof
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	base := a.manifest.next(baseFile)
+	if err := os.Rename(r.tmp.Name(), filepath.Join(a.dir, base.name)); err != nil {
+		return r.abortLocked(err)
+	}
+	_ = r.tmp.Close()
+
+	m := manifest{filename: a.filename}.with(base)
+	for i, f := range a.manifest.files {
+		if f == r.incr {
+			m.files = append(m.files, a.manifest.files[i:]...)
+			break
+		}
+	}
+
+	if err := m.write(a.dir); err != nil {
+		// The old manifest is still valid. The new base file will be removed when the AOF is opened again.
+		return r.abortLocked(err)
+	}
+
+	a.manifest, a.rewrite = m, nil
+	if size, err := m.size(a.dir); err == nil {
+		a.size, a.baseSize = size, size
+	}
+
+	// The old files are not needed anymore. If they cannot be removed, they will be removed when the AOF is
+	// opened again.
+	_ = m.removeUnused(a.dir)
+
+	return nil
+}
+
+// Abort discards the rewrite, removing the temporary file. The writes done since the rewrite started are kept
+// on the new incremental file.
+func (r *Rewrite) Abort() error {
+	return r.abort(nil)
+}
+
+func (r *Rewrite) abort(err error) error {
+	r.aof.mux.Lock()
+	defer r.aof.mux.Unlock()
+
+	return r.abortLocked(err)
+}
+
+func (r *Rewrite) abortLocked(err error) error {
+	r.aof.rewrite = nil
+	if r.recovering && !r.aof.discarded {
+		r.aof.discarded = true
+		r.aof.err = fmt.Errorf("%w: the rewrite has been aborted", ErrDiscarded)
+	}
+	_ = r.tmp.Close()
+	_ = os.Remove(r.tmp.Name())
+
+	if err != nil {
+		return fmt.Errorf("aborting rewrite: %w", err)
+	}
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = d.Close() }()
+
+	return d.Sync()
+}
@@ -0,0 +1,249 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"ddia/src/resp"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrTruncated is returned when the AOF ends with an incomplete command. It usually happens when the server
+// crashes (or the disk gets full) while writing into the AOF.
+var ErrTruncated = errors.New("truncated AOF")
+
+// ErrCorrupted is returned when the AOF contains something that is not a valid command
+var ErrCorrupted = errors.New("corrupted AOF")
+
+// Scanner reads the commands stored on an AOF one by one, validating each frame and keeping track of the
+// byte offset of the last complete command. Successive calls to Scan step through the commands. Scanning stops
+// at the end of the file, or at the first invalid frame.
+//
+//	s := aof.NewScanner(f)
+//	for s.Scan() {
+//		fmt.Println(s.Command())
+//	}
+//	if err := s.Err(); err != nil {
+//		// s.Offset() is where the last valid command ends
+//	}
+type Scanner struct {
+	r *countingReader
+	// offset is the position in the file right after the last complete command (or frame), and start the
+	// position where it begins
+	offset, start int64
+	cmd           []string
+	err           error
+	// timestamp is the last timestamp annotation found (see annotationMarker). 0 if none has been found.
+	timestamp int64
+
+	// queue contains the commands of the last frame read, not returned by Scan yet
+	queue [][]string
+	// lastSeq is the sequence number of the last frame read. 0 if no frame has been found.
+	lastSeq uint64
+}
+
+// NewScanner returns a Scanner reading from r
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{r: &countingReader{r: bufio.NewReaderSize(r, 1<<20)}}
+}
+
+// Scan reads the next command, which will then be available through the Command method. It returns false when
+// the scan stops, either by reaching the end of the input or an error.
+//
+// Plain RESP commands and framed commands (see frameMarker) can be mixed on the same input. The checksum and
+// sequence number of each frame are verified. Annotations (see annotationMarker) are not returned as commands.
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+
+	s.cmd = nil
+
+	if len(s.queue) != 0 {
+		s.cmd, s.queue = s.queue[0], s.queue[1:]
+		return true
+	}
+
+	operation, err := s.readOperation()
+	if errors.Is(err, io.EOF) && s.r.n == s.offset {
+		return false // Clean end of the file
+	} else if err != nil {
+		s.err = err
+		return false
+	}
+
+	s.start = s.offset
+
+	switch operation {
+	case resp.ArrayOp:
+		cmd, err := readCommand(s.r)
+		if err != nil {
+			s.err = s.frameError(err)
+			return false
+		}
+		s.cmd = cmd
+	case frameMarker:
+		commands, err := s.readFrame()
+		if err != nil {
+			s.err = err
+			return false
+		}
+		s.cmd, s.queue = commands[0], commands[1:]
+	default:
+		s.err = fmt.Errorf("%w: at offset %d: unexpected operation %q, expecting %q",
+			ErrCorrupted, s.offset, operation, resp.ArrayOp)
+		return false
+	}
+
+	s.offset = s.r.n
+
+	return true
+}
+
+// readOperation returns the operation of the next command or frame, consuming the annotations found before it
+func (s *Scanner) readOperation() (byte, error) {
+	for {
+		operation, err := resp.ReadOperation(s.r)
+		if errors.Is(err, io.EOF) && s.r.n == s.offset {
+			return 0, err
+		} else if err != nil {
+			return 0, s.frameError(err)
+		}
+
+		if operation != annotationMarker {
+			return operation, nil
+		}
+
+		ts, ok, err := readAnnotation(s.r)
+		if err != nil {
+			return 0, s.frameError(err)
+		}
+		if ok {
+			s.timestamp = ts
+		}
+		s.offset = s.r.n
+	}
+}
+
+// readFrame reads a frame, verifying its integrity, and returns the commands it contains
+func (s *Scanner) readFrame() ([][]string, error) {
+	header, err := readFrameHeader(s.r)
+	if err != nil {
+		return nil, s.frameError(err)
+	}
+
+	payload := make([]byte, header.length)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return nil, s.frameError(err)
+	}
+
+	if err := header.verify(payload); err != nil {
+		return nil, fmt.Errorf("%w: at offset %d: %v", ErrCorrupted, s.offset, err)
+	}
+
+	if s.lastSeq != 0 && header.seq != s.lastSeq+1 {
+		return nil, fmt.Errorf("%w: at offset %d: frame %d found after frame %d, frames are missing or duplicated",
+			ErrCorrupted, s.offset, header.seq, s.lastSeq)
+	}
+	s.lastSeq = header.seq
+
+	var commands [][]string
+	r := bytes.NewReader(payload)
+	for r.Len() > 0 {
+		operation, err := resp.ReadOperation(r)
+		if err == nil && operation != resp.ArrayOp {
+			err = fmt.Errorf("unexpected operation %q, expecting %q", operation, resp.ArrayOp)
+		}
+
+		var cmd []string
+		if err == nil {
+			cmd, err = readCommand(r)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: at offset %d: invalid command in frame %d: %v",
+				ErrCorrupted, s.offset, header.seq, err)
+		}
+
+		commands = append(commands, cmd)
+	}
+
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("%w: at offset %d: empty frame %d", ErrCorrupted, s.offset, header.seq)
+	}
+
+	return commands, nil
+}
+
+// readCommand reads a RESP array, once the operation ('*') has already been consumed
+func readCommand(r io.Reader) ([]string, error) {
+	array := &resp.Array{}
+	if _, err := array.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	if len(array.Strings()) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	return array.Strings(), nil
+}
+
+// Command returns the most recent command read by Scan
+func (s *Scanner) Command() []string {
+	return s.cmd
+}
+
+// Start returns the position on the input where the most recent command read by Scan begins. Commands read
+// from the same frame share the position of the frame.
+func (s *Scanner) Start() int64 {
+	return s.start
+}
+
+// Timestamp returns the unix timestamp of the most recent command read by Scan, as annotated on the AOF when it
+// was written (see WithTimestamps). The command has been executed during that second or later. It returns 0 if
+// no timestamp has been found yet.
+func (s *Scanner) Timestamp() int64 {
+	return s.timestamp
+}
+
+// Offset returns the position on the input right after the last complete command. On error, the input
+// is valid up to Offset.
+func (s *Scanner) Offset() int64 {
+	return s.offset
+}
+
+// Err returns the first error encountered by the Scanner. It returns nil if the end of the input has been
+// reached cleanly. The error wraps ErrTruncated if the input ends in the middle of a command, or ErrCorrupted
+// if an invalid frame has been found.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// frameError classifies an error found while reading a frame. If we've reached the end of the input, the frame
+// was incomplete. Otherwise, the content of the frame is invalid.
+func (s *Scanner) frameError(err error) error {
+	if s.r.eof {
+		return fmt.Errorf("%w: unexpected end of file at offset %d, last valid command ends at offset %d",
+			ErrTruncated, s.r.n, s.offset)
+	}
+
+	return fmt.Errorf("%w: invalid command at offset %d: %v", ErrCorrupted, s.offset, err)
+}
+
+// countingReader counts the bytes read, and remembers if the end of the input has been reached
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	eof bool
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if errors.Is(err, io.EOF) {
+		c.eof = true
+	}
+	return n, err
+}
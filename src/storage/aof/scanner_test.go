@@ -0,0 +1,104 @@
+package aof_test
+
+import (
+	"ddia/src/storage/aof"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	selectCmd = "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n"
+	setCmd    = "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"
+)
+
+func TestScanner(t *testing.T) {
+	s := aof.NewScanner(strings.NewReader(selectCmd + setCmd))
+
+	var commands [][]string
+	for s.Scan() {
+		commands = append(commands, s.Command())
+	}
+
+	if err := s.Err(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	want := [][]string{{"SELECT", "0"}, {"SET", "key", "value"}}
+	if !reflect.DeepEqual(commands, want) {
+		t.Fatalf("unexpected commands: %v, want %v", commands, want)
+	}
+
+	if want := int64(len(selectCmd + setCmd)); s.Offset() != want {
+		t.Fatalf("unexpected offset: %d, want %d", s.Offset(), want)
+	}
+}
+
+func TestScanner_Truncated(t *testing.T) {
+	s := aof.NewScanner(strings.NewReader(selectCmd + setCmd[:len(setCmd)-4]))
+
+	count := 0
+	for s.Scan() {
+		count++
+	}
+
+	if want := 1; count != want {
+		t.Fatalf("unexpected number of commands: %d, want %d", count, want)
+	}
+
+	if err := s.Err(); !errors.Is(err, aof.ErrTruncated) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrTruncated)
+	}
+
+	if want := int64(len(selectCmd)); s.Offset() != want {
+		t.Fatalf("unexpected offset: %d, want %d", s.Offset(), want)
+	}
+}
+
+func TestScanner_Corrupted(t *testing.T) {
+	corrupted := strings.Replace(setCmd, "$5", "$X", 1)
+	s := aof.NewScanner(strings.NewReader(selectCmd + corrupted + setCmd))
+
+	for s.Scan() {
+	}
+
+	if err := s.Err(); !errors.Is(err, aof.ErrCorrupted) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrCorrupted)
+	}
+
+	if want := int64(len(selectCmd)); s.Offset() != want {
+		t.Fatalf("unexpected offset: %d, want %d", s.Offset(), want)
+	}
+}
+
+func TestScanner_Annotations(t *testing.T) {
+	s := aof.NewScanner(strings.NewReader("#TS:100\r\n" + selectCmd + "#unknown\r\n#TS:200\r\n" + setCmd))
+
+	var timestamps []int64
+	var starts []int64
+	for s.Scan() {
+		timestamps = append(timestamps, s.Timestamp())
+		starts = append(starts, s.Start())
+	}
+
+	if err := s.Err(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if want := []int64{100, 200}; !reflect.DeepEqual(timestamps, want) {
+		t.Fatalf("unexpected timestamps: %v, want %v", timestamps, want)
+	}
+
+	if want := []int64{9, int64(9 + len(selectCmd) + 10 + 9)}; !reflect.DeepEqual(starts, want) {
+		t.Fatalf("unexpected starts: %v, want %v", starts, want)
+	}
+
+	s = aof.NewScanner(strings.NewReader(selectCmd + "#TS:1"))
+	for s.Scan() {
+	}
+
+	if err := s.Err(); !errors.Is(err, aof.ErrTruncated) {
+		t.Fatalf("unexpected error: %v, want %v", err, aof.ErrTruncated)
+	}
+}
@@ -0,0 +1,99 @@
+package aof
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File is a file of the AOF, as listed in its manifest
+type File struct {
+	Path string
+	// Seq is the sequence number of the file. The incremental files are numbered in the order they are created.
+	Seq int
+	// Base is true for the file that contains the dataset at the moment of the last rewrite
+	Base bool
+}
+
+// ListFiles returns the files of the AOF stored at dir, in the order they must be replayed. The last one is the
+// incremental file being written. Unlike Files, it only supports AOFs with a manifest.
+//
+// If the AOF does not exist, an error wrapping os.ErrNotExist is returned.
+func ListFiles(dir, filename string) ([]File, error) {
+	m, err := readManifest(dir, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]File, 0, len(m.files))
+	for _, f := range m.files {
+		files = append(files, File{Path: filepath.Join(dir, f.name), Seq: f.seq, Base: f.typ == baseFile})
+	}
+
+	return files, nil
+}
+
+type tail struct {
+	poll   time.Duration
+	sealed func() (bool, error)
+}
+
+func (t tail) apply(opts *importOptions) {
+	opts.tail = &t
+}
+
+// WithTail keeps reading the file while another process writes it, like tail -f, instead of stopping at its end.
+// Each time the end is reached, sealed is called: while it returns false, the file is read again after poll. Once
+// it returns true, the file is not written anymore (eg: it's not the last file of the AOF), and it's read up to
+// its end.
+//
+// A file being followed is never truncated, so it cannot be combined with WithLoadTruncated.
+func WithTail(poll time.Duration, sealed func() (bool, error)) ImportOption {
+	return tail{poll: poll, sealed: sealed}
+}
+
+// tailReader reads f as it grows (see WithTail)
+type tailReader struct {
+	ctx context.Context
+	f   *os.File
+	tail
+	// offset is the number of bytes read
+	offset int64
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.f.Read(p)
+		t.offset += int64(n)
+		if n > 0 || !errors.Is(err, io.EOF) {
+			return n, err
+		}
+
+		if stat, err := t.f.Stat(); err != nil {
+			return 0, err
+		} else if stat.Size() < t.offset {
+			return 0, fmt.Errorf("%s: the file has been truncated to %d bytes, %d already read", t.f.Name(),
+				stat.Size(), t.offset)
+		}
+
+		sealed, err := t.sealed()
+		if err != nil {
+			return 0, err
+		} else if sealed {
+			// The file was complete before it was sealed: what is left is read once more
+			n, err := t.f.Read(p)
+			t.offset += int64(n)
+			return n, err
+		}
+
+		select {
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		case <-time.After(t.poll):
+		}
+	}
+}
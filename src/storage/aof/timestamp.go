@@ -0,0 +1,75 @@
+package aof
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// annotationMarker is the first byte of an annotation: a line of metadata that is not a command. Like frames,
+// it cannot be confused with a RESP command.
+//
+// The only annotation written is the wall-clock time of the commands that follow it, in unix seconds:
+//
+//	#TS:1760870400\r\n
+//
+// It's written before a write when the second has changed since the last one, so the commands found after a
+// timestamp have been executed during that second or later, and before the next timestamp. Unknown annotations
+// are ignored.
+const annotationMarker = '#'
+
+// timestampPrefix is the prefix of a timestamp annotation, once the annotationMarker has been consumed
+const timestampPrefix = "TS:"
+
+// maxAnnotationLength prevents reading garbage forever when looking for the end of a corrupted annotation
+const maxAnnotationLength = 256
+
+// appendTimestamp appends into dst an annotation with the unix timestamp ts
+func appendTimestamp(dst []byte, ts int64) []byte {
+	dst = append(dst, annotationMarker)
+	dst = append(dst, timestampPrefix...)
+	dst = strconv.AppendInt(dst, ts, 10)
+	return append(dst, '\r', '\n')
+}
+
+// readAnnotation reads an annotation from r, once the annotationMarker has been consumed. It returns the timestamp
+// found on it, or ok=false if it's not a timestamp annotation.
+func readAnnotation(r io.Reader) (ts int64, ok bool, err error) {
+	line, err := readLine(r, maxAnnotationLength)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !strings.HasPrefix(line, timestampPrefix) {
+		return 0, false, nil
+	}
+
+	ts, err = strconv.ParseInt(strings.TrimPrefix(line, timestampPrefix), 10, 64)
+	if err != nil || ts < 0 {
+		return 0, false, fmt.Errorf("invalid timestamp annotation %q", line)
+	}
+
+	return ts, true, nil
+}
+
+// readLine reads from r up to the next "\n", byte by byte so nothing is consumed after it. The line is returned
+// without the trailing "\r\n".
+func readLine(r io.Reader, maxLength int) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+		if len(line) > maxLength {
+			return "", fmt.Errorf("line too long")
+		}
+	}
+
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"ddia/src/server"
+	"time"
+)
+
+// Keys are expired lazily: any access to a key whose timeout has passed deletes it, and the key is reported as
+// not found. The server deletes the rest of the expired keys in the background, but until then they would be
+// visible (see Server.lookForKeysToExpire). The server can also hide the key without deleting it, or keep it
+// (see OnExpire).
+
+// SetExpire sets the time when key expires, as a unix timestamp in milliseconds. If the key is not found, returns
+// ErrNotFound.
+func (m *InMemory) SetExpire(key string, expiresAt int64) error {
+	if _, ok := m.lookup(key); !ok {
+		return server.ErrNotFound
+	}
+
+	m.expires[key] = expiresAt
+	return nil
+}
+
+// ExpiresAt returns the unix timestamp in milliseconds when key expires. Returns false if the key does not exist,
+// or it has no timeout.
+func (m *InMemory) ExpiresAt(key string) (int64, bool) {
+	if m.expireIfNeeded(key) {
+		return 0, false
+	}
+
+	expiresAt, ok := m.expires[key]
+	return expiresAt, ok
+}
+
+// Persist removes the timeout of key. Returns true if the key had a timeout.
+func (m *InMemory) Persist(key string) bool {
+	if _, ok := m.ExpiresAt(key); !ok {
+		return false
+	}
+
+	delete(m.expires, key)
+	return true
+}
+
+// OnExpire sets the function called with each key whose timeout has passed, when it's accessed. It returns what is
+// done with the key, server.ExpireDelete by default. It's called with the lock of the database held.
+func (m *InMemory) OnExpire(fn func(key string) server.ExpireMode) {
+	m.onExpire = fn
+}
+
+// lookup returns the record stored at key, deleting it first if it has expired
+func (m *InMemory) lookup(key string) (atom, bool) {
+	if m.expireIfNeeded(key) {
+		return atom{}, false
+	}
+
+	a, ok := m.records[key]
+	return a, ok
+}
+
+// expireIfNeeded deletes key if its timeout has passed, unless onExpire asks to hide or keep it. Returns true if
+// the key must be reported as not found.
+func (m *InMemory) expireIfNeeded(key string) bool {
+	expiresAt, ok := m.expires[key]
+	if !ok || expiresAt > time.Now().UnixMilli() {
+		return false
+	}
+
+	mode := server.ExpireDelete
+	if m.onExpire != nil {
+		mode = m.onExpire(key)
+	}
+
+	switch mode {
+	case server.ExpireKeep:
+		return false
+	case server.ExpireHide:
+		return true
+	default:
+		m.remove(key)
+		return true
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"container/list"
+	"ddia/src/server"
+	"runtime"
+)
+
+// lazyFreeThreshold is the number of elements from which UNLINK frees a value in the background, as in Redis.
+// Smaller values are cheaper to free right away than to hand to another goroutine.
+const lazyFreeThreshold = 64
+
+// Freeing a value means dropping all the references to it: the garbage collector reclaims the memory. Dropping
+// the reference held by the database is done under its lock, and it's cheap whatever the size of the value. Then,
+// the values are taken apart on a goroutine (eg: the elements of a list are unlinked one by one), off the lock.
+
+// Unlink removes a key, like Del. Big values are freed in the background (see lazyFreeThreshold).
+func (m *InMemory) Unlink(key string) bool {
+	if m.expireIfNeeded(key) {
+		return false
+	}
+
+	a, ok := m.records[key]
+	if !ok {
+		return false
+	}
+	m.remove(key)
+
+	if l, ok := a.value.(*list.List); ok && l.Len() >= lazyFreeThreshold {
+		m.freeLazily(1, func() { freeList(l) })
+	}
+
+	return true
+}
+
+// FlushDBAsync removes all keys in the database, like FlushDB, freeing them in the background
+func (m *InMemory) FlushDBAsync() error {
+	records := m.records
+	if err := m.FlushDB(); err != nil {
+		return err
+	}
+
+	m.freeLazily(int64(len(records)), func() { freeRecords(records) })
+	return nil
+}
+
+// LazyFreeStats returns the number of values being freed in the background, and the ones already freed. It can be
+// called without holding the lock.
+func (m *InMemory) LazyFreeStats() server.LazyFreeStats {
+	return server.LazyFreeStats{Pending: m.lazyFreePending.Load(), Freed: m.lazyFreed.Load()}
+}
+
+// freeLazily runs free, which frees n values, on a new goroutine
+func (m *InMemory) freeLazily(n int64, free func()) {
+	m.lazyFreePending.Add(n)
+	go func() {
+		free()
+		m.lazyFreePending.Add(-n)
+		m.lazyFreed.Add(n)
+	}()
+}
+
+// freeRecords takes apart records, which must not be referenced by any database anymore
+func freeRecords(records map[string]atom) {
+	for key, a := range records {
+		if l, ok := a.value.(*list.List); ok {
+			freeList(l)
+		}
+		delete(records, key)
+	}
+}
+
+// freeList unlinks the elements of l, which must not be referenced by any database anymore. It yields between
+// batches, so freeing a big list does not delay the goroutines serving the clients.
+func freeList(l *list.List) {
+	for i := 0; l.Len() > 0; i++ {
+		l.Remove(l.Front())
+		if i%lazyFreeThreshold == 0 {
+			runtime.Gosched()
+		}
+	}
+}
@@ -35,20 +35,26 @@ func (m *InMemory) LTrim(key string, start, stop int) error {
 
 	// Same as "keep no elements in the list"
 	if start > stop {
-		m.saveList(key, list.New())
+		m.saveList(key, list.New(), 0)
 		return nil
 	}
 
-	n := l.Front()
-	for i := 0; i < l.Len(); i++ {
+	var delta int64
+	n, length := l.Front(), l.Len()
+	for i := 0; i < length; i++ {
 		next := n.Next()
 		if i < start || i > stop {
+			v, err := m.listReadValue(n)
+			if err != nil {
+				return err
+			}
 			l.Remove(n)
+			delta -= listElementSize(v)
 		}
 		n = next
 	}
 
-	m.saveList(key, l)
+	m.saveList(key, l, delta)
 
 	return nil
 }
@@ -72,6 +78,7 @@ func (m *InMemory) LRange(key string, start, stop int) (values []string, err err
 	}
 
 	start, stop = toPositive(start), toPositive(stop)
+	m.touch(key)
 
 	// If start is larger than the end of the list, an empty list is returned
 	if start > l.Len() {
@@ -124,7 +131,8 @@ func (m *InMemory) LRem(key string, count int, element string) (removed int, err
 		count = -count
 	}
 
-	for i := 0; i < l.Len() && count > 0; i++ {
+	length := l.Len()
+	for i := 0; i < length && count > 0; i++ {
 		next := move(n)
 
 		if v, ok := n.Value.(string); !ok {
@@ -138,7 +146,7 @@ func (m *InMemory) LRem(key string, count int, element string) (removed int, err
 		n = next
 	}
 
-	m.saveList(key, l)
+	m.saveList(key, l, -int64(removed)*listElementSize(element))
 
 	return removed, nil
 }
@@ -157,6 +165,7 @@ func (m *InMemory) LIndex(key string, index int) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	m.touch(key)
 
 	value, ok := n.Value.(string)
 	if !ok {
@@ -199,7 +208,13 @@ func (m *InMemory) LSet(key string, index int, value string) error {
 		}
 	}
 
+	old, err := m.listReadValue(n)
+	if err != nil {
+		return err
+	}
+
 	n.Value = value
+	m.saveList(key, l, listElementSize(value)-listElementSize(old))
 
 	return nil
 }
@@ -222,7 +237,7 @@ func (m *InMemory) LPop(key string) (string, error) {
 	}
 
 	l.Remove(first)
-	m.saveList(key, l)
+	m.saveList(key, l, -listElementSize(v))
 
 	return v, nil
 }
@@ -245,7 +260,7 @@ func (m *InMemory) RPop(key string) (string, error) {
 	}
 
 	l.Remove(last)
-	m.saveList(key, l)
+	m.saveList(key, l, -listElementSize(v))
 
 	return v, nil
 }
@@ -257,11 +272,13 @@ func (m *InMemory) LPush(key string, values []string) (int, error) {
 		return 0, err
 	}
 
+	var delta int64
 	for _, value := range values {
 		l.PushFront(value)
+		delta += listElementSize(value)
 	}
 
-	m.saveList(key, l)
+	m.saveList(key, l, delta)
 
 	return len(values), nil
 }
@@ -273,11 +290,13 @@ func (m *InMemory) RPush(key string, values []string) (int, error) {
 		return 0, err
 	}
 
+	var delta int64
 	for _, value := range values {
 		l.PushBack(value)
+		delta += listElementSize(value)
 	}
 
-	m.saveList(key, l)
+	m.saveList(key, l, delta)
 
 	return len(values), nil
 }
@@ -288,10 +307,11 @@ func (m *InMemory) LLen(key string) (int, error) {
 		return 0, err
 	}
 
-	a, ok := m.records[key]
+	a, ok := m.lookup(key)
 	if !ok {
 		return 0, nil // List does not exist? Return it  has 0 elements.
 	}
+	m.touch(key)
 
 	l, err := a.List()
 	if err != nil {
@@ -376,12 +396,18 @@ func (m *InMemory) listGetLast(l *list.List) (*list.Element, error) {
 	return first, nil
 }
 
-// saveList must be called after all the operations that remove elements from the list. If the list becomes empty
-// we need to remove the key from the storage.
-func (m *InMemory) saveList(key string, l *list.List) {
+// saveList must be called after all the operations that modify the list, with delta being the number of bytes
+// added (or removed, if negative) to the list. If the list becomes empty we need to remove the key from the storage.
+func (m *InMemory) saveList(key string, l *list.List, delta int64) {
 	if l.Len() == 0 {
-		delete(m.records, key)
+		m.remove(key)
+		return
+	}
+
+	size := int64(listOverhead)
+	if a, ok := m.records[key]; ok {
+		size = a.size
 	}
 
-	m.records[key] = atom{kind: listKind, value: l}
+	m.store(key, atom{kind: listKind, value: l, size: size + delta})
 }
@@ -6,8 +6,11 @@ import (
 	"container/list"
 	"ddia/src/server"
 	"errors"
+	"fmt"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ErrTypeCorruption shouldNeverHappen™ and is being returned when an atom cannot
@@ -32,10 +35,28 @@ const (
 	listKind kind = 2
 )
 
+// String returns the name of the kind, as reported by the TYPE command
+func (k kind) String() string {
+	switch k {
+	case stringKind:
+		return "string"
+	case listKind:
+		return "list"
+	default:
+		return "none"
+	}
+}
+
 // atom represents an indivisible datatype of a certain type
 type atom struct {
 	kind  kind
 	value any
+	// size is the approximated number of bytes used by the value
+	size int64
+	// accessedAt is the last time the atom has been accessed, in unix milliseconds (LRU clock)
+	accessedAt int64
+	// frequency is a logarithmic counter of the accesses to the atom (LFU counter), see touch
+	frequency uint8
 }
 
 func (a atom) String() (string, error) {
@@ -75,6 +96,18 @@ func (a atom) List() (*list.List, error) {
 type InMemory struct {
 	records    map[string]atom
 	recordsMux sync.RWMutex
+	// used is the approximated number of bytes used by the records. It's read without holding the lock.
+	used atomic.Int64
+	// byKind breaks down the records and the memory they use by kind (see account)
+	byKind [listKind + 1]server.MemoryStats
+	// expires holds the unix timestamp in milliseconds when each volatile key expires. An entry lives as long as
+	// its key: it's removed when the key is deleted or overwritten, and moved when the key is renamed.
+	expires map[string]int64
+	// onExpire is called with each key accessed after its timeout has passed (see OnExpire)
+	onExpire func(key string) server.ExpireMode
+	// lazyFreePending and lazyFreed count the values being freed in the background, and the ones already freed
+	lazyFreePending atomic.Int64
+	lazyFreed       atomic.Int64
 }
 
 // NewInMemory returns an in-memory storage
@@ -82,6 +115,7 @@ func NewInMemory() *InMemory {
 	return &InMemory{
 		records:    make(map[string]atom),
 		recordsMux: sync.RWMutex{},
+		expires:    make(map[string]int64),
 	}
 }
 
@@ -95,23 +129,25 @@ func (m *InMemory) Unlock() {
 	m.recordsMux.Unlock()
 }
 
-// Set stores or overwrites the key with the given value
+// Set stores or overwrites the key with the given value. The timeout of the key, if any, is discarded.
 func (m *InMemory) Set(key, value string) error {
 	if err := m.assertType(key, stringKind); err != nil {
 		return err
 	}
 
-	m.records[key] = atom{kind: stringKind, value: value}
+	m.store(key, atom{kind: stringKind, value: value, size: stringSize(value)})
+	delete(m.expires, key)
 
 	return nil
 }
 
 // Get returns value of the given key. If the key is not found, returns ErrNotFound
 func (m *InMemory) Get(key string) (string, error) {
-	a, ok := m.records[key]
+	a, ok := m.lookup(key)
 	if !ok {
 		return "", server.ErrNotFound
 	}
+	m.touch(key)
 
 	v, err := a.String()
 	if err != nil {
@@ -123,7 +159,7 @@ func (m *InMemory) Get(key string) (string, error) {
 
 // IncrementBy increments the counter key by amount, returning the new value
 func (m *InMemory) IncrementBy(key string, amount int) (string, error) {
-	a, ok := m.records[key]
+	a, ok := m.lookup(key)
 	if !ok { // Key does not exist, we create one with default value to 0
 		a = atom{kind: stringKind, value: "0"}
 	}
@@ -136,8 +172,8 @@ func (m *InMemory) IncrementBy(key string, amount int) (string, error) {
 	i += amount // TODO: Check if the integer is out of bounds
 
 	newValue := strconv.Itoa(i)
-	a.value = newValue
-	m.records[key] = a
+	a.value, a.size = newValue, stringSize(newValue)
+	m.store(key, a)
 
 	return newValue, nil
 }
@@ -149,21 +185,42 @@ func (m *InMemory) Size() int {
 
 // Del removes a key. Returns true if existed, False otherwise.
 func (m *InMemory) Del(key string) bool {
-	_, found := m.records[key]
-	delete(m.records, key)
-	return found
+	if m.expireIfNeeded(key) {
+		return false
+	}
+	return m.remove(key)
 }
 
 // FlushDB removes all keys in the database
 func (m *InMemory) FlushDB() error {
 	m.records = make(map[string]atom)
+	m.expires = make(map[string]int64)
+	m.used.Store(0)
+	m.byKind = [listKind + 1]server.MemoryStats{}
+
+	return nil
+}
+
+// Swap exchanges all the keys, with their timeouts, with the ones of other. Both databases must be InMemory.
+func (m *InMemory) Swap(other server.Storage) error {
+	o, ok := other.(*InMemory)
+	if !ok {
+		return fmt.Errorf("%w: cannot swap with %T", ErrTypeCorruption, other)
+	}
+
+	m.records, o.records = o.records, m.records
+	m.expires, o.expires = o.expires, m.expires
+	m.byKind, o.byKind = o.byKind, m.byKind
+	used := m.used.Load()
+	m.used.Store(o.used.Load())
+	o.used.Store(used)
 
 	return nil
 }
 
 // Exists returns ErrNotFound if key does not exist, return null otherwise
 func (m *InMemory) Exists(key string) error {
-	_, ok := m.records[key]
+	_, ok := m.lookup(key)
 	if !ok {
 		return server.ErrNotFound
 	}
@@ -174,26 +231,103 @@ func (m *InMemory) Exists(key string) error {
 // RandomKey return a random key from all the records on the present database
 func (m *InMemory) RandomKey() (string, bool) {
 	for k := range m.records {
+		if m.expireIfNeeded(k) {
+			continue // Deleting the current key while iterating a map is safe
+		}
 		return k, true
 	}
 	return "", false
 }
 
-// Rename renames key to newkey. It returns an error when key does not exist.
+// Rename renames key to newkey. It returns an error when key does not exist. The timeout of key is moved to
+// newkey, and the one of newkey, if any, is discarded.
 func (m *InMemory) Rename(oldKey string, newKey string) error {
-	value, ok := m.records[oldKey]
+	value, ok := m.lookup(oldKey)
 	if !ok {
 		return server.ErrNotFound
 	}
+	expiresAt, volatile := m.expires[oldKey]
+	m.remove(oldKey)
+	m.remove(newKey)
 	m.records[newKey] = value
-	delete(m.records, oldKey)
+	m.account(newKey, value, 1)
+	if volatile {
+		m.expires[newKey] = expiresAt
+	}
 	return nil
 }
 
+// Touch records an access to key. Returns false if the key does not exist.
+func (m *InMemory) Touch(key string) bool {
+	if _, ok := m.lookup(key); !ok {
+		return false
+	}
+	m.touch(key)
+	return true
+}
+
+// Keys returns all the keys stored in the database, in no particular order. Expired keys are deleted instead.
+func (m *InMemory) Keys() []string {
+	keys := make([]string, 0, len(m.records))
+	for k := range m.records {
+		if m.expireIfNeeded(k) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Type returns the kind of value stored at key ("string", "list"). If the key is not found, returns ErrNotFound
+func (m *InMemory) Type(key string) (string, error) {
+	a, ok := m.lookup(key)
+	if !ok {
+		return "", server.ErrNotFound
+	}
+	return a.kind.String(), nil
+}
+
 // assertType returns an error ErrWrongKind if the key exists, and it's different from kind
 func (m *InMemory) assertType(key string, kind kind) error {
-	if atom, ok := m.records[key]; ok && atom.kind != kind {
+	if atom, ok := m.lookup(key); ok && atom.kind != kind {
 		return server.ErrWrongKind
 	}
 	return nil
 }
+
+// store saves a at key, keeping the memory used by the database up to date. The access statistics of the value
+// being overwritten are kept, and the write is recorded as an access.
+func (m *InMemory) store(key string, a atom) {
+	now := time.Now()
+	if old, ok := m.records[key]; ok {
+		m.account(key, old, -1)
+		a.accessedAt, a.frequency = old.accessedAt, old.frequency
+	} else {
+		a.accessedAt, a.frequency = now.UnixMilli(), lfuInitValue
+	}
+
+	a.touch(now)
+	m.records[key] = a
+	m.account(key, a, 1)
+}
+
+// remove deletes key, keeping the memory used by the database up to date. Returns true if key existed.
+func (m *InMemory) remove(key string) bool {
+	a, ok := m.records[key]
+	if !ok {
+		return false
+	}
+
+	m.account(key, a, -1)
+	delete(m.records, key)
+	delete(m.expires, key)
+	return true
+}
+
+// touch records an access to key, if it exists
+func (m *InMemory) touch(key string) {
+	if a, ok := m.records[key]; ok {
+		a.touch(time.Now())
+		m.records[key] = a
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"ddia/src/server"
 	"ddia/src/storage"
 	"errors"
+	"reflect"
+	"sort"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestInMemory_GetSet(t *testing.T) {
@@ -108,6 +112,33 @@ func TestInMemory_FlushDB(t *testing.T) {
 	}
 }
 
+func TestInMemory_Swap(t *testing.T) {
+	first, second := storage.NewInMemory(), storage.NewInMemory()
+	_ = first.Set("key", "value")
+	_ = first.SetExpire("key", time.Now().Add(time.Hour).UnixMilli())
+	_, _ = second.RPush("list", []string{"a", "b"})
+	firstUsage, secondUsage := first.MemoryUsage(), second.MemoryUsage()
+
+	if err := first.Swap(second); err != nil {
+		t.Fatalf("expect no error: %v", err)
+	}
+
+	if got, err := first.LRange("list", 0, -1); err != nil || !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("unexpected list: %v (%v)", got, err)
+	}
+	if err := first.Exists("key"); !errors.Is(err, server.ErrNotFound) {
+		t.Fatalf("expecting ErrNotFound, got: %v", err)
+	}
+
+	if _, ok := second.ExpiresAt("key"); !ok {
+		t.Fatalf("expecting the timeout to be swapped with the key")
+	}
+
+	if first.MemoryUsage() != secondUsage || second.MemoryUsage() != firstUsage {
+		t.Fatalf("the memory usage has not been swapped: %d, %d", first.MemoryUsage(), second.MemoryUsage())
+	}
+}
+
 func TestInMemory_Exists(t *testing.T) {
 	store := storage.NewInMemory()
 
@@ -123,3 +154,277 @@ func TestInMemory_Exists(t *testing.T) {
 		t.Fatalf("incorrect error returned: %q, want %q", err.Error(), server.ErrNotFound.Error())
 	}
 }
+
+func TestInMemory_KeysType(t *testing.T) {
+	store := storage.NewInMemory()
+
+	_ = store.Set("key", "value")
+	_, _ = store.RPush("list", []string{"one", "two"})
+
+	keys := store.Keys()
+	sort.Strings(keys)
+	if want := []string{"key", "list"}; !reflect.DeepEqual(keys, want) {
+		t.Fatalf("unexpected keys: %v, want %v", keys, want)
+	}
+
+	if kind, _ := store.Type("key"); kind != "string" {
+		t.Fatalf("unexpected type: %q, want %q", kind, "string")
+	}
+
+	if kind, _ := store.Type("list"); kind != "list" {
+		t.Fatalf("unexpected type: %q, want %q", kind, "list")
+	}
+
+	if _, err := store.Type("non-existing-key"); !errors.Is(err, server.ErrNotFound) {
+		t.Fatalf("incorrect error returned: %v, want %q", err, server.ErrNotFound.Error())
+	}
+}
+
+func TestInMemory_LazyFree(t *testing.T) {
+	store := storage.NewInMemory()
+
+	values := make([]string, 1000)
+	for i := range values {
+		values[i] = strconv.Itoa(i)
+	}
+	_, _ = store.RPush("big", values)
+	_, _ = store.RPush("small", values[:2])
+	_ = store.Set("key", "value")
+
+	if !store.Unlink("big") || !store.Unlink("small") || store.Unlink("non-existing-key") {
+		t.Fatalf("unexpected result of unlink")
+	}
+
+	if err := store.FlushDBAsync(); err != nil {
+		t.Fatalf("expect no error: %v", err)
+	}
+
+	if store.Size() != 0 || store.MemoryUsage() != 0 {
+		t.Fatalf("the database is not empty: %d keys, %d bytes", store.Size(), store.MemoryUsage())
+	}
+
+	// The big list and the key flushed are freed in the background, the small list right away
+	for start := time.Now(); store.LazyFreeStats().Freed != 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("the values have not been freed: %+v", store.LazyFreeStats())
+		}
+	}
+
+	if pending := store.LazyFreeStats().Pending; pending != 0 {
+		t.Fatalf("unexpected pending values: %d", pending)
+	}
+}
+
+func TestInMemory_MemoryUsage(t *testing.T) {
+	store := storage.NewInMemory()
+
+	_ = store.Set("key", "value")
+	used := store.MemoryUsage()
+	if used <= int64(len("key")+len("value")) {
+		t.Fatalf("unexpected memory usage: %d", used)
+	}
+
+	_ = store.Set("key", "a much longer value")
+	if store.MemoryUsage() <= used {
+		t.Fatalf("expecting memory usage to grow: %d, was %d", store.MemoryUsage(), used)
+	}
+
+	_, _ = store.RPush("list", []string{"one", "two", "three"})
+	_, _ = store.LPop("list")
+	_ = store.LSet("list", 0, "a much longer element")
+	_, _ = store.LRem("list", 0, "three")
+	_ = store.Rename("list", "other")
+
+	stats, ok := store.KeyStats("other")
+	if !ok {
+		t.Fatalf("expecting the key to exist")
+	}
+
+	store.Del("other")
+	store.Del("key")
+	if want := int64(0); store.MemoryUsage() != want {
+		t.Fatalf("unexpected memory usage: %d, want %d", store.MemoryUsage(), want)
+	}
+
+	if stats.Size <= int64(len("other")+len("a much longer element")) {
+		t.Fatalf("unexpected size: %d", stats.Size)
+	}
+}
+
+func TestInMemory_Sample(t *testing.T) {
+	store := storage.NewInMemory()
+
+	if samples := store.Sample(5); len(samples) != 0 {
+		t.Fatalf("unexpected samples: %v", samples)
+	}
+
+	_ = store.Set("key", "value")
+	_ = store.Set("other", "value")
+
+	samples := store.Sample(5)
+	if want := 2; len(samples) != want {
+		t.Fatalf("unexpected number of samples: %d, want %d", len(samples), want)
+	}
+
+	for _, s := range samples {
+		if s.Key != "key" && s.Key != "other" {
+			t.Fatalf("unexpected key sampled: %q", s.Key)
+		}
+		if s.Frequency == 0 {
+			t.Fatalf("expecting new keys to have a frequency: %v", s)
+		}
+	}
+}
+
+func TestInMemory_MemoryStats(t *testing.T) {
+	store := storage.NewInMemory()
+
+	_ = store.Set("key", "value")
+	_, _ = store.RPush("list", []string{"one", "two"})
+
+	stats := store.MemoryStats()
+	if stats["string"].Keys != 1 || stats["list"].Keys != 1 {
+		t.Fatalf("unexpected number of keys: %v", stats)
+	}
+
+	if total := stats["string"].Bytes + stats["list"].Bytes; total != store.MemoryUsage() {
+		t.Fatalf("unexpected bytes: %d, want %d", total, store.MemoryUsage())
+	}
+
+	// Each element of a list uses more memory than its content: the node of the list
+	_, _ = store.RPush("list", []string{"x"})
+	if grown := store.MemoryStats()["list"].Bytes - stats["list"].Bytes; grown <= 1 {
+		t.Fatalf("unexpected memory used by the element: %d", grown)
+	}
+
+	_ = store.FlushDB()
+	if stats := store.MemoryStats(); stats["string"].Keys != 0 || stats["list"].Bytes != 0 {
+		t.Fatalf("unexpected stats after flushing: %v", stats)
+	}
+}
+
+func TestInMemory_Expires(t *testing.T) {
+	store := storage.NewInMemory()
+	deadline := time.Now().Add(time.Hour).UnixMilli()
+
+	if err := store.SetExpire("key", deadline); !errors.Is(err, server.ErrNotFound) {
+		t.Fatalf("expecting ErrNotFound, got: %v", err)
+	}
+
+	_ = store.Set("key", "value")
+	_ = store.Set("other", "value")
+	if err := store.SetExpire("key", deadline); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	samples := store.SampleVolatile(5)
+	if len(samples) != 1 || samples[0].Key != "key" || samples[0].ExpiresAt != deadline {
+		t.Fatalf("unexpected samples: %+v", samples)
+	}
+
+	// The timeout is moved with the key
+	_ = store.Rename("key", "renamed")
+	if _, ok := store.ExpiresAt("key"); ok {
+		t.Fatalf("the old key must not have a timeout")
+	}
+	if expiresAt, ok := store.ExpiresAt("renamed"); !ok || expiresAt != deadline {
+		t.Fatalf("unexpected timeout: %d (%v)", expiresAt, ok)
+	}
+
+	// Modifying the value keeps the timeout, overwriting it discards it
+	_, _ = store.IncrementBy("counter", 1)
+	_ = store.SetExpire("counter", deadline)
+	_, _ = store.IncrementBy("counter", 1)
+	if _, ok := store.ExpiresAt("counter"); !ok {
+		t.Fatalf("expecting the counter to keep its timeout")
+	}
+
+	_ = store.Set("counter", "0")
+	if _, ok := store.ExpiresAt("counter"); ok {
+		t.Fatalf("expecting the timeout to be discarded by Set")
+	}
+
+	if !store.Persist("renamed") || store.Persist("renamed") {
+		t.Fatalf("expecting the timeout to be removed once")
+	}
+
+	_ = store.SetExpire("other", deadline)
+	_ = store.FlushDB()
+	_ = store.Set("other", "value")
+	if _, ok := store.ExpiresAt("other"); ok {
+		t.Fatalf("expecting the timeout to be discarded by FlushDB")
+	}
+}
+
+func TestInMemory_LazyExpiration(t *testing.T) {
+	store := storage.NewInMemory()
+
+	var expired []string
+	store.OnExpire(func(key string) server.ExpireMode {
+		expired = append(expired, key)
+		return server.ExpireDelete
+	})
+
+	past := time.Now().Add(-time.Millisecond).UnixMilli()
+	for _, key := range []string{"get", "exists", "del", "keys", "list"} {
+		_ = store.Set(key, "value")
+		_ = store.SetExpire(key, past)
+	}
+
+	if _, err := store.Get("get"); !errors.Is(err, server.ErrNotFound) {
+		t.Fatalf("expecting ErrNotFound, got: %v", err)
+	}
+	if err := store.Exists("exists"); !errors.Is(err, server.ErrNotFound) {
+		t.Fatalf("expecting ErrNotFound, got: %v", err)
+	}
+	if store.Del("del") {
+		t.Fatalf("an expired key must not be reported as deleted")
+	}
+	// An expired key of another kind does not prevent overwriting it
+	if _, err := store.RPush("list", []string{"a"}); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+	if keys := store.Keys(); !reflect.DeepEqual(keys, []string{"list"}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	sort.Strings(expired)
+	if want := []string{"del", "exists", "get", "keys", "list"}; !reflect.DeepEqual(expired, want) {
+		t.Fatalf("unexpected expired keys: %v, want %v", expired, want)
+	}
+
+	if store.Size() != 1 || store.MemoryStats()["string"].Keys != 0 {
+		t.Fatalf("the expired keys have not been deleted: %d keys", store.Size())
+	}
+}
+
+// On a replica, the expired keys are hidden to the clients, and visible to the master, but never deleted
+func TestInMemory_LazyExpiration_Replica(t *testing.T) {
+	store := storage.NewInMemory()
+
+	mode := server.ExpireHide
+	store.OnExpire(func(string) server.ExpireMode { return mode })
+
+	_ = store.Set("key", "value")
+	_ = store.SetExpire("key", time.Now().Add(-time.Millisecond).UnixMilli())
+
+	if _, err := store.Get("key"); !errors.Is(err, server.ErrNotFound) {
+		t.Fatalf("expecting ErrNotFound, got: %v", err)
+	}
+	if keys := store.Keys(); len(keys) != 0 {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	mode = server.ExpireKeep
+	if v, err := store.Get("key"); err != nil || v != "value" {
+		t.Fatalf("expecting the key to be kept, got: %q, %v", v, err)
+	}
+	if !store.Persist("key") {
+		t.Fatalf("expecting the timeout of the key to be removed")
+	}
+
+	mode = server.ExpireHide
+	if v, err := store.Get("key"); err != nil || v != "value" {
+		t.Fatalf("expecting the key not to expire anymore, got: %q, %v", v, err)
+	}
+}
@@ -0,0 +1,57 @@
+package rdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Dump serializes the value of a single key, and its expiration, as used by DUMP and RESTORE. It's a snapshot
+// holding only that key, so it carries the version of the format and a checksum. The database and the name of
+// the key are not kept.
+func Dump(r Record) ([]byte, error) {
+	r.DB, r.Key = 0, ""
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.Write(r); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Undump reads a value serialized by Dump. It returns ErrInvalid if the payload has been created by another
+// version of the format, or if it's corrupted.
+func Undump(payload []byte) (Record, error) {
+	r, err := NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return Record{}, err
+	}
+
+	rec, err := r.Next()
+	if errors.Is(err, io.EOF) {
+		return Record{}, fmt.Errorf("%w: no value", ErrInvalid)
+	} else if err != nil {
+		return Record{}, err
+	}
+
+	if _, err := r.Next(); !errors.Is(err, io.EOF) {
+		return Record{}, fmt.Errorf("%w: more than one value", ErrInvalid)
+	}
+
+	if r.Offset() != int64(len(payload)) {
+		return Record{}, fmt.Errorf("%w: trailing data after the value", ErrInvalid)
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,77 @@
+// Package rdb provides a compact binary format to store a snapshot of the dataset. It's used as preamble of the AOF
+// (see aof-use-rdb-preamble): loading a snapshot is much faster than replaying the commands that recreate it.
+// A snapshot holding a single key is also the serialization of the values used by DUMP and RESTORE (see Dump).
+//
+// The format is inspired by the Redis RDB format, but it's not compatible with it:
+//
+//	"REDIS" "0001"                          header: magic and version
+//	0xFE {db}                               select the database of the following keys
+//	0xFC {unix ms, 8 bytes little endian}   expiration of the following key
+//	{type} {key} {value}                    a key. Strings: {value}. Lists: {length} {element}...
+//	0xFF {CRC32C, 4 bytes little endian}    end of the snapshot, with the checksum of everything before it
+//
+// Numbers ({db}, {length}) are unsigned varints, and strings are written as {length}{bytes}.
+package rdb
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+// Magic is found at the beginning of every snapshot
+const Magic = "REDIS"
+
+// version of the format, written after Magic
+const version = "0001"
+
+const (
+	opExpireTimeMs = 0xFC
+	opSelectDB     = 0xFE
+	opEOF          = 0xFF
+)
+
+const (
+	// maxStringLength prevents allocating huge amounts of memory when the length of a string is corrupted
+	maxStringLength = 512 << 20
+	// maxListLength prevents allocating huge amounts of memory when the length of a list is corrupted
+	maxListLength = 1 << 32
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrInvalid is returned when the snapshot cannot be read: it's not a snapshot, it has been created by an
+// unsupported version, or it's corrupted
+var ErrInvalid = errors.New("invalid snapshot")
+
+// Type is the type of the value of a key
+type Type byte
+
+const (
+	// TypeString is a key holding a string
+	TypeString Type = 0
+	// TypeList is a key holding a list of strings
+	TypeList Type = 1
+)
+
+// String returns the name of the type, as returned by the TYPE command
+func (t Type) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	default:
+		return "unknown"
+	}
+}
+
+// Record is a key stored in the snapshot
+type Record struct {
+	DB    int
+	Key   string
+	Type  Type
+	Value string   // Only for TypeString
+	List  []string // Only for TypeList
+	// ExpiresAt is the unix timestamp in milliseconds when the key expires. 0 if it does not expire.
+	ExpiresAt int64
+}
@@ -0,0 +1,158 @@
+package rdb_test
+
+import (
+	"bytes"
+	"ddia/src/storage/rdb"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var records = []rdb.Record{
+	{DB: 0, Key: "key", Type: rdb.TypeString, Value: "value"},
+	{DB: 0, Key: "expiring", Type: rdb.TypeString, Value: "", ExpiresAt: 1760000000123},
+	{DB: 3, Key: "list", Type: rdb.TypeList, List: []string{"one", "two", "three"}},
+	{DB: 3, Key: "binary\r\n", Type: rdb.TypeString, Value: "\x00\xff"},
+}
+
+func write(t *testing.T, records []rdb.Record) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := rdb.NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	for _, r := range records {
+		if err := w.Write(r); err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func read(snapshot io.Reader) ([]rdb.Record, error) {
+	r, err := rdb.NewReader(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	var read []rdb.Record
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return read, nil
+		} else if err != nil {
+			return read, err
+		}
+		read = append(read, rec)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	snapshot := write(t, records)
+
+	if !bytes.HasPrefix(snapshot, []byte(rdb.Magic)) {
+		t.Fatalf("the snapshot does not start with the magic string: %q", snapshot)
+	}
+
+	got, err := read(bytes.NewReader(snapshot))
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, records) {
+		t.Fatalf("unexpected records: %+v, want %+v", got, records)
+	}
+}
+
+func TestReader_StopsAtTheEnd(t *testing.T) {
+	snapshot := write(t, records)
+	const tail = "*1\r\n$4\r\nPING\r\n"
+
+	r := bytes.NewReader(append(snapshot, tail...))
+	reader, err := rdb.NewReader(r)
+	if err != nil {
+		t.Fatalf("expecting no error: %v", err)
+	}
+
+	for {
+		if _, err := reader.Next(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+	}
+
+	if reader.Offset() != int64(len(snapshot)) {
+		t.Fatalf("unexpected offset: %d, want %d", reader.Offset(), len(snapshot))
+	}
+
+	// What comes after the snapshot can be read from the original reader
+	rest, _ := io.ReadAll(r)
+	if string(rest) != tail {
+		t.Fatalf("unexpected tail: %q, want %q", rest, tail)
+	}
+}
+
+func TestReader_Invalid(t *testing.T) {
+	snapshot := write(t, records)
+
+	tests := map[string][]byte{
+		"not a snapshot":      []byte("*1\r\n$4\r\nPING\r\n"),
+		"unsupported version": append([]byte("REDIS9999"), snapshot[9:]...),
+		"truncated":           snapshot[:len(snapshot)-10],
+		"corrupted":           bytes.Replace(snapshot, []byte("three"), []byte("THREE"), 1),
+	}
+
+	for name, snapshot := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := read(bytes.NewReader(snapshot)); !errors.Is(err, rdb.ErrInvalid) {
+				t.Fatalf("unexpected error: %v, want %v", err, rdb.ErrInvalid)
+			}
+		})
+	}
+}
+
+func TestDump(t *testing.T) {
+	for _, want := range records {
+		payload, err := rdb.Dump(want)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		got, err := rdb.Undump(payload)
+		if err != nil {
+			t.Fatalf("expecting no error: %v", err)
+		}
+
+		// Only the value and its expiration are kept
+		want.DB, want.Key = 0, ""
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected record: %+v, want %+v", got, want)
+		}
+	}
+
+	payload, _ := rdb.Dump(records[2])
+	tests := map[string][]byte{
+		"empty":         write(t, nil),
+		"two values":    write(t, records[:2]),
+		"trailing data": append(payload, 0),
+		"corrupted":     bytes.Replace(payload, []byte("three"), []byte("THREE"), 1),
+	}
+
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := rdb.Undump(payload); !errors.Is(err, rdb.ErrInvalid) {
+				t.Fatalf("unexpected error: %v, want %v", err, rdb.ErrInvalid)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Reader reads the records of a snapshot one by one
+type Reader struct {
+	r   byteReader
+	crc hash.Hash32
+	// n is the number of bytes read
+	n    int64
+	db   int
+	done bool
+}
+
+// NewReader reads the header of the snapshot found on r, and returns a Reader to read its records.
+//
+// If r is an io.ByteReader (eg: bufio.Reader), the Reader never reads beyond the end of the snapshot, so whatever
+// comes after it can be read from r. Otherwise, r is buffered.
+func NewReader(r io.Reader) (*Reader, error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	rr := &Reader{r: br, crc: crc32.New(crc32c)}
+
+	header := make([]byte, len(Magic)+len(version))
+	if err := rr.readFull(header); err != nil {
+		return nil, rr.error(err)
+	}
+
+	if string(header[:len(Magic)]) != Magic {
+		return nil, fmt.Errorf("%w: unexpected header %q", ErrInvalid, header)
+	}
+
+	if v := string(header[len(Magic):]); v != version {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrInvalid, v)
+	}
+
+	return rr, nil
+}
+
+// Next returns the next record. It returns io.EOF once the end of the snapshot has been read, and its checksum
+// verified.
+func (r *Reader) Next() (Record, error) {
+	if r.done {
+		return Record{}, io.EOF
+	}
+
+	rec, err := r.next()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Record{}, r.error(err)
+	}
+
+	return rec, err
+}
+
+func (r *Reader) next() (Record, error) {
+	rec := Record{DB: r.db}
+
+	for {
+		op, err := r.readByte()
+		if err != nil {
+			return rec, err
+		}
+
+		switch op {
+		case opSelectDB:
+			db, err := r.readUvarint()
+			if err != nil {
+				return rec, err
+			}
+			r.db, rec.DB = int(db), int(db)
+		case opExpireTimeMs:
+			b := make([]byte, 8)
+			if err := r.readFull(b); err != nil {
+				return rec, err
+			}
+			rec.ExpiresAt = int64(binary.LittleEndian.Uint64(b))
+		case opEOF:
+			return rec, r.verify()
+		case byte(TypeString), byte(TypeList):
+			rec.Type = Type(op)
+			return rec, r.readValue(&rec)
+		default:
+			return rec, fmt.Errorf("unknown opcode 0x%02x", op)
+		}
+	}
+}
+
+func (r *Reader) readValue(rec *Record) (err error) {
+	if rec.Key, err = r.readString(); err != nil {
+		return err
+	}
+
+	if rec.Type == TypeString {
+		rec.Value, err = r.readString()
+		return err
+	}
+
+	length, err := r.readUvarint()
+	if err != nil {
+		return err
+	}
+	if length > maxListLength {
+		return fmt.Errorf("invalid list length %d", length)
+	}
+
+	capacity := length
+	if capacity > 1024 {
+		capacity = 1024 // The length might be corrupted, grow as the elements are read
+	}
+
+	rec.List = make([]string, 0, capacity)
+	for i := uint64(0); i < length; i++ {
+		element, err := r.readString()
+		if err != nil {
+			return err
+		}
+		rec.List = append(rec.List, element)
+	}
+
+	return nil
+}
+
+// verify reads the checksum written after opEOF, and compares it with the content read
+func (r *Reader) verify() error {
+	want := r.crc.Sum32()
+
+	b := make([]byte, 4)
+	if err := r.readFull(b); err != nil {
+		return err
+	}
+
+	if sum := binary.LittleEndian.Uint32(b); sum != want {
+		return fmt.Errorf("checksum mismatch: %08x, want %08x", sum, want)
+	}
+
+	r.done = true
+	return io.EOF
+}
+
+// Offset returns the number of bytes read. Once Next has returned io.EOF, it's the size of the snapshot.
+func (r *Reader) Offset() int64 {
+	return r.n
+}
+
+func (r *Reader) error(err error) error {
+	return fmt.Errorf("%w: at offset %d: %v", ErrInvalid, r.n, err)
+}
+
+// readByte reads a byte. The end of the input is unexpected: the snapshot ends with opEOF.
+func (r *Reader) readByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if errors.Is(err, io.EOF) {
+		return 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return 0, err
+	}
+
+	r.n++
+	_, _ = r.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (r *Reader) readFull(p []byte) error {
+	n, err := io.ReadFull(r.r, p)
+	r.n += int64(n)
+	_, _ = r.crc.Write(p[:n])
+
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *Reader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(byteReaderFunc(r.readByte))
+}
+
+func (r *Reader) readString() (string, error) {
+	length, err := r.readUvarint()
+	if err != nil {
+		return "", err
+	}
+
+	if length > maxStringLength {
+		return "", fmt.Errorf("invalid string length %d", length)
+	}
+
+	b := make([]byte, length)
+	if err := r.readFull(b); err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type byteReaderFunc func() (byte, error)
+
+func (f byteReaderFunc) ReadByte() (byte, error) {
+	return f()
+}
@@ -0,0 +1,88 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Writer writes a snapshot. Records must be written grouped by database, and Close must be called to write
+// the end of the snapshot.
+type Writer struct {
+	w      *bufio.Writer
+	crc    hash.Hash32
+	lastDB int
+	buf    []byte
+}
+
+// NewWriter writes the header of a snapshot into w, and returns a Writer to write the records
+func NewWriter(w io.Writer) (*Writer, error) {
+	crc := crc32.New(crc32c)
+	rw := &Writer{w: bufio.NewWriter(io.MultiWriter(w, crc)), crc: crc, lastDB: -1}
+
+	if _, err := rw.w.WriteString(Magic + version); err != nil {
+		return nil, err
+	}
+
+	return rw, nil
+}
+
+// Write writes a record
+func (w *Writer) Write(r Record) error {
+	w.buf = w.buf[:0]
+
+	if r.DB != w.lastDB {
+		w.buf = append(w.buf, opSelectDB)
+		w.buf = binary.AppendUvarint(w.buf, uint64(r.DB))
+		w.lastDB = r.DB
+	}
+
+	if r.ExpiresAt != 0 {
+		w.buf = append(w.buf, opExpireTimeMs)
+		w.buf = binary.LittleEndian.AppendUint64(w.buf, uint64(r.ExpiresAt))
+	}
+
+	w.buf = append(w.buf, byte(r.Type))
+	w.buf = appendString(w.buf, r.Key)
+
+	switch r.Type {
+	case TypeString:
+		w.buf = appendString(w.buf, r.Value)
+	case TypeList:
+		w.buf = binary.AppendUvarint(w.buf, uint64(len(r.List)))
+		for _, element := range r.List {
+			w.buf = appendString(w.buf, element)
+		}
+	default:
+		return fmt.Errorf("unknown type %d for key %q", r.Type, r.Key)
+	}
+
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// Close writes the end of the snapshot, with its checksum. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if err := w.w.WriteByte(opEOF); err != nil {
+		return err
+	}
+
+	// Everything must go through the hash before computing the checksum
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w.w, binary.LittleEndian, w.crc.Sum32()); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}